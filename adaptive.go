@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// With -adaptive-retry the retry count follows the success rate of the last
+// attempts: a healthy run retries more since failures are likely blips, a
+// failing one retries less and briefly holds off every download, since the
+// problem is likely on the server's side
+const (
+	adaptiveMinSamples = 10              // attempts seen before the rate is trusted
+	adaptiveHealthy    = 0.9             // success rate above which retries double
+	adaptiveFailing    = 0.5             // success rate below which they halve
+	adaptiveBackoff    = 5 * time.Second // pause applied to all downloads while failing
+)
+
+// successWindow keeps the outcome of the most recent download attempts
+type successWindow struct {
+	mu           sync.Mutex
+	results      []bool
+	next, filled int
+	backoffUntil time.Time
+}
+
+// newSuccessWindow tracks the last size attempts
+func newSuccessWindow(size int) *successWindow {
+	return &successWindow{results: make([]bool, size)}
+}
+
+// add records one attempt, starting a global backoff when the rate is low
+func (w *successWindow) add(ok bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.results[w.next] = ok
+	w.next = (w.next + 1) % len(w.results)
+	w.filled = min(w.filled+1, len(w.results))
+	if !ok && w.filled >= adaptiveMinSamples && w.rateLocked() < adaptiveFailing && time.Now().After(w.backoffUntil) {
+		w.backoffUntil = time.Now().Add(adaptiveBackoff)
+		logf("Most recent downloads are failing, holding off for %v\n", adaptiveBackoff)
+	}
+}
+
+// rateLocked is the share of successful attempts in the window
+func (w *successWindow) rateLocked() float64 {
+	ok := 0
+	for _, r := range w.results[:w.filled] {
+		if r {
+			ok++
+		}
+	}
+	return float64(ok) / float64(w.filled)
+}
+
+// retries scales the configured retry count by the recent success rate
+func (w *successWindow) retries(base int) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.filled < adaptiveMinSamples {
+		return base
+	}
+	switch rate := w.rateLocked(); {
+	case rate >= adaptiveHealthy:
+		return base * 2
+	case rate < adaptiveFailing:
+		return base / 2
+	}
+	return base
+}
+
+// wait blocks while a global backoff is in effect or until the run is canceled
+func (w *successWindow) wait() {
+	w.mu.Lock()
+	until := w.backoffUntil
+	w.mu.Unlock()
+	if d := time.Until(until); d > 0 {
+		sleep(d)
+	}
+}
+
+// retryLimit is how many times a failed download may be retried now
+func (pd *PhotoDownloader) retryLimit() int {
+	if pd.window == nil {
+		return pd.retries
+	}
+	return pd.window.retries(pd.retries)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// animationDelay is the time each frame is shown, in hundredths of a second
+const animationDelay = 10
+
+// frameNumber matches the sequence number at the end of a frame's PhotoCode
+var frameNumber = regexp.MustCompile(`^(.*?)[_-]?(\d+)$`)
+
+// animation is a sequence of photos sharing a ParentID, in frame order
+type animation struct {
+	name   string // output file name without extension
+	frames []Photo
+}
+
+// groupAnimations pulls out photos that are frames of an animation: two or
+// more photos sharing a ParentID whose PhotoCodes end in distinct sequence
+// numbers. Groups that do not fit that pattern are left as individual photos.
+func groupAnimations(photos []Photo) ([]Photo, []animation) {
+	byParent := make(map[string][]Photo)
+	var parents []string
+	for _, p := range photos {
+		if p.ParentID == "" {
+			continue
+		}
+		if _, ok := byParent[p.ParentID]; !ok {
+			parents = append(parents, p.ParentID)
+		}
+		byParent[p.ParentID] = append(byParent[p.ParentID], p)
+	}
+
+	grouped := make(map[string]bool)
+	var animations []animation
+	for _, parent := range parents {
+		a, ok := sequence(parent, byParent[parent])
+		if !ok {
+			continue
+		}
+		for _, f := range a.frames {
+			grouped[f.ID] = true
+		}
+		animations = append(animations, a)
+	}
+
+	rest, _ := filterPhotos(photos, func(p Photo) bool { return !grouped[p.ID] })
+	return rest, animations
+}
+
+// sequence orders frames by their sequence numbers, reporting false when the
+// grouping is ambiguous
+func sequence(parent string, frames []Photo) (animation, bool) {
+	if len(frames) < 2 {
+		return animation{}, false
+	}
+	numbers := make(map[string]int)
+	seen := make(map[int]bool)
+	prefix := ""
+	for i, f := range frames {
+		m := frameNumber.FindStringSubmatch(f.PhotoCode)
+		if m == nil {
+			logf("Not animating %s: %s has no frame number\n", parent, f.PhotoCode)
+			return animation{}, false
+		}
+		n, _ := strconv.Atoi(m[2])
+		if seen[n] || (i > 0 && m[1] != prefix) {
+			logf("Not animating %s: frame numbers are ambiguous\n", parent)
+			return animation{}, false
+		}
+		seen[n] = true
+		numbers[f.ID] = n
+		prefix = m[1]
+	}
+
+	ordered := append([]Photo(nil), frames...)
+	sort.Slice(ordered, func(i, j int) bool { return numbers[ordered[i].ID] < numbers[ordered[j].ID] })
+	name := strings.Trim(prefix, "_-")
+	if name == "" {
+		name = parent
+	}
+	return animation{name: name + "_animated", frames: ordered}, true
+}
+
+// saveAnimation downloads the frames of a at size and writes them as an
+// animated GIF in outputDir
+func (pd *PhotoDownloader) saveAnimation(a animation, size string) error {
+	filename := pd.sanitizePath(a.name + ".gif")
+	target := filepath.Join(outputDir, filename)
+	if info, err := os.Stat(target); err == nil && info.Size() > 0 {
+		pd.stats.skipped.Add(1)
+		for _, frame := range a.frames {
+			pd.skips.add(frame, size, skipExists, "animation "+filename+" already exists")
+		}
+		logf("Skipping %s, already exists\n", filename)
+		return nil
+	}
+
+	logf("Downloading %d frames for %s...\n", len(a.frames), filename)
+	anim := &gif.GIF{}
+	var bounds image.Rectangle
+	for i, frame := range a.frames {
+		url := pd.resolveURL(frame, size)
+		if url == "" {
+			return fmt.Errorf("frame %s has no %s URL", frame.PhotoCode, size)
+		}
+		data, err := pd.fetchBytes(url)
+		if err != nil {
+			return fmt.Errorf("error downloading frame %s: %w", frame.PhotoCode, err)
+		}
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("error decoding frame %s: %v", frame.PhotoCode, err)
+		}
+		if i == 0 {
+			bounds = image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy())
+		}
+
+		// GIF frames are paletted; dither each frame onto a shared palette
+		paletted := image.NewPaletted(bounds, palette.Plan9)
+		draw.FloydSteinberg.Draw(paletted, bounds, img, img.Bounds().Min)
+		anim.Image = append(anim.Image, paletted)
+		anim.Delay = append(anim.Delay, animationDelay)
+	}
+
+	var b bytes.Buffer
+	if err := gif.EncodeAll(&b, anim); err != nil {
+		return fmt.Errorf("error encoding %s: %v", filename, err)
+	}
+	if err := os.WriteFile(target, b.Bytes(), 0644); err != nil {
+		return fmt.Errorf("error writing %s: %v", filename, err)
+	}
+	pd.stats.downloaded.Add(1)
+	logf("Successfully created %s\n", filename)
+	return nil
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultPageLimit is how many photos each listing page asks for
+const defaultPageLimit = 400
+
+// pageLimit is the page size in use, set by -limit
+var pageLimit = defaultPageLimit
+
+// HTTPDoer sends an HTTP request. *http.Client is the implementation the
+// tool runs with; tests can supply their own.
+type HTTPDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// apiClient is shared by every catalog request. Requests are bounded by
+// pageTimeout rather than a client timeout.
+var apiClient = &http.Client{}
+
+// apiDoer sends every catalog request; apiClient unless replaced
+var apiDoer HTTPDoer = apiClient
+
+const defaultUserAgent = "disney-photo-api/1.0"
+
+// userAgent is sent with every API and download request
+var userAgent = defaultUserAgent
+
+// newRequest builds a request carrying the configured User-Agent and any
+// -headers-file headers, which may replace it
+func newRequest(method, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(runCtx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	for name, values := range extraHeaders {
+		req.Header[name] = values
+	}
+	return req, nil
+}
+
+// Ways the token can be sent to the API, chosen with -auth-mode
+const (
+	authQuery  = "query"  // tokenId query parameter
+	authHeader = "header" // a header named by authHeaderName
+	authBearer = "bearer" // Authorization: Bearer <token>
+)
+
+// authMode and authHeaderName select how authorize attaches the token
+var (
+	authMode       = authQuery
+	authHeaderName = "X-Api-Key"
+)
+
+// authorize attaches token to req the way authMode asks
+func authorize(req *http.Request, token string) {
+	switch authMode {
+	case authHeader:
+		req.Header.Set(authHeaderName, token)
+	case authBearer:
+		req.Header.Set("Authorization", "Bearer "+token)
+	default:
+		q := req.URL.Query()
+		q.Set("tokenId", token)
+		req.URL.RawQuery = q.Encode()
+	}
+}
+
+// Temporary DNS failures are retried with a doubling backoff starting at
+// dnsRetryDelay, since they often clear within seconds on flaky links
+const (
+	dnsRetries    = 4
+	dnsRetryDelay = 2 * time.Second
+)
+
+// getWithDNSRetry issues a GET, retrying temporary DNS resolution failures.
+// A host that does not exist fails immediately as it will not start resolving.
+func getWithDNSRetry(req *http.Request) (*http.Response, error) {
+	delay := dnsRetryDelay
+	for attempt := 0; ; attempt++ {
+		resp, err := apiDoer.Do(req)
+		var dnsErr *net.DNSError
+		if err == nil || !errors.As(err, &dnsErr) {
+			return resp, err
+		}
+		if dnsErr.IsNotFound {
+			logf("Host %s does not exist, check the API address: %v\n", dnsErr.Name, err)
+			return nil, err
+		}
+		if attempt == dnsRetries {
+			return nil, err
+		}
+		logf("Temporary DNS failure resolving %s, retrying in %v: %v\n", dnsErr.Name, delay, err)
+		sleep(delay)
+		delay *= 2
+	}
+}
+
+// getAPIResponse calls the endpoint at path under the API of token's region
+// as token with the given query parameters
+func getAPIResponse(ctx context.Context, path, token string, params url.Values) (*APIResponse, error) {
+	req, err := newRequest(http.MethodGet, tokenRegion(token).api+path+"?"+params.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	_, id := splitToken(token)
+	authorize(req, id)
+	debugf("GET %s\n", redactToken(req.URL.String()))
+
+	defer phases.add(&phases.catalog, time.Now())
+	phases.catalogRequests.Add(1)
+	requestLimit.wait()
+	resp, err := getWithDNSRetry(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, &statusError{code: resp.StatusCode}
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, &statusError{code: resp.StatusCode, resp: resp}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{code: resp.StatusCode}
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	phases.catalogBytes.Add(int64(len(body)))
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %w", err)
+	}
+
+	var result APIResponse
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing JSON: %v", err)
+	}
+	if responseSchema != nil {
+		responseSchema.check(body)
+	}
+
+	return &result, nil
+}
+
+// listFunc fetches one page of a token's photos, e.g. GetPhotosByConditions
+type listFunc func(ctx context.Context, token string, page, limit int) (*APIResponse, error)
+
+// fetchTokens lists each token's catalog concurrently, tags every photo with
+// its source token and drops photos already seen under an earlier token of
+// the same region.
+// Progress is recorded in cursor so an interrupted listing can be resumed.
+// When only some tokens fail, the others' photos are returned with an error
+// wrapping errPartialListing.
+func fetchTokens(tokens []string, list listFunc, cursor *catalogCursor) ([]Photo, error) {
+	listed := make([][]Photo, len(tokens))
+	errs := make([]error, len(tokens))
+
+	var wg sync.WaitGroup
+	for i, token := range tokens {
+		wg.Add(1)
+		go func(i int, token string) {
+			defer wg.Done()
+			listed[i], errs[i] = fetchPages(token, list, cursor, nil)
+		}(i, token)
+	}
+	wg.Wait()
+
+	var photos []Photo
+	seen := make(map[string]bool)
+	var lastErr error
+	failed := 0
+	for i, token := range tokens {
+		if errs[i] != nil && abortOnAuthError && exitCodeFor(errs[i]) == exitAuth {
+			return nil, fmt.Errorf("token %s: %w", tokenLabel(token), errs[i])
+		}
+	}
+	for i, token := range tokens {
+		if errs[i] != nil {
+			fmt.Printf("Error fetching photos for token %s: %v\n", tokenLabel(token), errs[i])
+			lastErr = errs[i]
+			failed++
+			continue
+		}
+		name, _ := splitToken(token)
+		for _, photo := range listed[i] {
+			if seen[name+"/"+photo.ID] {
+				continue
+			}
+			seen[name+"/"+photo.ID] = true
+			photo.SourceToken = token
+			photos = append(photos, photo)
+		}
+	}
+
+	if failed == len(tokens) {
+		return nil, fmt.Errorf("could not fetch photos for any token: %w", lastErr)
+	}
+	if failed > 0 {
+		return photos, fmt.Errorf("%w: %d of %d tokens failed", errPartialListing, failed, len(tokens))
+	}
+	return photos, nil
+}
+
+// errPartialListing marks a listing that is missing the photos of some tokens
+var errPartialListing = errors.New("listing incomplete")
+
+// streamTokens lists the photos of every token like fetchTokens, sending
+// each page to pages as soon as it arrives instead of waiting for the rest
+func streamTokens(tokens []string, list listFunc, cursor *catalogCursor, pages chan<- []Photo) error {
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	errs := make([]error, len(tokens))
+
+	var wg sync.WaitGroup
+	for i, token := range tokens {
+		wg.Add(1)
+		go func(i int, token string) {
+			defer wg.Done()
+			name, _ := splitToken(token)
+			_, errs[i] = fetchPages(token, list, cursor, func(batch []Photo) {
+				var fresh []Photo
+				mu.Lock()
+				for _, photo := range batch {
+					if !seen[name+"/"+photo.ID] {
+						seen[name+"/"+photo.ID] = true
+						photo.SourceToken = token
+						fresh = append(fresh, photo)
+					}
+				}
+				mu.Unlock()
+				if len(fresh) > 0 {
+					pages <- fresh
+				}
+			})
+		}(i, token)
+	}
+	wg.Wait()
+
+	var lastErr error
+	failed := 0
+	for i, token := range tokens {
+		if errs[i] != nil && abortOnAuthError && exitCodeFor(errs[i]) == exitAuth {
+			return fmt.Errorf("token %s: %w", tokenLabel(token), errs[i])
+		}
+	}
+	for i, token := range tokens {
+		if errs[i] != nil {
+			fmt.Printf("Error fetching photos for token %s: %v\n", tokenLabel(token), errs[i])
+			lastErr = errs[i]
+			failed++
+		}
+	}
+	if failed == len(tokens) {
+		return fmt.Errorf("could not fetch photos for any token: %w", lastErr)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%w: %d of %d tokens failed", errPartialListing, failed, len(tokens))
+	}
+	return nil
+}
+
+// abortOnAuthError makes a 401/403 for any one token fail the whole listing
+// rather than only dropping that token's photos
+var abortOnAuthError bool
+
+// tokenLabel names token in messages without revealing it: its region and
+// last four characters, enough to tell several tokens apart
+func tokenLabel(token string) string {
+	name, id := splitToken(token)
+	if len(id) < 12 {
+		return name + ":REDACTED"
+	}
+	return name + ":..." + id[len(id)-4:]
+}
+
+// redactToken hides the tokenId in rawURL so it can be logged safely
+func redactToken(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	q := u.Query()
+	if q.Has("tokenId") {
+		q.Set("tokenId", "REDACTED")
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// extraParams are added verbatim to every getPhotosByConditions query, for
+// filters the API accepts that have no flag of their own
+var extraParams url.Values
+
+// photoConditions builds the query shared by the getPhotosByConditions
+// helpers, including the catalog time an incremental listing put in ctx
+func photoConditions(ctx context.Context, page, limit int) url.Values {
+	params := url.Values{
+		"currentPageIndex": {strconv.Itoa(page)},
+		"limit":            {strconv.Itoa(limit)},
+		"sortField":        {"shootOn"},
+		"order":            {"-1"},
+	}
+	if since, ok := catalogSince(ctx); ok {
+		params.Set(incrementalParam, strconv.FormatInt(since, 10))
+	}
+	for key, values := range extraParams {
+		for _, v := range values {
+			params.Add(key, v)
+		}
+	}
+	return params
+}
+
+// GetPhotosByConditions lists a page of every photo visible to token, newest first
+func GetPhotosByConditions(ctx context.Context, token string, page, limit int) (*APIResponse, error) {
+	return getAPIResponse(ctx, "getPhotosByConditions", token, photoConditions(ctx, page, limit))
+}
+
+// GetFavorites lists a page of the photos token has marked as favorites
+func GetFavorites(ctx context.Context, token string, page, limit int) (*APIResponse, error) {
+	params := photoConditions(ctx, page, limit)
+	params.Set("isFavorite", "true")
+	return getAPIResponse(ctx, "getPhotosByConditions", token, params)
+}
+
+// GetPurchased lists a page of the photos token has paid for
+func GetPurchased(ctx context.Context, token string, page, limit int) (*APIResponse, error) {
+	params := photoConditions(ctx, page, limit)
+	params.Set("isPaid", "true")
+	return getAPIResponse(ctx, "getPhotosByConditions", token, params)
+}
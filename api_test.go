@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// stubDoer answers every request with the same status and body
+type stubDoer struct {
+	status int
+	body   string
+	seen   []*http.Request
+}
+
+func (s *stubDoer) Do(req *http.Request) (*http.Response, error) {
+	s.seen = append(s.seen, req)
+	return &http.Response{
+		StatusCode: s.status,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader(s.body)),
+		Request:    req,
+	}, nil
+}
+
+// withAPIDoer sends catalog requests to d for the rest of the test
+func withAPIDoer(t *testing.T, d HTTPDoer) {
+	prev := apiDoer
+	apiDoer = d
+	t.Cleanup(func() { apiDoer = prev })
+}
+
+func TestGetAPIResponse(t *testing.T) {
+	const page = `{"status":200,"msg":"OK","result":{"time":1700000000,"photos":[
+		{"_id":"id0","photoCode":"CODE0","shootOn":"2024-10-01T10:00:00.000Z",
+		 "thumbnail":{"x1024":{"url":"media/CODE0_x1024.jpg","width":1024,"height":768}},
+		 "originalInfo":{"url":"media/CODE0_orig.jpg","width":1600,"height":1200}}]}}`
+
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		wantErr string // substring of the error; empty for success
+		code    int    // statusError code expected, if any
+	}{
+		{name: "valid page", status: http.StatusOK, body: page},
+		{name: "bad status in body", status: http.StatusOK, body: `{"status":500,"msg":"busy","result":{}}`, wantErr: "API answered with status 500: busy"},
+		{name: "server error", status: http.StatusInternalServerError, body: `oops`, wantErr: "non-200 status code: 500", code: http.StatusInternalServerError},
+		{name: "unauthorized", status: http.StatusUnauthorized, body: `{}`, wantErr: "non-200 status code: 401", code: http.StatusUnauthorized},
+		{name: "not JSON", status: http.StatusOK, body: `<html>`, wantErr: "error parsing JSON"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := &stubDoer{status: tt.status, body: tt.body}
+			withAPIDoer(t, stub)
+
+			resp, err := GetPhotosByConditions(context.Background(), "token", 1, 10)
+			if err == nil {
+				err = checkPage(resp)
+			}
+			if len(stub.seen) != 1 {
+				t.Fatalf("sent %d requests, want 1", len(stub.seen))
+			}
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if len(resp.Result.Photos) != 1 {
+					t.Fatalf("got %d photos, want 1", len(resp.Result.Photos))
+				}
+				p := resp.Result.Photos[0]
+				if p.ID != "id0" || p.PhotoCode != "CODE0" || p.Thumbnail.X1024.Width != 1024 || p.OriginalInfo.Height != 1200 {
+					t.Errorf("photo parsed as %+v", p)
+				}
+				if got := p.ShootOn.Time().UTC().Format("2006-01-02 15:04"); got != "2024-10-01 10:00" {
+					t.Errorf("shootOn parsed as %s", got)
+				}
+				if resp.Result.Time != 1700000000 {
+					t.Errorf("time parsed as %d", resp.Result.Time)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error %v, want one containing %q", err, tt.wantErr)
+			}
+			var se *statusError
+			if tt.code != 0 && (!errors.As(err, &se) || se.code != tt.code) {
+				t.Errorf("error %v does not carry status %d", err, tt.code)
+			}
+		})
+	}
+}
+
+func TestFetchTokensReportsFailedToken(t *testing.T) {
+	list := func(ctx context.Context, token string, page, limit int) (*APIResponse, error) {
+		if token == "bad" {
+			return nil, errors.New("connection reset")
+		}
+		return &APIResponse{Status: http.StatusOK, Result: Result{Photos: []Photo{{ID: "id-" + token}}}}, nil
+	}
+
+	photos, err := fetchTokens([]string{"good", "bad"}, list, nil)
+	if !errors.Is(err, errPartialListing) {
+		t.Fatalf("error = %v, want errPartialListing", err)
+	}
+	if exitCodeFor(err) != exitPartial {
+		t.Errorf("exit code = %d, want %d", exitCodeFor(err), exitPartial)
+	}
+	if len(photos) != 1 || photos[0].ID != "id-good" {
+		t.Errorf("photos = %v, want only the good token's", photos)
+	}
+
+	if _, err := fetchTokens([]string{"bad"}, list, nil); err == nil || errors.Is(err, errPartialListing) {
+		t.Errorf("error = %v, want the listing to fail outright", err)
+	}
+	if _, err := fetchTokens([]string{"good"}, list, nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestTokenLabelHidesToken(t *testing.T) {
+	tests := []struct{ token, want string }{
+		{"eyJhbGciOiJIUzI1NiJ9.secret.sig1a2b", "hk:...1a2b"},
+		{"sh:eyJhbGciOiJIUzI1NiJ9.secret.sig9z8y", "sh:...9z8y"},
+		{"short", "hk:REDACTED"},
+	}
+	for _, tt := range tests {
+		if got := tokenLabel(tt.token); got != tt.want {
+			t.Errorf("tokenLabel(%q) = %q, want %q", tt.token, got, tt.want)
+		}
+	}
+
+	const token = "eyJhbGciOiJIUzI1NiJ9.secret.sig1a2b"
+	prev := abortOnAuthError
+	abortOnAuthError = true
+	t.Cleanup(func() { abortOnAuthError = prev })
+	list := func(ctx context.Context, token string, page, limit int) (*APIResponse, error) {
+		return nil, &statusError{code: http.StatusUnauthorized}
+	}
+	if _, err := fetchTokens([]string{token}, list, nil); err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("error = %v, want one that does not reveal the token", err)
+	}
+}
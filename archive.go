@@ -0,0 +1,439 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sink receives downloads in place of files under outputDir, e.g. a tar
+// archive or object storage. add reads the file from body as it arrives and
+// must be safe for concurrent use.
+type sink interface {
+	add(name string, modTime time.Time, body io.Reader) error
+	Close() error
+}
+
+// sinkError is a failure to store a download in the sink, which retrying the
+// download would not fix
+type sinkError struct{ err error }
+
+func (e *sinkError) Error() string { return e.err.Error() }
+func (e *sinkError) Unwrap() error { return e.err }
+
+// tarArchive is a gzip-compressed tar that concurrent downloads write into
+type tarArchive struct {
+	mu sync.Mutex
+	f  *os.File
+	gz *gzip.Writer
+	tw *tar.Writer
+
+	// With -resume-archive every entry is its own gzip member, and the end
+	// of each is logged to index once it is on disk
+	index *os.File
+	done  map[string]bool // entries finalized by earlier runs, by entryStem
+}
+
+// createTarArchive creates the archive at path, replacing any existing file
+func createTarArchive(path string) (*tarArchive, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("error creating archive: %v", err)
+	}
+	gz := gzip.NewWriter(f)
+	return &tarArchive{f: f, gz: gz, tw: tar.NewWriter(gz)}, nil
+}
+
+// archiveIndexSuffix is appended to the archive path for the list of its
+// finalized entries
+const archiveIndexSuffix = ".entries"
+
+// openResumableTar opens the archive at path for -resume-archive. An archive
+// left by an earlier run is cut back to its last finalized entry, dropping
+// any half-written one and the end-of-archive marker, and appended to.
+func openResumableTar(path string) (*tarArchive, error) {
+	indexPath := path + archiveIndexSuffix
+	a := &tarArchive{done: make(map[string]bool)}
+	var end int64
+	data, err := os.ReadFile(indexPath)
+	switch {
+	case os.IsNotExist(err):
+		if _, err := os.Stat(path); err == nil {
+			return nil, fmt.Errorf("archive %s has no %s, so it was not written with -resume-archive", path, indexPath)
+		}
+	case err != nil:
+		return nil, fmt.Errorf("error reading archive index: %v", err)
+	default:
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			offset, name, ok := strings.Cut(line, "\t")
+			n, err := strconv.ParseInt(offset, 10, 64)
+			if !ok || err != nil {
+				// A line cut short by a crash; its entry is rewritten
+				continue
+			}
+			a.done[entryStem(name)] = true
+			end = max(end, n)
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening archive: %v", err)
+	}
+	if info, err := f.Stat(); err != nil || info.Size() < end {
+		f.Close()
+		return nil, fmt.Errorf("archive %s is shorter than its index says; delete both to start over", path)
+	}
+	if err := f.Truncate(end); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error truncating archive: %v", err)
+	}
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error opening archive: %v", err)
+	}
+	a.index, err = os.OpenFile(indexPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error opening archive index: %v", err)
+	}
+	a.f = f
+	if len(a.done) > 0 {
+		logf("Resuming archive %s after %d finalized entries\n", path, len(a.done))
+	}
+	return a, nil
+}
+
+// entryStem is name without its extension, which archiveFile and saveFile
+// may change after sniffing the download
+func entryStem(name string) string {
+	name = filepath.ToSlash(name)
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// finalized reports whether an earlier run already archived name
+func (a *tarArchive) finalized(name string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.done[entryStem(name)]
+}
+
+// add writes one file to the archive. The header needs its size, so the file
+// is read in before taking the lock.
+func (a *tarArchive) add(name string, modTime time.Time, body io.Reader) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     filepath.ToSlash(name),
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  modTime,
+	}
+	if a.index != nil {
+		return a.addMember(hdr, data)
+	}
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("error writing archive entry: %v", err)
+	}
+	if _, err := a.tw.Write(data); err != nil {
+		return fmt.Errorf("error writing archive entry: %v", err)
+	}
+	return nil
+}
+
+// addMember writes hdr and data as a gzip member of their own, syncs it to
+// disk and only then logs it in the index
+func (a *tarArchive) addMember(hdr *tar.Header, data []byte) error {
+	gz := gzip.NewWriter(a.f)
+	tw := tar.NewWriter(gz)
+	err := tw.WriteHeader(hdr)
+	if err == nil {
+		_, err = tw.Write(data)
+	}
+	if err == nil {
+		err = tw.Flush()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = a.f.Sync()
+	}
+	var end int64
+	if err == nil {
+		end, err = a.f.Seek(0, io.SeekCurrent)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing archive entry: %v", err)
+	}
+	if _, err := fmt.Fprintf(a.index, "%d\t%s\n", end, hdr.Name); err != nil {
+		return fmt.Errorf("error writing archive index: %v", err)
+	}
+	if err := a.index.Sync(); err != nil {
+		return fmt.Errorf("error writing archive index: %v", err)
+	}
+	return nil
+}
+
+// Close finishes the archive
+func (a *tarArchive) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var err error
+	if a.index != nil {
+		// The end-of-archive marker goes in a member of its own, past the
+		// last offset in the index, so a later run can cut it off again
+		gz := gzip.NewWriter(a.f)
+		err = tar.NewWriter(gz).Close()
+		if gzErr := gz.Close(); err == nil {
+			err = gzErr
+		}
+		if indexErr := a.index.Close(); err == nil {
+			err = indexErr
+		}
+	} else {
+		err = a.tw.Close()
+		if gzErr := a.gz.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	if closeErr := a.f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error finishing archive: %v", err)
+	}
+	return nil
+}
+
+// archiveFile streams d into the pd.archive sink, dated by the photo's shoot
+// time
+func (pd *PhotoDownloader) archiveFile(d download) error {
+	if a, ok := pd.archive.(*tarArchive); ok && a.finalized(d.filename) {
+		pd.stats.skipped.Add(1)
+		pd.skips.add(d.photo, d.key, skipExists, "already in the archive")
+		logf("Skipping %s, already in the archive\n", d.filename)
+		return nil
+	}
+	logf("Downloading %s...\n", d.filename)
+	pd.stats.inFlight.Add(1)
+	defer pd.stats.inFlight.Add(-1)
+
+	modTime := d.photo.ShootOn.Time()
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	fetchStart := time.Now()
+	filename, err := pd.archiveWithRetry(d.url, d.filename, modTime)
+	phases.add(&phases.download, fetchStart)
+	if err != nil {
+		return err
+	}
+	pd.stats.downloaded.Add(1)
+	logf("Successfully archived %s\n", filename)
+	return nil
+}
+
+// fetchBytesWithRetry is fetchBytes retried like a download
+func (pd *PhotoDownloader) fetchBytesWithRetry(url string) ([]byte, error) {
+	var data []byte
+	var err error
+	attempts := 0
+	for attempt := 0; attempt <= pd.retryLimit(); attempt++ {
+		attempts++
+		if attempt > 0 {
+			pd.stats.retryAttempts.Add(1)
+			sleep(retryDelay(attempt))
+			pd.breaker.wait()
+		}
+		if pd.window != nil {
+			pd.window.wait()
+		}
+		data, err = pd.fetchBytes(url)
+		if pd.window != nil {
+			pd.window.add(err == nil)
+		}
+		if err == nil {
+			if attempt > 0 {
+				pd.stats.retriedSuccess.Add(1)
+			}
+			return data, nil
+		}
+		if !pd.shouldRetry(err, attempt) {
+			break
+		}
+	}
+	return nil, attemptsError(err, attempts)
+}
+
+// archiveWithRetry is archiveOnce retried like a download. Failures to
+// store the file are returned at once.
+func (pd *PhotoDownloader) archiveWithRetry(url, name string, modTime time.Time) (string, error) {
+	var err error
+	attempts := 0
+	for attempt := 0; attempt <= pd.retryLimit(); attempt++ {
+		attempts++
+		if attempt > 0 {
+			pd.stats.retryAttempts.Add(1)
+			sleep(retryDelay(attempt))
+			pd.breaker.wait()
+		}
+		if pd.window != nil {
+			pd.window.wait()
+		}
+		var stored string
+		stored, err = pd.archiveOnce(url, name, modTime)
+		var se *sinkError
+		if errors.As(err, &se) {
+			return "", se.err
+		}
+		if pd.window != nil {
+			pd.window.add(err == nil)
+		}
+		if err == nil {
+			if attempt > 0 {
+				pd.stats.retriedSuccess.Add(1)
+			}
+			return stored, nil
+		}
+		if !pd.shouldRetry(err, attempt) {
+			break
+		}
+	}
+	return "", attemptsError(err, attempts)
+}
+
+// archiveOnce streams url into the pd.archive sink under name, with its
+// extension matched to the sniffed image type, honouring pd.maxSize and
+// pd.minBytes. It returns the name used.
+func (pd *PhotoDownloader) archiveOnce(url, name string, modTime time.Time) (string, error) {
+	resp, deadline, stop, err := pd.get(url)
+	if err != nil {
+		return "", err
+	}
+	defer stop()
+
+	body := &limitedBody{r: resp.Body, limit: pd.maxSize}
+	// Peek far enough to name the file and turn away a short body before
+	// anything reaches the sink
+	peek := max(sniffLen, int(pd.minBytes))
+	br := bufio.NewReaderSize(body, peek)
+	head, _ := br.Peek(peek)
+	if body.err != nil {
+		pd.stats.bytes.Add(body.n)
+		return "", fmt.Errorf("error downloading image: %w", deadline.explain(body.err))
+	}
+	if n := int64(len(head)); n < pd.minBytes {
+		pd.stats.bytes.Add(n)
+		return "", fmt.Errorf("server sent only %d bytes, below the %d byte minimum", n, pd.minBytes)
+	}
+	if detected := sniffImageType(head[:min(len(head), sniffLen)]); strings.HasPrefix(detected, "image/") {
+		name = strings.TrimSuffix(name, filepath.Ext(name)) + extensionFor(detected)
+	}
+
+	err = pd.archive.add(name, modTime, br)
+	pd.stats.bytes.Add(body.n)
+	if body.err != nil {
+		return "", fmt.Errorf("error downloading image: %w", deadline.explain(body.err))
+	}
+	if err != nil {
+		return "", &sinkError{err}
+	}
+	return name, nil
+}
+
+// limitedBody reads a download body, failing once it passes limit bytes
+// (0 for no limit) and remembering any read error, so a sink that fails can
+// be told apart from a download that did
+type limitedBody struct {
+	r     io.Reader
+	limit int64
+	n     int64
+	err   error
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	if b.limit > 0 && b.n > b.limit {
+		err = fmt.Errorf("file exceeds limit of %d bytes", b.limit)
+	}
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// get sends a GET for url and checks for a 200. stop releases the response
+// and its deadline.
+func (pd *PhotoDownloader) get(url string) (*http.Response, *sizedDeadline, func(), error) {
+	req, err := newRequest(http.MethodGet, url)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error creating request: %v", err)
+	}
+	client, done := pd.pickClient(req)
+	req, deadline, stopDeadline := pd.bounded(req)
+	resp, err := client.Do(req)
+	done(requestOK(resp, err))
+	if err != nil {
+		stopDeadline()
+		return nil, nil, nil, fmt.Errorf("error downloading image: %w", deadline.explain(err))
+	}
+	deadline.scale(resp.ContentLength)
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		stopDeadline()
+		return nil, nil, nil, &statusError{code: resp.StatusCode, resp: resp}
+	}
+	return resp, deadline, func() {
+		resp.Body.Close()
+		stopDeadline()
+	}, nil
+}
+
+// fetchBytes downloads url into memory, honouring pd.maxSize
+func (pd *PhotoDownloader) fetchBytes(url string) ([]byte, error) {
+	resp, deadline, stop, err := pd.get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+
+	var body io.Reader = resp.Body
+	if pd.maxSize > 0 {
+		body = io.LimitReader(resp.Body, pd.maxSize+1)
+	}
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, body)
+	pd.stats.bytes.Add(n)
+	err = deadline.explain(err)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading image: %w", err)
+	}
+	if pd.maxSize > 0 && n > pd.maxSize {
+		return nil, fmt.Errorf("file exceeds limit of %d bytes", pd.maxSize)
+	}
+	if n < pd.minBytes {
+		return nil, fmt.Errorf("server sent only %d bytes, below the %d byte minimum", n, pd.minBytes)
+	}
+	return buf.Bytes(), nil
+}
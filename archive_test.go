@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memSink keeps what it is given, or fails every add with err
+type memSink struct {
+	files map[string]string
+	err   error
+}
+
+func (s *memSink) add(name string, modTime time.Time, body io.Reader) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if s.err != nil {
+		return s.err
+	}
+	s.files[name] = string(data)
+	return nil
+}
+
+func (s *memSink) Close() error { return nil }
+
+func TestArchiveOnce(t *testing.T) {
+	const png = "\x89PNG\r\n\x1a\n png bytes"
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		maxSize  int64
+		minBytes int64
+		sinkErr  error
+		want     string // name stored under; empty when it fails
+		sinkFail bool   // the failure is the sink's rather than the download's
+	}{
+		{name: "renamed to sniffed type", status: http.StatusOK, body: png, want: "a.png"},
+		{name: "bad status", status: http.StatusNotFound, body: "missing"},
+		{name: "over max size", status: http.StatusOK, body: png, maxSize: 4},
+		{name: "under min bytes", status: http.StatusOK, body: "tiny", minBytes: 1 << 10},
+		{name: "sink fails", status: http.StatusOK, body: png, sinkErr: errors.New("bucket gone"), sinkFail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pd := NewPhotoDownloader(nil)
+			pd.Doer = &stubDoer{status: tt.status, body: tt.body}
+			pd.maxSize = tt.maxSize
+			if tt.minBytes > 0 {
+				pd.minBytes = tt.minBytes
+			}
+			s := &memSink{files: make(map[string]string), err: tt.sinkErr}
+			pd.archive = s
+
+			got, err := pd.archiveOnce("https://cdn.example.com/a.jpg", "a.jpg", time.Now())
+			if tt.want != "" {
+				if err != nil || got != tt.want || s.files[tt.want] != tt.body {
+					t.Fatalf("archiveOnce = %q, %v with %v, want %q holding the body", got, err, s.files, tt.want)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("archiveOnce stored %v, want an error", s.files)
+			}
+			var se *sinkError
+			if errors.As(err, &se) != tt.sinkFail {
+				t.Errorf("error %v: sink failure = %v, want %v", err, !tt.sinkFail, tt.sinkFail)
+			}
+			if len(s.files) > 0 {
+				t.Errorf("stored %v after a failure", s.files)
+			}
+		})
+	}
+}
+
+func TestArchiveWithRetryStopsOnSinkError(t *testing.T) {
+	pd := NewPhotoDownloader(nil)
+	doer := &stubDoer{status: http.StatusOK, body: "\xff\xd8\xff\xe0 jpeg bytes"}
+	pd.Doer = doer
+	pd.retries = 3
+	pd.archive = &memSink{err: errors.New("bucket gone")}
+
+	_, err := pd.archiveWithRetry("https://cdn.example.com/a.jpg", "a.jpg", time.Now())
+	if err == nil || !strings.Contains(err.Error(), "bucket gone") {
+		t.Fatalf("archiveWithRetry = %v, want the sink's error", err)
+	}
+	if len(doer.seen) != 1 {
+		t.Errorf("sent %d requests, want 1: sink failures are not retried", len(doer.seen))
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"runtime"
+	"time"
+)
+
+// Downloads wait on the network rather than the CPU, so the default
+// concurrency allows several per core, within a limit servers tolerate
+const (
+	downloadsPerCPU       = 4
+	maxDefaultConcurrency = 32
+)
+
+// defaultConcurrency is the -max-concurrency used when none is given
+func defaultConcurrency() int {
+	return min(runtime.NumCPU()*downloadsPerCPU, maxDefaultConcurrency)
+}
+
+const (
+	tuneInterval     = 5 * time.Second
+	tuneWindow       = 3   // samples in the sliding window
+	tuneMaxErrorRate = 0.2 // failure share above which concurrency backs off
+)
+
+// tuneSample is the activity seen during one tuneInterval
+type tuneSample struct {
+	bytes, completed, failed int64
+}
+
+// concurrencyTuner adjusts how many downloads run at once by holding back
+// slots of the downloader's semaphore, growing while throughput improves and
+// shrinking when it drops or errors rise
+type concurrencyTuner struct {
+	sem      chan struct{}
+	held     int // slots held back from downloads
+	min, max int
+	stats    *downloadStats
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// startTuner begins at min concurrency and adjusts between min and max
+func startTuner(sem chan struct{}, min, max int, stats *downloadStats) *concurrencyTuner {
+	t := &concurrencyTuner{sem: sem, min: min, max: max, stats: stats, stop: make(chan struct{}), done: make(chan struct{})}
+	for t.held < max-min {
+		sem <- struct{}{}
+		t.held++
+	}
+	logf("Auto-tuning concurrency between %d and %d, starting at %d\n", min, max, min)
+	go t.run()
+	return t
+}
+
+func (t *concurrencyTuner) current() int {
+	return t.max - t.held
+}
+
+func (t *concurrencyTuner) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(tuneInterval)
+	defer ticker.Stop()
+
+	var window []tuneSample
+	var last tuneSample
+	var lastRate float64
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		}
+
+		now := tuneSample{
+			bytes:     t.stats.bytes.Load(),
+			completed: t.stats.downloaded.Load() + t.stats.failed.Load(),
+			failed:    t.stats.failed.Load(),
+		}
+		window = append(window, tuneSample{now.bytes - last.bytes, now.completed - last.completed, now.failed - last.failed})
+		if len(window) > tuneWindow {
+			window = window[1:]
+		}
+		last = now
+
+		var sum tuneSample
+		for _, s := range window {
+			sum.bytes += s.bytes
+			sum.completed += s.completed
+			sum.failed += s.failed
+		}
+		rate := float64(sum.bytes) / float64(len(window))
+		errRate := 0.0
+		if sum.completed > 0 {
+			errRate = float64(sum.failed) / float64(sum.completed)
+		}
+
+		switch {
+		case errRate > tuneMaxErrorRate:
+			t.shrink("errors rising")
+		case rate > lastRate*1.05:
+			t.grow()
+		case rate < lastRate*0.9:
+			t.shrink("throughput dropped")
+		}
+		lastRate = rate
+	}
+}
+
+func (t *concurrencyTuner) grow() {
+	if t.held == 0 {
+		return
+	}
+	<-t.sem
+	t.held--
+	logf("Concurrency raised to %d\n", t.current())
+}
+
+func (t *concurrencyTuner) shrink(reason string) {
+	if t.current() <= t.min {
+		return
+	}
+	// Waits for a running download to finish and keeps its slot
+	select {
+	case t.sem <- struct{}{}:
+		t.held++
+		logf("Concurrency lowered to %d (%s)\n", t.current(), reason)
+	case <-t.stop:
+	}
+}
+
+// Stop ends tuning
+func (t *concurrencyTuner) Stop() {
+	close(t.stop)
+	<-t.done
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	breakerWindow = 10 * time.Second // how recent 429s must be to count towards a burst
+	breakerRamp   = 15 * time.Second // quiet time before each step back up
+)
+
+// throttleBreaker slows the whole pool down when the server answers with a
+// burst of 429s: new downloads and retries wait out a cooldown, then resume
+// at half the concurrency, which comes back one slot per quiet breakerRamp.
+type throttleBreaker struct {
+	hits     atomic.Int64 // 429s seen over the whole run
+	trips    atomic.Int64
+	burst    int
+	cooldown time.Duration
+	sem      chan struct{} // the downloader's semaphore; nil for no limit
+
+	mu     sync.Mutex
+	recent []time.Time // 429s within breakerWindow
+	until  time.Time   // paused until then
+	last   time.Time   // latest 429
+	held   int         // semaphore slots taken back from downloads
+	shed   int         // slots being taken back, including those still awaited
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// startBreaker trips after burst 429s within breakerWindow and pauses for
+// cooldown each time
+func startBreaker(burst int, cooldown time.Duration, sem chan struct{}) *throttleBreaker {
+	b := &throttleBreaker{burst: burst, cooldown: cooldown, sem: sem, stop: make(chan struct{}), done: make(chan struct{})}
+	go b.ramp()
+	return b
+}
+
+// hit records a 429, tripping the breaker if it completes a burst
+func (b *throttleBreaker) hit() {
+	b.hits.Add(1)
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.last = now
+	if now.Before(b.until) {
+		return // already cooling down
+	}
+	kept := b.recent[:0]
+	for _, t := range b.recent {
+		if now.Sub(t) < breakerWindow {
+			kept = append(kept, t)
+		}
+	}
+	b.recent = append(kept, now)
+	if len(b.recent) < b.burst {
+		return
+	}
+
+	b.recent = b.recent[:0]
+	b.until = now.Add(b.cooldown)
+	b.trips.Add(1)
+	if b.sem == nil {
+		logf("Server is throttling (%d 429s in %v), pausing downloads for %v\n", b.burst, breakerWindow, b.cooldown)
+		return
+	}
+	// Halve what is left after earlier trips, counting slots not yet taken,
+	// so repeated bursts never take the last one
+	shed := (cap(b.sem) - b.shed) / 2
+	b.shed += shed
+	logf("Server is throttling (%d 429s in %v), pausing downloads for %v and halving concurrency\n", b.burst, breakerWindow, b.cooldown)
+	// Slots are taken as running downloads free them
+	go func() {
+		for i := 0; i < shed; i++ {
+			select {
+			case b.sem <- struct{}{}:
+				b.mu.Lock()
+				b.held++
+				b.mu.Unlock()
+			case <-b.stop:
+				return
+			}
+		}
+	}()
+}
+
+// wait blocks while the breaker is cooling down, returning early if the run
+// is canceled. It is a no-op on nil.
+func (b *throttleBreaker) wait() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	pause := time.Until(b.until)
+	b.mu.Unlock()
+	if pause > 0 {
+		sleep(pause)
+	}
+}
+
+// ramp gives back one held slot for every breakerRamp without a 429
+func (b *throttleBreaker) ramp() {
+	defer close(b.done)
+	ticker := time.NewTicker(breakerRamp)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+		}
+		b.mu.Lock()
+		quiet := b.held > 0 && time.Now().After(b.until) && time.Since(b.last) >= breakerRamp
+		b.mu.Unlock()
+		if !quiet {
+			continue
+		}
+		select {
+		case <-b.sem:
+		case <-b.stop:
+			return
+		}
+		b.mu.Lock()
+		b.held--
+		b.shed--
+		b.mu.Unlock()
+		logf("Throttling has eased, allowing one more download at once\n")
+	}
+}
+
+// Stop ends ramping
+func (b *throttleBreaker) Stop() {
+	close(b.stop)
+	<-b.done
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreakerAlwaysLeavesASlot(t *testing.T) {
+	tests := []struct {
+		name  string
+		slots int
+		trips int
+		want  int // slots held once the trips settle
+	}{
+		{name: "one trip halves", slots: 8, trips: 1, want: 4},
+		{name: "second trip halves the rest", slots: 8, trips: 2, want: 6},
+		{name: "many trips keep one", slots: 8, trips: 10, want: 7},
+		{name: "single slot is never taken", slots: 1, trips: 3, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Every slot is busy, so the breaker can only take them back as
+			// downloads finish
+			sem := make(chan struct{}, tt.slots)
+			for i := 0; i < tt.slots; i++ {
+				sem <- struct{}{}
+			}
+			b := startBreaker(1, time.Millisecond, sem)
+			defer b.Stop()
+			for i := 0; i < tt.trips; i++ {
+				b.hit()
+				time.Sleep(2 * time.Millisecond)
+			}
+			for i := 0; i < tt.slots; i++ {
+				<-sem
+			}
+
+			deadline := time.Now().Add(time.Second)
+			for len(sem) < tt.want && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			time.Sleep(10 * time.Millisecond)
+			if got := len(sem); got != tt.want {
+				t.Errorf("%d of %d slots held, want %d", got, tt.slots, tt.want)
+			}
+			if b.trips.Load() != int64(tt.trips) {
+				t.Errorf("trips = %d, want %d", b.trips.Load(), tt.trips)
+			}
+		})
+	}
+}
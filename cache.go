@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// metadataCache is the on-disk form of a cached catalog listing
+type metadataCache struct {
+	Key       string        `json:"key"`
+	FetchedAt time.Time     `json:"fetchedAt"`
+	Photos    []cachedPhoto `json:"photos"`
+}
+
+// cachedPhoto keeps the source token, which Photo does not serialize
+type cachedPhoto struct {
+	Token string `json:"token"`
+	Photo
+}
+
+// cacheKey identifies the listing a cache was built from so a cache written
+// for other tokens or a different listing is never reused
+func cacheKey(tokens []string, listing string) string {
+	return listing + ":" + strings.Join(tokens, ",")
+}
+
+// loadMetadataCache returns the cached photos for key if the cache at path is
+// younger than ttl
+func loadMetadataCache(path, key string, ttl time.Duration) ([]Photo, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	var cache metadataCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		logf("Ignoring unreadable metadata cache %s: %v\n", path, err)
+		return nil, false
+	}
+	if cache.Key != key {
+		logf("Metadata cache %s was built for a different listing, refetching\n", path)
+		return nil, false
+	}
+	if age := time.Since(cache.FetchedAt); age > ttl {
+		logf("Metadata cache is %v old, refetching\n", age.Round(time.Second))
+		return nil, false
+	}
+
+	photos := make([]Photo, len(cache.Photos))
+	for i, cp := range cache.Photos {
+		photos[i] = cp.Photo
+		photos[i].SourceToken = cp.Token
+	}
+	logf("Using metadata cache from %s (%d photos)\n", cache.FetchedAt.Local().Format(time.RFC822), len(photos))
+	return photos, true
+}
+
+// saveMetadataCache writes photos to path under key
+func saveMetadataCache(path, key string, photos []Photo) error {
+	cache := metadataCache{Key: key, FetchedAt: time.Now(), Photos: make([]cachedPhoto, len(photos))}
+	for i, p := range photos {
+		cache.Photos[i] = cachedPhoto{Token: p.SourceToken, Photo: p}
+	}
+
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return fmt.Errorf("error encoding metadata cache: %v", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("error writing metadata cache: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("error writing metadata cache: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// cursorName is the file in outputDir recording how far the catalog listing
+// got, so -resume-catalog can continue an interrupted fetch
+const cursorName = ".catalog-cursor.jsonl"
+
+// maxPages caps how many pages are listed per token, so an API that never
+// returns a short page cannot keep a run listing forever
+var maxPages = 1000
+
+// pageTimeout bounds each attempt at fetching one listing page; a page that
+// times out is requested again up to pageRetries times
+var pageTimeout = 10 * time.Second
+
+const pageRetries = 2
+
+// pageSem bounds how many listing pages are requested at once across all
+// tokens, separately from the download limit; nil for no limit
+var pageSem chan struct{}
+
+// A page the API answers with 429 is requested again after the pause its
+// Retry-After asks for, or a doubling one from throttleDelay without it
+const (
+	throttleRetries = 5
+	throttleDelay   = 5 * time.Second
+)
+
+// fetchPage fetches one page of token's listing within pageTimeout
+func fetchPage(list listFunc, token string, page int) (*APIResponse, error) {
+	timeouts, throttled := 0, 0
+	delay := throttleDelay
+	for {
+		// Waiting for a slot does not count against the page's timeout
+		if pageSem != nil {
+			pageSem <- struct{}{}
+		}
+		ctx, cancel := runCtx, context.CancelFunc(func() {})
+		if pageTimeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, pageTimeout)
+		}
+		resp, err := list(ctx, token, page, pageLimit)
+		cancel()
+		if pageSem != nil {
+			<-pageSem
+		}
+
+		var se *statusError
+		if errors.As(err, &se) && se.code == http.StatusTooManyRequests {
+			if throttled == throttleRetries {
+				return nil, fmt.Errorf("page %d still rate limited after %d pauses: %w", page, throttled, err)
+			}
+			throttled++
+			pause, ok := retryAfter(se.resp)
+			if !ok {
+				pause = delay
+				delay *= 2
+			}
+			logf("API rate limited page %d for token %s, pausing %v\n", page, tokenLabel(token), pause)
+			sleep(pause)
+			continue
+		}
+		if err == nil || !errors.Is(err, context.DeadlineExceeded) {
+			return resp, err
+		}
+		if timeouts == pageRetries {
+			return nil, fmt.Errorf("page %d timed out after %v: %w", page, pageTimeout, err)
+		}
+		timeouts++
+		logf("Page %d for token %s timed out after %v, retrying\n", page, tokenLabel(token), pageTimeout)
+	}
+}
+
+// catalogCursor records the pages fetched so far for each token. The file
+// is a journal: a line with the listing's key, then one line per page, so
+// saving a page costs only that page.
+type catalogCursor struct {
+	mu     sync.Mutex
+	path   string
+	f      *os.File // journal pages are appended to; nil to keep them in memory
+	key    string
+	tokens map[string]*tokenCursor
+}
+
+// tokenCursor is the listing progress of one token
+type tokenCursor struct {
+	page   int // last page fetched successfully
+	photos []Photo
+	done   bool
+}
+
+// cursorLine is one line of the cursor journal: the header when Key is set,
+// otherwise a page fetched for Token and the photos it added
+type cursorLine struct {
+	Key    string  `json:"key,omitempty"`
+	Token  string  `json:"token,omitempty"`
+	Page   int     `json:"page,omitempty"`
+	Photos []Photo `json:"photos,omitempty"`
+	Done   bool    `json:"done,omitempty"`
+}
+
+// newCatalogCursor starts an empty cursor for the listing identified by key
+// that is not saved
+func newCatalogCursor(dir, key string) *catalogCursor {
+	return &catalogCursor{path: filepath.Join(dir, cursorName), key: key, tokens: make(map[string]*tokenCursor)}
+}
+
+// loadCatalogCursor reads the saved cursor in dir and keeps saving to it. A
+// cursor saved for other tokens or filters is discarded so pages of
+// different listings never mix. The journal is rewritten with one line per
+// token, dropping any line a crash cut short.
+func loadCatalogCursor(dir, key string) *catalogCursor {
+	c := newCatalogCursor(dir, key)
+	if data, err := os.ReadFile(c.path); err == nil {
+		c.replay(data)
+	}
+
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.Encode(cursorLine{Key: key})
+	for token, tc := range c.tokens {
+		enc.Encode(cursorLine{Token: token, Page: tc.page, Photos: tc.photos, Done: tc.done})
+	}
+	tmp := c.path + ".tmp"
+	err := os.WriteFile(tmp, b.Bytes(), 0644)
+	if err == nil {
+		err = os.Rename(tmp, c.path)
+	}
+	if err == nil {
+		c.f, err = os.OpenFile(c.path, os.O_WRONLY|os.O_APPEND, 0644)
+	}
+	if err != nil {
+		logf("Warning: could not save catalog cursor: %v\n", err)
+	}
+	return c
+}
+
+// replay applies the journal in data when it was saved for c's key
+func (c *catalogCursor) replay(data []byte) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 64<<20)
+	var header cursorLine
+	if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &header) != nil || header.Key == "" {
+		logf("Ignoring unreadable catalog cursor\n")
+		return
+	}
+	if header.Key != c.key {
+		logf("Saved catalog cursor is for different tokens or filters, starting from page 1\n")
+		return
+	}
+	for scanner.Scan() {
+		var line cursorLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil || line.Token == "" {
+			continue
+		}
+		c.apply(line)
+	}
+}
+
+// apply adds a journal line to the progress of its token
+func (c *catalogCursor) apply(line cursorLine) {
+	tc := c.tokens[line.Token]
+	if tc == nil {
+		tc = &tokenCursor{}
+		c.tokens[line.Token] = tc
+	}
+	tc.page = line.Page
+	tc.photos = append(tc.photos, line.Photos...)
+	tc.done = line.Done
+}
+
+// position returns the last page fetched for token and the photos listed
+// so far. A nil cursor has none.
+func (c *catalogCursor) position(token string) (int, []Photo, bool) {
+	if c == nil {
+		return 0, nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tc, ok := c.tokens[token]
+	if !ok {
+		return 0, nil, false
+	}
+	return tc.page, append([]Photo(nil), tc.photos...), tc.done
+}
+
+// advance records that page was fetched for token, adding photos, and
+// appends it to the journal. It is a no-op on nil.
+func (c *catalogCursor) advance(token string, page int, photos []Photo, done bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	line := cursorLine{Token: token, Page: page, Photos: photos, Done: done}
+	c.apply(line)
+	if c.f == nil {
+		return
+	}
+	data, err := json.Marshal(line)
+	if err == nil {
+		_, err = c.f.Write(append(data, '\n'))
+	}
+	if err != nil {
+		logf("Warning: could not save catalog cursor: %v\n", err)
+	}
+}
+
+// clear removes the saved cursor once every token's listing is complete. It
+// is a no-op on nil.
+func (c *catalogCursor) clear(tokens []string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, token := range tokens {
+		if tc, ok := c.tokens[token]; !ok || !tc.done {
+			return
+		}
+	}
+	if c.f != nil {
+		c.f.Close()
+		c.f = nil
+	}
+	if err := os.Remove(c.path); err != nil && !os.IsNotExist(err) {
+		logf("Warning: could not remove catalog cursor: %v\n", err)
+	}
+}
+
+// checkPage rejects a listing page the API answered with an error in the
+// body rather than the HTTP status. Responses without a status are let
+// through as they carry no verdict.
+func checkPage(resp *APIResponse) error {
+	if resp.Status != 0 && resp.Status != http.StatusOK {
+		if resp.Message != "" {
+			return fmt.Errorf("API answered with status %d: %s", resp.Status, resp.Message)
+		}
+		return fmt.Errorf("API answered with status %d", resp.Status)
+	}
+	if resp.Result.Time < 0 {
+		return fmt.Errorf("API reported an invalid server time %d", resp.Result.Time)
+	}
+	return nil
+}
+
+// fetchPages lists every page of token's catalog, continuing after the last
+// page the cursor recorded. When emit is set it receives the photos of each
+// page as soon as the page arrives, starting with any the cursor had saved.
+func fetchPages(token string, list listFunc, cursor *catalogCursor, emit func([]Photo)) ([]Photo, error) {
+	page, photos, done := cursor.position(token)
+	if emit != nil && len(photos) > 0 {
+		emit(photos)
+	}
+	if done {
+		return photos, nil
+	}
+	if page > 0 {
+		logf("Resuming catalog for token %s after page %d (%d photos so far)\n", tokenLabel(token), page, len(photos))
+	}
+
+	region, _ := splitToken(token)
+	listed := make(map[string]bool, len(photos))
+	for _, p := range photos {
+		listed[regionKey(region, p.ID)] = true
+	}
+	for {
+		page++
+		if maxPages > 0 && page > maxPages {
+			logf("Warning: stopped listing token %s after -max-pages %d pages; some photos may be missing\n", tokenLabel(token), maxPages)
+			cursor.advance(token, page-1, nil, true)
+			return photos, nil
+		}
+		resp, err := fetchPage(list, token, page)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching page %d: %w", page, err)
+		}
+		if err := checkPage(resp); err != nil {
+			return nil, fmt.Errorf("error fetching page %d: %w", page, err)
+		}
+
+		// Photos a shifting listing repeats from earlier pages are dropped
+		var fresh []Photo
+		for _, p := range resp.Result.Photos {
+			if key := regionKey(region, p.ID); !listed[key] {
+				listed[key] = true
+				fresh = append(fresh, p)
+			}
+		}
+		if len(fresh) == 0 && len(resp.Result.Photos) > 0 {
+			logf("Warning: page %d for token %s repeats photos already listed, stopping\n", page, tokenLabel(token))
+			cursor.advance(token, page-1, nil, true)
+			return photos, nil
+		}
+
+		photos = append(photos, fresh...)
+		if emit != nil && len(fresh) > 0 {
+			emit(fresh)
+		}
+		done := len(resp.Result.Photos) < pageLimit
+		cursor.advance(token, page, fresh, done)
+		if done {
+			return photos, nil
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// cursorLines reads the journal in dir
+func cursorLines(t *testing.T, dir string) []cursorLine {
+	t.Helper()
+	f, err := os.Open(filepath.Join(dir, cursorName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines []cursorLine
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var line cursorLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("unreadable cursor line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestCatalogCursorResumes(t *testing.T) {
+	withPageLimit(t, 2)
+	reset := errors.New("connection reset")
+	tests := []struct {
+		name      string
+		key       string // key the second run lists under
+		corrupt   string // appended to the journal between runs
+		wantFirst int    // first page the second run asks for
+	}{
+		{name: "resumes after the last page", key: "k", wantFirst: 3},
+		{name: "drops a line cut short", key: "k", corrupt: `{"token":"tok","page":3,"pho`, wantFirst: 3},
+		{name: "other listing starts over", key: "other", wantFirst: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			first := &pagedList{n: 7, err: reset, failFrom: 3}
+			if _, err := fetchPages("tok", first.list, loadCatalogCursor(dir, "k"), nil); err == nil {
+				t.Fatal("first listing succeeded, want it cut off at page 3")
+			}
+
+			// Each page is saved as its own line holding only that page
+			lines := cursorLines(t, dir)
+			if len(lines) != 3 || lines[0].Key != "k" || len(lines[1].Photos) != 2 || len(lines[2].Photos) != 2 {
+				t.Fatalf("journal = %+v, want the key and one line per page", lines)
+			}
+			if tt.corrupt != "" {
+				f, err := os.OpenFile(filepath.Join(dir, cursorName), os.O_WRONLY|os.O_APPEND, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.WriteString(tt.corrupt)
+				f.Close()
+			}
+
+			second := &pagedList{n: 7}
+			cursor := loadCatalogCursor(dir, tt.key)
+			photos, err := fetchPages("tok", second.list, cursor, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if second.first != tt.wantFirst {
+				t.Errorf("second listing started at page %d, want %d", second.first, tt.wantFirst)
+			}
+			if len(photos) != 7 {
+				t.Errorf("listed %d photos, want 7", len(photos))
+			}
+			cursor.clear([]string{"tok"})
+			if _, err := os.Stat(filepath.Join(dir, cursorName)); !os.IsNotExist(err) {
+				t.Errorf("cursor kept after the listing completed")
+			}
+		})
+	}
+}
+
+// fixedPages serves pages as given, then an empty page
+type fixedPages [][]string
+
+func (f fixedPages) list(ctx context.Context, token string, page, limit int) (*APIResponse, error) {
+	resp := &APIResponse{Status: 200}
+	if page <= len(f) {
+		for _, id := range f[page-1] {
+			resp.Result.Photos = append(resp.Result.Photos, Photo{ID: id})
+		}
+	}
+	return resp, nil
+}
+
+func TestFetchPagesDropsRepeats(t *testing.T) {
+	withPageLimit(t, 3)
+	tests := []struct {
+		name  string
+		pages fixedPages
+		want  []string
+	}{
+		{name: "distinct pages", pages: fixedPages{{"a", "b", "c"}, {"d"}}, want: []string{"a", "b", "c", "d"}},
+		{name: "page shifted by one", pages: fixedPages{{"a", "b", "c"}, {"c", "d", "e"}, {"f"}}, want: []string{"a", "b", "c", "d", "e", "f"}},
+		{name: "repeat within a page", pages: fixedPages{{"a", "a", "b"}, {"c"}}, want: []string{"a", "b", "c"}},
+		{name: "page of only repeats stops", pages: fixedPages{{"a", "b", "c"}, {"a", "b", "c"}, {"d"}}, want: []string{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var emitted []string
+			photos, err := fetchPages("tok", tt.pages.list, nil, func(page []Photo) {
+				for _, p := range page {
+					emitted = append(emitted, p.ID)
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, p := range photos {
+				got = append(got, p.ID)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("listed %v, want %v", got, tt.want)
+			}
+			if strings.Join(emitted, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("emitted %v, want %v", emitted, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// checksumList appends a line per completed file to a -checksums file in the
+// format sha256sum writes, so `sha256sum -c` can verify the downloads
+type checksumList struct {
+	mu  sync.Mutex
+	f   *os.File
+	dir string // names are written relative to the file's own folder
+}
+
+// openChecksumList opens path for appending, creating it if needed
+func openChecksumList(path string) (*checksumList, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening checksums file: %v", err)
+	}
+	return &checksumList{f: f, dir: filepath.Dir(path)}, nil
+}
+
+// add records sum for filename, a path under outputDir
+func (c *checksumList) add(filename, sum string) {
+	name := filepath.Join(outputDir, filename)
+	if rel, err := filepath.Rel(c.dir, name); err == nil {
+		name = rel
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := fmt.Fprintf(c.f, "%s  %s\n", sum, filepath.ToSlash(name)); err != nil {
+		logf("Error writing checksum of %s: %v\n", filename, err)
+	}
+}
+
+// Close closes the file
+func (c *checksumList) Close() error {
+	if err := c.f.Close(); err != nil {
+		return fmt.Errorf("error closing checksums file: %v", err)
+	}
+	return nil
+}
+
+// addChecksum appends filename to the -checksums file, if any
+func (pd *PhotoDownloader) addChecksum(filename, sum string) {
+	if pd.checksums != nil && sum != "" {
+		pd.checksums.add(filename, sum)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Policies for two downloads that would be saved to the same path
+const (
+	collideSuffix    = "suffix"    // number the later file, e.g. name_1.jpg
+	collideSkip      = "skip"      // keep the first file and drop the later one
+	collideOverwrite = "overwrite" // save both to the path, the last one wins
+	collideError     = "error"     // abort the run
+)
+
+// collisionPolicies lists the values -on-collision accepts
+var collisionPolicies = []string{collideSuffix, collideSkip, collideOverwrite, collideError}
+
+// nameRegistry hands out output paths so no two downloads of a run share one.
+// A download asking again for its own name always gets the same answer, so
+// planning a photo repeatedly is stable.
+type nameRegistry struct {
+	mu     sync.Mutex
+	policy string
+	owners map[string]string // filename -> owning photo ID and size
+	first  string            // first collision seen, for the error policy
+}
+
+// newNameRegistry returns an empty registry resolving collisions by policy
+func newNameRegistry(policy string) *nameRegistry {
+	return &nameRegistry{policy: policy, owners: make(map[string]string)}
+}
+
+// claim returns the path d should be saved to, or false when the policy
+// drops it
+func (r *nameRegistry) claim(d download) (string, bool) {
+	owner := photoKey(d.photo) + "/" + d.key
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	name := d.filename
+	if prev, taken := r.owners[name]; !taken || prev == owner {
+		r.owners[name] = owner
+		return name, true
+	}
+	if r.first == "" {
+		r.first = fmt.Sprintf("%s and %s are both saved as %s", r.owners[name], owner, name)
+	}
+
+	switch r.policy {
+	case collideOverwrite:
+		return name, true
+	case collideSuffix:
+		ext := filepath.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		for i := 1; ; i++ {
+			candidate := fmt.Sprintf("%s_%d%s", base, i, ext)
+			if prev, taken := r.owners[candidate]; !taken || prev == owner {
+				r.owners[candidate] = owner
+				return candidate, true
+			}
+		}
+	}
+	return "", false
+}
+
+// collision describes the first collision seen, or is empty if there was none
+func (r *nameRegistry) collision() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.first
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// isLargeDownload reports whether a run of n files totalling about bytes
+// crosses either -prompt-before-large-download threshold. Zero disables one.
+func isLargeDownload(n int, bytes int64, maxFiles int, maxBytes int64) bool {
+	return (maxFiles > 0 && n > maxFiles) || (maxBytes > 0 && bytes > maxBytes)
+}
+
+// approxGB formats a byte count in gigabytes for the confirmation prompt
+func approxGB(n int64) string {
+	return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+}
+
+// confirmDownload asks on the terminal whether to go ahead with n files of
+// about bytes, defaulting to no. It fails when stdout is not a terminal, as
+// nobody may be there to answer.
+func confirmDownload(n int, bytes int64, in io.Reader) error {
+	if !term.IsTerminal(int(os.Stdout.Fd())) {
+		return fmt.Errorf("about to download %d files (~%s) and not on a terminal to confirm; pass -yes to go ahead", n, approxGB(bytes))
+	}
+	fmt.Printf("About to download %d files (~%s). Continue? [y/N] ", n, approxGB(bytes))
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return fmt.Errorf("download not confirmed")
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	sheetPadding       = 6  // pixels around each cell
+	sheetCaptionHeight = 16 // pixels below each thumbnail for its caption
+	sheetWorkers       = 8  // thumbnails fetched at once
+)
+
+// sheetLayout describes the grid of a contact sheet
+type sheetLayout struct {
+	columns int
+	rows    int // 0 puts every photo on one sheet
+	cell    int // width and height each thumbnail is fitted into
+}
+
+// contactSheet fetches the x128 thumbnail of each photo and writes them as a
+// captioned grid to out. When rows limits the sheet, further sheets are
+// written next to it as out-2.jpg, out-3.jpg and so on.
+func (pd *PhotoDownloader) contactSheet(photos []Photo, out string, layout sheetLayout) error {
+	if layout.columns < 1 || layout.cell < 16 || layout.rows < 0 {
+		return fmt.Errorf("invalid contact sheet layout: %d columns, %d rows, %dpx cells", layout.columns, layout.rows, layout.cell)
+	}
+	thumbs := pd.fetchThumbnails(photos)
+
+	perSheet := len(photos)
+	if layout.rows > 0 {
+		perSheet = layout.columns * layout.rows
+	}
+	ext := filepath.Ext(out)
+	for sheet, start := 1, 0; start < len(photos); sheet, start = sheet+1, start+perSheet {
+		end := start + perSheet
+		if end > len(photos) {
+			end = len(photos)
+		}
+		name := out
+		if sheet > 1 {
+			name = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(out, ext), sheet, ext)
+		}
+		img := renderSheet(photos[start:end], thumbs[start:end], layout)
+		if err := writeJPEG(name, img); err != nil {
+			return err
+		}
+		logf("Wrote contact sheet %s with %d photos\n", name, end-start)
+	}
+	return nil
+}
+
+// fetchThumbnails downloads the x128 thumbnail of every photo into memory.
+// Thumbnails that cannot be fetched or decoded are left nil.
+func (pd *PhotoDownloader) fetchThumbnails(photos []Photo) []image.Image {
+	thumbs := make([]image.Image, len(photos))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < sheetWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				img, err := pd.fetchImage(pd.resolveURL(photos[i], "x128"))
+				if err != nil {
+					logf("Could not fetch thumbnail for %s: %v\n", photos[i].PhotoCode, err)
+					continue
+				}
+				thumbs[i] = img
+			}
+		}()
+	}
+	for i := range photos {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return thumbs
+}
+
+// fetchImage downloads and decodes the image at url
+func (pd *PhotoDownloader) fetchImage(url string) (image.Image, error) {
+	if url == "" {
+		return nil, fmt.Errorf("no thumbnail URL")
+	}
+	data, err := pd.fetchBytes(url)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding image: %v", err)
+	}
+	return img, nil
+}
+
+// renderSheet lays out thumbs in a grid with each photo's code beneath it
+func renderSheet(photos []Photo, thumbs []image.Image, layout sheetLayout) image.Image {
+	columns := layout.columns
+	if len(photos) < columns {
+		columns = len(photos)
+	}
+	rows := (len(photos) + columns - 1) / columns
+	cellW := layout.cell + 2*sheetPadding
+	cellH := layout.cell + sheetCaptionHeight + 2*sheetPadding
+
+	sheet := image.NewRGBA(image.Rect(0, 0, columns*cellW, rows*cellH))
+	draw.Draw(sheet, sheet.Bounds(), image.White, image.Point{}, draw.Src)
+	placeholder := image.NewUniform(color.Gray{Y: 0xCC})
+
+	for i, photo := range photos {
+		x := (i % columns) * cellW
+		y := (i / columns) * cellH
+		box := image.Rect(x+sheetPadding, y+sheetPadding, x+sheetPadding+layout.cell, y+sheetPadding+layout.cell)
+
+		if thumbs[i] == nil {
+			draw.Draw(sheet, box, placeholder, image.Point{}, draw.Src)
+		} else {
+			xdraw.ApproxBiLinear.Scale(sheet, fitRect(thumbs[i].Bounds(), box), thumbs[i], thumbs[i].Bounds(), draw.Src, nil)
+		}
+		drawCaption(sheet, photo.PhotoCode, x+sheetPadding, box.Max.Y, layout.cell)
+	}
+	return sheet
+}
+
+// fitRect is the largest rectangle with src's aspect ratio centred in box
+func fitRect(src, box image.Rectangle) image.Rectangle {
+	w, h := box.Dx(), box.Dy()
+	if src.Dx()*h > src.Dy()*w {
+		h = src.Dy() * w / src.Dx()
+	} else {
+		w = src.Dx() * h / src.Dy()
+	}
+	min := box.Min.Add(image.Pt((box.Dx()-w)/2, (box.Dy()-h)/2))
+	return image.Rectangle{Min: min, Max: min.Add(image.Pt(w, h))}
+}
+
+// drawCaption writes text below a thumbnail, truncated to the cell width
+func drawCaption(dst draw.Image, text string, x, top, width int) {
+	face := basicfont.Face7x13
+	if max := width / face.Advance; len(text) > max {
+		text = text[:max]
+	}
+	d := &font.Drawer{
+		Dst:  dst,
+		Src:  image.Black,
+		Face: face,
+		Dot:  fixed.P(x, top+face.Ascent+2),
+	}
+	d.DrawString(text)
+}
+
+// writeJPEG encodes img to path
+func writeJPEG(path string, img image.Image) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %v", path, err)
+	}
+	if err := jpeg.Encode(f, img, &jpeg.Options{Quality: 90}); err != nil {
+		f.Close()
+		return fmt.Errorf("error encoding %s: %v", path, err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,46 @@
+package main
+
+import "sync"
+
+// conversionJob is a saved file's post-processing waiting for a worker
+type conversionJob struct {
+	post func() error
+	done chan error
+}
+
+// conversionPool runs CPU-bound post-processing such as re-encoding, EXIF
+// writing and stripping on a fixed number of workers, apart from the
+// network-bound download slots
+type conversionPool struct {
+	jobs chan conversionJob
+	wg   sync.WaitGroup
+}
+
+// startConversionPool starts workers goroutines waiting for files
+func startConversionPool(workers int) *conversionPool {
+	p := &conversionPool{jobs: make(chan conversionJob)}
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for job := range p.jobs {
+				job.done <- job.post()
+			}
+		}()
+	}
+	return p
+}
+
+// run queues post for the next free worker and waits for its result
+func (p *conversionPool) run(post func() error) error {
+	done := make(chan error, 1)
+	p.jobs <- conversionJob{post: post, done: done}
+	return <-done
+}
+
+// Close waits for the workers to finish the files they have; call it once
+// every download has returned
+func (p *conversionPool) Close() {
+	close(p.jobs)
+	p.wg.Wait()
+}
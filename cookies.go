@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// cookieDomain is matched against cookie domains to find PhotoPass cookies
+const cookieDomain = "disneyphotopass"
+
+// tokenPattern matches the UUID form of PhotoPass tokens
+var tokenPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// exportedCookie is one cookie as browser export extensions write them to JSON
+type exportedCookie struct {
+	Domain string `json:"domain"`
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+}
+
+// tokenFromCookies reads a browser cookie export, either a Netscape
+// cookies.txt or a JSON array, and returns the value of the PhotoPass cookie
+// called name
+func tokenFromCookies(path, name string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading cookie file: %v", err)
+	}
+
+	var cookies []exportedCookie
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &cookies); err != nil {
+			return "", fmt.Errorf("error parsing cookie file: %v", err)
+		}
+	} else {
+		cookies = parseNetscapeCookies(data)
+	}
+
+	for _, c := range cookies {
+		if c.Name != name || !strings.Contains(c.Domain, cookieDomain) {
+			continue
+		}
+		token := strings.TrimSpace(c.Value)
+		if !tokenPattern.MatchString(token) {
+			return "", fmt.Errorf("cookie %s in %s is %q, which does not look like a tokenId", name, path, token)
+		}
+		return token, nil
+	}
+	return "", fmt.Errorf("no %s cookie for %s found in %s; export the cookies while logged in to the PhotoPass site", name, cookieDomain, path)
+}
+
+// parseNetscapeCookies reads the tab-separated cookies.txt format: domain,
+// subdomain flag, path, secure, expiry, name and value
+func parseNetscapeCookies(data []byte) []exportedCookie {
+	var cookies []exportedCookie
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		// curl and browsers mark HttpOnly cookies with a prefix on an otherwise normal line
+		line = strings.TrimPrefix(line, "#HttpOnly_")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			continue
+		}
+		cookies = append(cookies, exportedCookie{Domain: fields[0], Name: fields[5], Value: fields[6]})
+	}
+	return cookies
+}
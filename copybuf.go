@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// defaultCopyBuffer is the buffer size io.Copy uses on its own
+const defaultCopyBuffer = 32 << 10
+
+// copyBuffers hands out buffers of one size to copy download bodies through,
+// reusing them across downloads
+type copyBuffers struct {
+	size int
+	pool sync.Pool
+}
+
+// newCopyBuffers returns a pool of size-byte buffers
+func newCopyBuffers(size int) *copyBuffers {
+	b := &copyBuffers{size: size}
+	b.pool.New = func() any {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return b
+}
+
+// copy copies src to dst through a pooled buffer. dst is wrapped so that an
+// *os.File cannot take over with ReadFrom, which would copy through its own
+// 32KB buffer instead.
+func (b *copyBuffers) copy(dst io.Writer, src io.Reader) (int64, error) {
+	if b == nil {
+		return io.Copy(dst, src)
+	}
+	buf := b.pool.Get().(*[]byte)
+	defer b.pool.Put(buf)
+	return io.CopyBuffer(struct{ io.Writer }{dst}, src, *buf)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// hashFile returns the hex SHA-256 of the file at path
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// How -dedupe-link and -dedupe-hardlink replace a duplicate
+const (
+	linkSymbolic = "symlink"
+	linkHard     = "hardlink"
+)
+
+// linkDuplicate replaces the file dup with a link of the given kind to kept.
+// dup is only replaced once the link exists, so a filesystem without link
+// support leaves the copy in place.
+func linkDuplicate(kept, dup, kind string) error {
+	tmp := dup + ".tmp"
+	os.Remove(tmp)
+	var err error
+	if kind == linkHard {
+		err = os.Link(kept, tmp)
+	} else {
+		var rel string
+		if rel, err = filepath.Rel(filepath.Dir(dup), kept); err == nil {
+			err = os.Symlink(rel, tmp)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dup); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// contentIndex maps the SHA-256 of every file kept so far, this run or in
+// the manifest of earlier ones, to its name relative to outputDir
+type contentIndex struct {
+	mu     sync.Mutex
+	byHash map[string]string
+}
+
+// newContentIndex starts from the manifest's checksums of files still on disk
+func newContentIndex(m *Manifest) *contentIndex {
+	c := &contentIndex{byHash: make(map[string]string)}
+	for sum, names := range m.checksummedFiles() {
+		sort.Strings(names)
+		for _, name := range names {
+			if _, err := os.Stat(filepath.Join(outputDir, name)); err == nil {
+				c.byHash[sum] = name
+				break
+			}
+		}
+	}
+	return c
+}
+
+// claim records filename as the copy of sum unless another file that still
+// exists already is, returning that file
+func (c *contentIndex) claim(sum, filename string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if kept, ok := c.byHash[sum]; ok && kept != filename {
+		if _, err := os.Stat(filepath.Join(outputDir, kept)); err == nil {
+			return kept, true
+		}
+	}
+	c.byHash[sum] = filename
+	return "", false
+}
+
+// collapseDuplicate removes, or with pd.dedupeLink links, the file that size
+// of photo was just saved as when its bytes match a file kept earlier. It
+// reports whether the file is gone.
+func (pd *PhotoDownloader) collapseDuplicate(photo Photo, size, filename, sum string) bool {
+	if sum == "" {
+		return false
+	}
+	kept, dup := pd.contents.claim(sum, filename)
+	if !dup {
+		return false
+	}
+	if pd.dedupeLink != "" {
+		if err := linkDuplicate(filepath.Join(outputDir, kept), filepath.Join(outputDir, filename), pd.dedupeLink); err != nil {
+			logf("Could not link %s to %s, keeping the copy: %v\n", filename, kept, err)
+			return false
+		}
+		pd.manifest.markLinked(photo, size, kept)
+		pd.stats.collapsed.Add(1)
+		logf("Replaced %s with a %s to the identical %s\n", filename, pd.dedupeLink, kept)
+		return false
+	}
+	if err := os.Remove(filepath.Join(outputDir, filename)); err != nil {
+		logf("Error removing duplicate %s: %v\n", filename, err)
+		return false
+	}
+	pd.manifest.markDuplicate(photo, size, kept)
+	pd.stats.collapsed.Add(1)
+	logf("Removed %s, identical to %s\n", filename, kept)
+	return true
+}
+
+// sizeArea returns the pixel area the API reports for size on photo
+func sizeArea(photo Photo, size string) int {
+	if size == originalSize {
+		return photo.OriginalInfo.Width * photo.OriginalInfo.Height
+	}
+	if v, ok := lookupVariant(size); ok {
+		ts := v.get(photo.Thumbnail)
+		return ts.Width * ts.Height
+	}
+	return 0
+}
+
+// removeDuplicateSizes deletes sizes of photo whose bytes are identical to another
+// size, keeping the one with the largest reported dimensions, and records
+// each decision in the manifest
+func (pd *PhotoDownloader) removeDuplicateSizes(photo Photo, sizes []string) {
+	keep := make(map[string]string) // hash -> size kept
+	for _, size := range sizes {
+		filename := pd.manifest.fileFor(photo, size)
+		if filename == "" {
+			continue
+		}
+		sum, err := hashFile(filepath.Join(outputDir, filename))
+		if err != nil {
+			logf("Error hashing %s: %v\n", filename, err)
+			continue
+		}
+
+		kept, seen := keep[sum]
+		if !seen {
+			keep[sum] = size
+			continue
+		}
+
+		drop := size
+		if sizeArea(photo, size) > sizeArea(photo, kept) {
+			drop, kept = kept, size
+			keep[sum] = kept
+		}
+		dropped := pd.manifest.fileFor(photo, drop)
+		if pd.dedupeLink != "" {
+			keptName := pd.manifest.fileFor(photo, kept)
+			if err := linkDuplicate(filepath.Join(outputDir, keptName), filepath.Join(outputDir, dropped), pd.dedupeLink); err != nil {
+				logf("Could not link %s to %s, keeping the copy: %v\n", dropped, keptName, err)
+				continue
+			}
+			pd.manifest.markLinked(photo, drop, kept)
+			logf("Replaced %s with a %s to %s\n", dropped, pd.dedupeLink, keptName)
+			continue
+		}
+		if err := os.Remove(filepath.Join(outputDir, dropped)); err != nil {
+			logf("Error removing duplicate %s: %v\n", dropped, err)
+			continue
+		}
+		pd.manifest.markDuplicate(photo, drop, kept)
+		logf("Removed %s, identical to the %s size of %s\n", dropped, kept, photo.PhotoCode)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// derivativeQuality is the JPEG quality of -derive outputs, which are meant
+// as previews rather than archival copies
+const derivativeQuality = 85
+
+// derivative is one extra file -derive makes from each download
+type derivative struct {
+	format string // jpeg or png
+	width  int    // scaled down to this many pixels wide, or 0 for full size
+}
+
+// parseDerivatives reads a comma-separated -derive list of format[@width]
+// entries, e.g. "original,jpeg@512,png". "original" names the downloaded
+// file itself and adds nothing.
+func parseDerivatives(spec string) ([]derivative, error) {
+	var derivs []derivative
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || entry == "original" {
+			continue
+		}
+		format, width, hasWidth := strings.Cut(entry, "@")
+		d := derivative{format: strings.ToLower(format)}
+		if hasWidth {
+			n, err := strconv.Atoi(width)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid width in -derive entry %q", entry)
+			}
+			d.width = n
+		}
+		switch d.format {
+		case "jpeg", "jpg":
+			d.format = "jpeg"
+		case "png":
+		case "webp":
+			return nil, fmt.Errorf("-derive cannot write WebP, as no WebP encoder is built in; use jpeg or png")
+		default:
+			return nil, fmt.Errorf("unknown format %q in -derive, expected jpeg or png", format)
+		}
+		derivs = append(derivs, d)
+	}
+	return derivs, nil
+}
+
+// name returns the filename of the derivative of filename
+func (d derivative) name(filename string) string {
+	base := strings.TrimSuffix(filename, filepath.Ext(filename))
+	ext := ".jpg"
+	if d.format == "png" {
+		ext = ".png"
+	}
+	if d.width > 0 {
+		return fmt.Sprintf("%s_%dw%s", base, d.width, ext)
+	}
+	return base + ext
+}
+
+// key returns the manifest key of the derivative of the size key
+func (d derivative) key(key string) string {
+	if d.width > 0 {
+		return fmt.Sprintf("%s.%s@%d", key, d.format, d.width)
+	}
+	return key + "." + d.format
+}
+
+// derive decodes the saved file once and writes each of pd.derivatives next
+// to it, recording them in the manifest
+func (pd *PhotoDownloader) derive(photo Photo, key, filename, contentType string) error {
+	path := filepath.Join(outputDir, filename)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var segments []jpegSegment
+	if contentType == "image/jpeg" {
+		if segments, _, err = splitJPEG(data); err != nil {
+			return err
+		}
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("error decoding image: %v", err)
+	}
+	modTime := time.Now()
+	if info, err := os.Stat(path); err == nil {
+		modTime = info.ModTime()
+	}
+
+	for _, d := range pd.derivatives {
+		name := d.name(filename)
+		if name == filename {
+			continue // the download already is this derivative
+		}
+		img := src
+		if b := src.Bounds(); d.width > 0 && d.width < b.Dx() {
+			scaled := image.NewRGBA(image.Rect(0, 0, d.width, b.Dy()*d.width/b.Dx()))
+			xdraw.CatmullRom.Scale(scaled, scaled.Bounds(), src, b, xdraw.Src, nil)
+			img = scaled
+		}
+
+		var out []byte
+		if d.format == "png" {
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, img); err != nil {
+				return fmt.Errorf("error encoding %s: %v", name, err)
+			}
+			out = buf.Bytes()
+		} else if segments != nil {
+			if out, err = encodeKeepingSegments(img, segments, derivativeQuality); err != nil {
+				return err
+			}
+		} else {
+			var buf bytes.Buffer
+			if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: derivativeQuality}); err != nil {
+				return fmt.Errorf("error encoding %s: %v", name, err)
+			}
+			out = buf.Bytes()
+		}
+
+		target := filepath.Join(outputDir, name)
+		if err := os.WriteFile(target, out, 0644); err != nil {
+			return fmt.Errorf("error writing %s: %v", name, err)
+		}
+		os.Chtimes(target, modTime, modTime)
+		pd.addChecksum(name, pd.manifest.record(photo, d.key(key), name, fetched{}))
+		logf("Derived %s\n", name)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// catalogDiff compares the remote catalog with what is on disk
+type catalogDiff struct {
+	present []string // expected files that exist locally
+	missing []string // expected files not yet downloaded
+	orphans []string // local files no remote photo accounts for
+}
+
+// diff works out which of the planned downloads for photos are already in
+// outputDir and which local files belong to none of them
+func (pd *PhotoDownloader) diff(photos []Photo, sizes []string) (*catalogDiff, error) {
+	d := &catalogDiff{}
+	claimed := make(map[string]bool)
+
+	for _, photo := range photos {
+		downloads, _ := pd.plan(photo, sizes)
+		for _, dl := range downloads {
+			name := pd.localName(dl)
+			claimed[name] = true
+			claimed[sidecarName(name)] = true
+			if info, err := os.Stat(filepath.Join(outputDir, name)); err == nil && info.Size() > 0 {
+				d.present = append(d.present, name)
+			} else {
+				d.missing = append(d.missing, name)
+			}
+		}
+		// Files recorded for sizes outside this run's selection are still accounted for
+		for _, name := range pd.manifest.filesFor(photo) {
+			claimed[name] = true
+		}
+	}
+
+	err := filepath.WalkDir(outputDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(outputDir, path)
+		if err != nil {
+			return err
+		}
+		if bookkeepingFile(name) {
+			return nil
+		}
+		if !claimed[name] {
+			d.orphans = append(d.orphans, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error scanning %s: %v", outputDir, err)
+	}
+
+	sort.Strings(d.present)
+	sort.Strings(d.missing)
+	sort.Strings(d.orphans)
+	return d, nil
+}
+
+// bookkeepingFile reports whether name, relative to outputDir, is one of the
+// downloader's own files rather than a photo: the manifest, hidden state
+// files, the skipped list and unfinished downloads
+func bookkeepingFile(name string) bool {
+	return name == manifestName || name == skippedName || strings.HasPrefix(filepath.Base(name), ".") ||
+		strings.HasSuffix(name, partSuffix) || strings.HasSuffix(name, ".tmp")
+}
+
+// print writes the three lists of the diff
+func (d *catalogDiff) print() {
+	section := func(title string, names []string) {
+		fmt.Printf("%s (%d):\n", title, len(names))
+		for _, name := range names {
+			fmt.Printf("  %s\n", name)
+		}
+	}
+	section("Present", d.present)
+	section("Missing locally", d.missing)
+	section("Local orphans", d.orphans)
+}
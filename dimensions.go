@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"os"
+)
+
+// What -check-dimensions does with a file whose dimensions are off
+const (
+	dimsWarn  = "warn"  // log it and keep the file
+	dimsRetry = "retry" // download it again, failing once retries run out
+	dimsFail  = "fail"  // fail the download straight away
+)
+
+// dimensionPolicies lists the values -check-dimensions accepts
+var dimensionPolicies = []string{dimsWarn, dimsRetry, dimsFail}
+
+// errWrongDimensions is returned by checkDimensions for a mismatched file
+var errWrongDimensions = errors.New("wrong dimensions")
+
+// dimensions are the width and height the API reports for a file; zero
+// when unknown
+type dimensions struct {
+	width, height int
+}
+
+// expectedDimensions returns what the API reports for size of photo
+func expectedDimensions(photo Photo, size string) dimensions {
+	if size == originalSize {
+		return dimensions{photo.OriginalInfo.Width, photo.OriginalInfo.Height}
+	}
+	if v, ok := lookupVariant(size); ok {
+		ts := v.get(photo.Thumbnail)
+		return dimensions{ts.Width, ts.Height}
+	}
+	return dimensions{}
+}
+
+// checkDimensions decodes the header of the image at path and compares its
+// size with want, allowing each side to be off by tolerance as a fraction.
+// Unknown dimensions and formats the standard library cannot decode pass.
+func checkDimensions(path string, want dimensions, tolerance float64) error {
+	if want.width <= 0 || want.height <= 0 {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening file to check dimensions: %v", err)
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if errors.Is(err, image.ErrFormat) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading image dimensions: %v", err)
+	}
+	off := func(got, want int) bool {
+		return math.Abs(float64(got-want)) > tolerance*float64(want)
+	}
+	if off(cfg.Width, want.width) || off(cfg.Height, want.height) {
+		return fmt.Errorf("%w: served %dx%d, expected %dx%d", errWrongDimensions, cfg.Width, cfg.Height, want.width, want.height)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import "fmt"
+
+// diskInfo is the free capacity of the filesystem holding the output folder
+type diskInfo struct {
+	freeInodes  uint64
+	inodesKnown bool // false where the filesystem does not report inode counts
+}
+
+// preflightDisk checks the output folder has room for the given number of new
+// files before any download starts. It fails when fewer than minInodes inodes are free and
+// warns when the run needs more inodes than remain.
+func preflightDisk(dir string, files int, minInodes uint64) error {
+	info, ok := diskUsage(dir)
+	if !ok {
+		return nil
+	}
+	if !info.inodesKnown {
+		if minInodes > 0 {
+			logf("Free inodes are not reported for %s, skipping the -min-inodes check\n", dir)
+		}
+		return nil
+	}
+	if info.freeInodes < minInodes {
+		return fmt.Errorf("only %d free inodes on %s, below -min-inodes %d", info.freeInodes, dir, minInodes)
+	}
+	if uint64(files) > info.freeInodes {
+		logf("Warning: this run creates up to %d files but only %d inodes are free on %s\n", files, info.freeInodes, dir)
+	}
+	return nil
+}
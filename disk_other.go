@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package main
+
+// diskUsage is not implemented on this platform
+func diskUsage(dir string) (diskInfo, bool) {
+	return diskInfo{}, false
+}
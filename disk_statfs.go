@@ -0,0 +1,18 @@
+//go:build linux || darwin
+
+package main
+
+import "syscall"
+
+// diskUsage reports the free inodes of the filesystem holding dir
+func diskUsage(dir string) (diskInfo, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return diskInfo{}, false
+	}
+	return diskInfo{
+		freeInodes: uint64(st.Ffree),
+		// Some filesystems, such as btrfs, report zero inodes in total
+		inodesKnown: st.Files > 0,
+	}, true
+}
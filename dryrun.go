@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// jpegBytesPerPixel is roughly what a PhotoPass JPEG compresses to, used to
+// estimate download sizes from the dimensions the API reports
+const jpegBytesPerPixel = 0.35
+
+// estimateSize guesses the bytes of d from its reported dimensions, or 0 when
+// the API gives none
+func estimateSize(d download) int64 {
+	size := d.key
+	if strings.HasPrefix(size, "edit-") {
+		size = originalSize // edits keep the original's dimensions
+	}
+	return int64(float64(sizeArea(d.photo, size)) * jpegBytesPerPixel)
+}
+
+// approxSize formats a byte count in KB below a megabyte and MB above
+func approxSize(n int64) string {
+	if n < 1<<20 {
+		return fmt.Sprintf("%d KB", (n+1023)/1024)
+	}
+	return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+}
+
+// localName returns the name dl is, or would be, saved under. The manifest
+// knows the real name when the served type changed the extension.
+func (pd *PhotoDownloader) localName(dl download) string {
+	if recorded := pd.manifest.fileFor(dl.photo, dl.key); recorded != "" {
+		return recorded
+	}
+	return dl.filename
+}
+
+// dryRun prints the files a run would create with their estimated sizes.
+// With onlyMissing, files already present in outputDir are left out.
+func (pd *PhotoDownloader) dryRun(photos []Photo, sizes []string, onlyMissing bool) {
+	var planned []download
+	for _, photo := range photos {
+		downloads, problems := pd.plan(photo, sizes)
+		for _, p := range problems {
+			logf("%s\n", p)
+		}
+		for _, dl := range downloads {
+			if onlyMissing {
+				if info, err := os.Stat(filepath.Join(outputDir, pd.localName(dl))); err == nil && info.Size() > 0 {
+					continue
+				}
+			}
+			planned = append(planned, dl)
+		}
+	}
+
+	var total int64
+	unknown := 0
+	for _, dl := range planned {
+		est := estimateSize(dl)
+		if est == 0 {
+			unknown++
+			fmt.Printf("  %s  (size unknown)\n", dl.filename)
+			continue
+		}
+		total += est
+		fmt.Printf("  %s  ~%s\n", dl.filename, approxSize(est))
+	}
+	fmt.Printf("Would download %d files, about %s", len(planned), approxSize(total))
+	if unknown > 0 {
+		fmt.Printf(" plus %d of unknown size", unknown)
+	}
+	fmt.Println()
+}
+
+// listSizes prints which sizes each photo has a URL for, with the dimensions
+// the API reports, followed by how many photos have each size
+func listSizes(photos []Photo) {
+	names := make([]string, 0, len(thumbnailVariants)+1)
+	for _, v := range thumbnailVariants {
+		names = append(names, v.name)
+	}
+	names = append(names, originalSize)
+
+	counts := make(map[string]int)
+	for _, photo := range photos {
+		fields := make([]string, 0, len(names))
+		for _, name := range names {
+			var ts ThumbnailSize
+			if v, ok := lookupVariant(name); ok {
+				ts = v.get(photo.Thumbnail)
+			} else {
+				ts = ThumbnailSize{URL: photo.OriginalInfo.URL, Width: photo.OriginalInfo.Width, Height: photo.OriginalInfo.Height}
+			}
+			field := name + " -"
+			if ts.URL != "" {
+				counts[name]++
+				field = fmt.Sprintf("%s %dx%d", name, ts.Width, ts.Height)
+				if ts.Width <= 0 || ts.Height <= 0 {
+					field = name + " ?"
+				}
+				if name == originalSize && !originalAvailable(photo) {
+					field += " (not purchased)"
+				}
+			}
+			fields = append(fields, field)
+		}
+		fmt.Printf("  %s  %s\n", photo.PhotoCode, strings.Join(fields, ", "))
+	}
+
+	fmt.Printf("Sizes across %d photos:", len(photos))
+	for _, name := range names {
+		fmt.Printf(" %s %d", name, counts[name])
+	}
+	fmt.Println()
+}
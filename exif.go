@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+const (
+	markerSOI  = 0xD8
+	markerSOS  = 0xDA
+	markerAPP0 = 0xE0
+	markerAPP1 = 0xE1
+)
+
+// EXIF field types and their sizes in bytes
+const (
+	exifByte      = 1
+	exifASCII     = 2
+	exifShort     = 3
+	exifLong      = 4
+	exifRational  = 5
+	exifUndefined = 7
+	exifSLong     = 9
+	exifSRational = 10
+)
+
+var exifTypeSize = map[uint16]int{
+	exifByte: 1, exifASCII: 1, exifShort: 2, exifLong: 4, exifRational: 8,
+	exifUndefined: 1, exifSLong: 4, exifSRational: 8,
+}
+
+// Tags pointing at sub-IFDs, rebuilt by encode rather than copied
+const (
+	tagExifIFD    = 0x8769
+	tagGPSIFD     = 0x8825
+	tagInteropIFD = 0xA005
+)
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// jpegSegment is a marker segment that precedes the scan data
+type jpegSegment struct {
+	marker  byte
+	payload []byte // without the length bytes
+}
+
+// splitJPEG returns the segments before the first scan and the remainder of
+// the file starting at the SOS marker
+func splitJPEG(data []byte) ([]jpegSegment, []byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != markerSOI {
+		return nil, nil, errors.New("not a JPEG file")
+	}
+
+	var segments []jpegSegment
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xFF {
+			return nil, nil, fmt.Errorf("invalid JPEG marker at offset %d", i)
+		}
+		marker := data[i+1]
+		if marker == 0xFF { // fill byte
+			i++
+			continue
+		}
+		if marker == markerSOS {
+			return segments, data[i:], nil
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return nil, nil, fmt.Errorf("truncated JPEG segment at offset %d", i)
+		}
+		segments = append(segments, jpegSegment{marker: marker, payload: data[i+4 : i+2+length]})
+		i += 2 + length
+	}
+	return nil, nil, errors.New("no image data found in JPEG")
+}
+
+// joinJPEG reassembles a file split by splitJPEG
+func joinJPEG(segments []jpegSegment, scan []byte) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0xFF, markerSOI})
+	for _, s := range segments {
+		b.Write([]byte{0xFF, s.marker})
+		binary.Write(&b, binary.BigEndian, uint16(len(s.payload)+2))
+		b.Write(s.payload)
+	}
+	b.Write(scan)
+	return b.Bytes()
+}
+
+// exifEntry is one IFD entry with its value bytes in the file's byte order
+type exifEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// exifData holds the IFDs of an EXIF block that are worth preserving. The
+// thumbnail IFD is dropped since its offsets cannot be carried over safely.
+type exifData struct {
+	order                    binary.ByteOrder
+	ifd0, exif, gps, interop []exifEntry
+}
+
+// parseExif decodes an APP1 payload starting with the Exif header
+func parseExif(payload []byte) (*exifData, error) {
+	if !bytes.HasPrefix(payload, exifHeader) {
+		return nil, errors.New("not an EXIF segment")
+	}
+	tiff := payload[len(exifHeader):]
+	if len(tiff) < 8 {
+		return nil, errors.New("truncated EXIF data")
+	}
+
+	x := &exifData{}
+	switch string(tiff[:2]) {
+	case "II":
+		x.order = binary.LittleEndian
+	case "MM":
+		x.order = binary.BigEndian
+	default:
+		return nil, errors.New("invalid EXIF byte order")
+	}
+
+	var err error
+	var pointers map[uint16]uint32
+	if x.ifd0, pointers, err = readIFD(tiff, x.order, x.order.Uint32(tiff[4:])); err != nil {
+		return nil, err
+	}
+	if off, ok := pointers[tagExifIFD]; ok {
+		var sub map[uint16]uint32
+		if x.exif, sub, err = readIFD(tiff, x.order, off); err != nil {
+			return nil, err
+		}
+		if off, ok := sub[tagInteropIFD]; ok {
+			if x.interop, _, err = readIFD(tiff, x.order, off); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if off, ok := pointers[tagGPSIFD]; ok {
+		if x.gps, _, err = readIFD(tiff, x.order, off); err != nil {
+			return nil, err
+		}
+	}
+	return x, nil
+}
+
+// readIFD reads the entries of the IFD at off, returning sub-IFD pointers separately
+func readIFD(tiff []byte, order binary.ByteOrder, off uint32) ([]exifEntry, map[uint16]uint32, error) {
+	if int(off)+2 > len(tiff) {
+		return nil, nil, errors.New("EXIF IFD offset out of range")
+	}
+	n := int(order.Uint16(tiff[off:]))
+	start := int(off) + 2
+	if start+12*n > len(tiff) {
+		return nil, nil, errors.New("truncated EXIF IFD")
+	}
+
+	var entries []exifEntry
+	pointers := make(map[uint16]uint32)
+	for i := 0; i < n; i++ {
+		raw := tiff[start+12*i : start+12*i+12]
+		e := exifEntry{tag: order.Uint16(raw), typ: order.Uint16(raw[2:]), count: order.Uint32(raw[4:])}
+		if e.tag == tagExifIFD || e.tag == tagGPSIFD || e.tag == tagInteropIFD {
+			pointers[e.tag] = order.Uint32(raw[8:])
+			continue
+		}
+		size, ok := exifTypeSize[e.typ]
+		if !ok {
+			continue // unknown type, drop it
+		}
+		length := size * int(e.count)
+		if length <= 4 {
+			e.value = append([]byte(nil), raw[8:8+length]...)
+		} else {
+			valueOff := int(order.Uint32(raw[8:]))
+			if valueOff+length > len(tiff) {
+				continue
+			}
+			e.value = append([]byte(nil), tiff[valueOff:valueOff+length]...)
+		}
+		entries = append(entries, e)
+	}
+	return entries, pointers, nil
+}
+
+// setEntry adds e to ifd, replacing any entry with the same tag
+func setEntry(ifd *[]exifEntry, e exifEntry) {
+	for i := range *ifd {
+		if (*ifd)[i].tag == e.tag {
+			(*ifd)[i] = e
+			return
+		}
+	}
+	*ifd = append(*ifd, e)
+}
+
+// removeEntry deletes the entry for tag from ifd
+func removeEntry(ifd *[]exifEntry, tag uint16) {
+	for i := range *ifd {
+		if (*ifd)[i].tag == tag {
+			*ifd = append((*ifd)[:i], (*ifd)[i+1:]...)
+			return
+		}
+	}
+}
+
+// swapEntries exchanges the values of two tags in ifd when both are present
+func swapEntries(ifd []exifEntry, a, b uint16) {
+	i, j := -1, -1
+	for k := range ifd {
+		switch ifd[k].tag {
+		case a:
+			i = k
+		case b:
+			j = k
+		}
+	}
+	if i >= 0 && j >= 0 {
+		ifd[i].typ, ifd[j].typ = ifd[j].typ, ifd[i].typ
+		ifd[i].count, ifd[j].count = ifd[j].count, ifd[i].count
+		ifd[i].value, ifd[j].value = ifd[j].value, ifd[i].value
+	}
+}
+
+// findEntry returns the entry for tag in ifd
+func findEntry(ifd []exifEntry, tag uint16) (exifEntry, bool) {
+	for _, e := range ifd {
+		if e.tag == tag {
+			return e, true
+		}
+	}
+	return exifEntry{}, false
+}
+
+// asciiEntry builds a NUL-terminated ASCII entry
+func asciiEntry(tag uint16, s string) exifEntry {
+	v := append([]byte(s), 0)
+	return exifEntry{tag: tag, typ: exifASCII, count: uint32(len(v)), value: v}
+}
+
+// rationalEntry builds an unsigned RATIONAL entry from numerator/denominator pairs
+func (x *exifData) rationalEntry(tag uint16, pairs ...[2]uint32) exifEntry {
+	v := make([]byte, 8*len(pairs))
+	for i, p := range pairs {
+		x.order.PutUint32(v[8*i:], p[0])
+		x.order.PutUint32(v[8*i+4:], p[1])
+	}
+	return exifEntry{tag: tag, typ: exifRational, count: uint32(len(pairs)), value: v}
+}
+
+// ifdSize is the number of bytes ifd occupies including its out-of-line values
+func ifdSize(ifd []exifEntry, pointers int) int {
+	size := 2 + 12*(len(ifd)+pointers) + 4
+	for _, e := range ifd {
+		if len(e.value) > 4 {
+			size += len(e.value) + len(e.value)%2
+		}
+	}
+	return size
+}
+
+// encode serializes the EXIF block as an APP1 payload
+func (x *exifData) encode() []byte {
+	type layout struct {
+		entries  []exifEntry
+		pointers []exifEntry
+		offset   uint32
+	}
+
+	var exifPtrs []exifEntry
+	if len(x.interop) > 0 {
+		exifPtrs = append(exifPtrs, exifEntry{tag: tagInteropIFD, typ: exifLong, count: 1})
+	}
+	var ifd0Ptrs []exifEntry
+	if len(x.exif) > 0 || len(exifPtrs) > 0 {
+		ifd0Ptrs = append(ifd0Ptrs, exifEntry{tag: tagExifIFD, typ: exifLong, count: 1})
+	}
+	if len(x.gps) > 0 {
+		ifd0Ptrs = append(ifd0Ptrs, exifEntry{tag: tagGPSIFD, typ: exifLong, count: 1})
+	}
+
+	ifds := []*layout{
+		{entries: x.ifd0, pointers: ifd0Ptrs},
+		{entries: x.exif, pointers: exifPtrs},
+		{entries: x.interop},
+		{entries: x.gps},
+	}
+
+	// Assign offsets: the TIFF header takes 8 bytes, then the IFDs in order
+	offset := uint32(8)
+	for i, l := range ifds {
+		if i > 0 && len(l.entries) == 0 {
+			continue
+		}
+		l.offset = offset
+		offset += uint32(ifdSize(l.entries, len(l.pointers)))
+	}
+	target := map[uint16]uint32{tagExifIFD: ifds[1].offset, tagInteropIFD: ifds[2].offset, tagGPSIFD: ifds[3].offset}
+
+	tiff := make([]byte, offset)
+	if x.order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	x.order.PutUint16(tiff[2:], 42)
+	x.order.PutUint32(tiff[4:], 8)
+
+	for i, l := range ifds {
+		if i > 0 && len(l.entries) == 0 {
+			continue
+		}
+		all := append(append([]exifEntry(nil), l.entries...), l.pointers...)
+		sort.Slice(all, func(a, b int) bool { return all[a].tag < all[b].tag })
+
+		pos := l.offset
+		x.order.PutUint16(tiff[pos:], uint16(len(all)))
+		pos += 2
+		data := l.offset + uint32(2+12*len(all)+4)
+		for _, e := range all {
+			x.order.PutUint16(tiff[pos:], e.tag)
+			x.order.PutUint16(tiff[pos+2:], e.typ)
+			x.order.PutUint32(tiff[pos+4:], e.count)
+			switch {
+			case e.value == nil:
+				x.order.PutUint32(tiff[pos+8:], target[e.tag])
+			case len(e.value) <= 4:
+				copy(tiff[pos+8:pos+12], e.value)
+			default:
+				x.order.PutUint32(tiff[pos+8:], data)
+				copy(tiff[data:], e.value)
+				data += uint32(len(e.value) + len(e.value)%2)
+			}
+			pos += 12
+		}
+		// next-IFD offset stays zero since the thumbnail IFD is not kept
+	}
+
+	return append(append([]byte(nil), exifHeader...), tiff...)
+}
+
+// updateExif rewrites the JPEG at path after applying edit to its EXIF data,
+// creating the EXIF block when the file has none. edit reports whether it
+// changed anything; the file is left untouched otherwise. The file's
+// modification time is preserved.
+func updateExif(path string, edit func(x *exifData) bool) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	segments, scan, err := splitJPEG(data)
+	if err != nil {
+		return false, err
+	}
+
+	index := -1
+	x := &exifData{order: binary.BigEndian}
+	for i, s := range segments {
+		if s.marker == markerAPP1 && bytes.HasPrefix(s.payload, exifHeader) {
+			if x, err = parseExif(s.payload); err != nil {
+				return false, fmt.Errorf("error reading existing EXIF: %v", err)
+			}
+			index = i
+			break
+		}
+	}
+
+	if !edit(x) {
+		return false, nil
+	}
+
+	app1 := jpegSegment{marker: markerAPP1, payload: x.encode()}
+	if len(app1.payload) > 0xFFFF-2 {
+		return false, errors.New("EXIF data too large")
+	}
+	switch {
+	case index >= 0:
+		segments[index] = app1
+	case len(segments) > 0 && segments[0].marker == markerAPP0:
+		// Keep the JFIF header first
+		segments = append(segments[:1], append([]jpegSegment{app1}, segments[1:]...)...)
+	default:
+		segments = append([]jpegSegment{app1}, segments...)
+	}
+
+	return true, replaceFile(path, joinJPEG(segments, scan))
+}
+
+// replaceFile atomically overwrites path with data, keeping its modification time
+func replaceFile(path string, data []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Chtimes(path, info.ModTime(), info.ModTime())
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Process exit codes, documented in the README
+const (
+	exitOK       = 0 // everything downloaded
+	exitPartial  = 1 // some downloads failed
+	exitAuth     = 2 // the API or CDN rejected the token (401/403)
+	exitConfig   = 3 // invalid flags or local configuration
+	exitNetwork  = 4 // the network or host was unreachable
+	exitCanceled = 5 // interrupted by a signal
+)
+
+// exitCodeFor maps an error to the exit code for its category
+func exitCodeFor(err error) int {
+	if errors.Is(err, context.Canceled) {
+		return exitCanceled
+	}
+	if errors.Is(err, errTokenExpired) {
+		return exitAuth
+	}
+	var se *statusError
+	if errors.As(err, &se) && !se.expired && (se.code == http.StatusUnauthorized || se.code == http.StatusForbidden) {
+		return exitAuth
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return exitConfig // the configured host does not exist
+	}
+
+	var opErr *net.OpError
+	var netErr net.Error
+	if errors.As(err, &opErr) || errors.As(err, &dnsErr) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return exitNetwork
+	}
+	return exitPartial
+}
+
+// dominantExitCode returns the exit code for the most common category among errs
+func dominantExitCode(errs []error) int {
+	if len(errs) == 0 {
+		return exitOK
+	}
+	counts := make(map[int]int)
+	best := exitPartial
+	for _, err := range errs {
+		code := exitCodeFor(err)
+		counts[code]++
+		if counts[code] > counts[best] {
+			best = code
+		}
+	}
+	return best
+}
+
+// runCtx is the context of every request, canceled by the first SIGINT or
+// SIGTERM so downloads in flight stop and no new ones start
+var runCtx, cancelRun = context.WithCancel(context.Background())
+
+// sleep waits for d, returning early if the run is canceled
+func sleep(d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-runCtx.Done():
+	}
+}
+
+// exitOnSignal cancels runCtx on SIGINT or SIGTERM, letting the run wind down
+// and report as usual. A second signal saves progress and terminates the
+// process with exitCanceled; a third terminates it at once.
+func exitOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		logf("\nInterrupted, stopping downloads (interrupt again to save progress and quit now)\n")
+		cancelRun()
+		<-sig
+		logf("\nSaving progress (interrupt again to quit immediately)\n")
+		go func() {
+			<-sig
+			os.Exit(exitCanceled)
+		}()
+		interruptMu.Lock()
+		for _, f := range interruptHooks {
+			f()
+		}
+		if closeLogFile != nil {
+			closeLogFile()
+		}
+		os.Exit(exitCanceled)
+	}()
+}
+
+// interruptHooks run in order when a signal ends the run, e.g. to save the
+// manifest of what completed so far
+var (
+	interruptMu    sync.Mutex
+	interruptHooks []func()
+)
+
+// atInterrupt registers f to run before the process exits on a signal
+func atInterrupt(f func()) {
+	interruptMu.Lock()
+	defer interruptMu.Unlock()
+	interruptHooks = append(interruptHooks, f)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// failedDownload is one entry of the -failures-file: a single size of a
+// photo that could not be downloaded
+type failedDownload struct {
+	ID        string `json:"id"`
+	Region    string `json:"region,omitempty"`
+	PhotoCode string `json:"photoCode"`
+	Size      string `json:"size"`
+	File      string `json:"file"`
+	Error     string `json:"error"`
+}
+
+// recordDownloadFailure remembers that one size of a photo failed, for the
+// end-of-run summary and the -failures-file
+func (pd *PhotoDownloader) recordDownloadFailure(d download, err error) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	pd.failures = append(pd.failures, failure{filename: d.filename, err: err, photoID: d.photo.ID, region: photoRegion(d.photo), photoCode: d.photo.PhotoCode, size: d.key})
+}
+
+// writeFailures saves the sizes that failed this run to path, replacing what
+// it held so sizes that now succeeded drop out. Failures not tied to one
+// photo size, such as a failed archive, are left out.
+func (pd *PhotoDownloader) writeFailures(path string) error {
+	entries := []failedDownload{}
+	pd.mu.Lock()
+	for _, f := range pd.failures {
+		if f.photoID != "" {
+			entries = append(entries, failedDownload{ID: f.photoID, Region: f.region, PhotoCode: f.photoCode, Size: f.size, File: f.filename, Error: f.err.Error()})
+		}
+	}
+	pd.mu.Unlock()
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding failures: %v", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing failures: %v", err)
+	}
+	return nil
+}
+
+// loadFailures reads a -failures-file into the sizes to retry, keyed by photoKey
+func loadFailures(path string) (map[string]map[string]bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading failures: %v", err)
+	}
+	var entries []failedDownload
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("error parsing failures in %s: %v", path, err)
+	}
+	retry := make(map[string]map[string]bool)
+	for _, e := range entries {
+		region := e.Region
+		if region == "" {
+			region = defaultRegion
+		}
+		key := regionKey(region, e.ID)
+		if retry[key] == nil {
+			retry[key] = make(map[string]bool)
+		}
+		retry[key][e.Size] = true
+	}
+	return retry, nil
+}
+
+// onlyFailedSizes keeps the downloads of photo that -retry-failed lists
+func (pd *PhotoDownloader) onlyFailedSizes(photo Photo, downloads []download) []download {
+	var kept []download
+	for _, d := range downloads {
+		if pd.retrySizes[photoKey(photo)][d.key] {
+			kept = append(kept, d)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// filterPhotos returns the photos keep accepts and how many it dropped
+func filterPhotos(photos []Photo, keep func(Photo) bool) ([]Photo, int) {
+	var kept []Photo
+	for _, p := range photos {
+		if keep(p) {
+			kept = append(kept, p)
+		}
+	}
+	return kept, len(photos) - len(kept)
+}
+
+// favoritesOnly keeps photos marked as favorites. The server-side isFavorite
+// condition is not honoured by every API, so results are always re-checked.
+func favoritesOnly(photos []Photo) []Photo {
+	kept, dropped := filterPhotos(photos, func(p Photo) bool { return p.IsFavorite })
+	if dropped > 0 {
+		logf("Server returned %d non-favorite photos, filtered them client-side\n", dropped)
+	}
+	return kept
+}
+
+// parseShootBound parses an -after or -before value, either a date or an
+// RFC 3339 time. A date is taken in shootZone; as a -before bound (endOfDay)
+// it includes that whole day.
+func parseShootBound(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	zone := shootZone
+	if zone == nil {
+		zone = time.Local
+	}
+	day, err := time.ParseInLocation(time.DateOnly, value, zone)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q, expected YYYY-MM-DD or an RFC 3339 time", value)
+	}
+	if endOfDay {
+		day = day.AddDate(0, 0, 1)
+	}
+	return day, nil
+}
+
+// shotBetween reports whether photo was taken at or after after and before
+// before, either of which may be zero for no bound. Photos without a shoot
+// time never match.
+func shotBetween(photo Photo, after, before time.Time) bool {
+	t := shootTime(photo)
+	if t.IsZero() {
+		return false
+	}
+	return (after.IsZero() || !t.Before(after)) && (before.IsZero() || t.Before(before))
+}
+
+// hasExpired reports whether photo's expireDate is before now. A date lasts
+// until the end of that day; a missing or unreadable expiry never expires.
+func hasExpired(photo Photo, now time.Time) bool {
+	if photo.ExpireDate == "" {
+		return false
+	}
+	expires, err := parseShootBound(photo.ExpireDate, true)
+	return err == nil && !now.Before(expires)
+}
+
+// parseShard parses a -shard value of the form "i/n" with 0 <= i < n
+func parseShard(s string) (int, int, error) {
+	var i, n int
+	if _, err := fmt.Sscanf(s, "%d/%d", &i, &n); err != nil || n < 1 || i < 0 || i >= n {
+		return 0, 0, fmt.Errorf("invalid shard %q, expected i/n with 0 <= i < n", s)
+	}
+	return i, n, nil
+}
+
+// inShard reports whether a photo belongs to shard i of n. Photos are assigned
+// by a hash of their ID so the split does not depend on listing order and
+// every run places a photo in the same shard.
+func inShard(p Photo, i, n int) bool {
+	h := fnv.New32a()
+	h.Write([]byte(p.ID))
+	return int(h.Sum32()%uint32(n)) == i
+}
+
+// readIDs reads a newline-delimited file of photo IDs. Blank lines and lines
+// starting with # are ignored.
+func readIDs(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening ID list: %v", err)
+	}
+	defer f.Close()
+
+	ids := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ids[line] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading ID list: %v", err)
+	}
+	return ids, nil
+}
+
+// allowedIDs keeps only photos listed in ids, warning about listed IDs the
+// catalog does not contain
+func allowedIDs(photos []Photo, ids map[string]bool) []Photo {
+	found := make(map[string]bool)
+	kept, _ := filterPhotos(photos, func(p Photo) bool {
+		if ids[p.ID] {
+			found[p.ID] = true
+			return true
+		}
+		return false
+	})
+
+	var unknown []string
+	for id := range ids {
+		if !found[id] {
+			unknown = append(unknown, id)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		logf("Warning: %d listed IDs are not in the catalog: %s\n", len(unknown), strings.Join(unknown, ", "))
+	}
+	return kept
+}
+
+// missingCodes returns the codes, in the order given, that no photo in
+// photos has
+func missingCodes(photos []Photo, codes []string) []string {
+	have := make(map[string]bool, len(photos))
+	for _, p := range photos {
+		have[p.PhotoCode] = true
+	}
+	var missing []string
+	for _, code := range codes {
+		if !have[code] {
+			missing = append(missing, code)
+		}
+	}
+	return missing
+}
+
+// checkCount verifies the number of photos matched against -expect-count,
+// -min-count and -max-count. Negative limits are unset.
+func checkCount(n, expect, min, max int) error {
+	switch {
+	case expect >= 0 && n != expect:
+		return fmt.Errorf("expected %d photos but found %d", expect, n)
+	case n < min:
+		return fmt.Errorf("expected at least %d photos but found %d", min, n)
+	case max >= 0 && n > max:
+		return fmt.Errorf("expected at most %d photos but found %d", max, n)
+	}
+	return nil
+}
+
+// samplePhotos picks n photos uniformly at random using seed, keeping them in
+// listing order. All photos are returned when n is at least their number.
+func samplePhotos(photos []Photo, n int, seed int64) []Photo {
+	if n >= len(photos) {
+		return photos
+	}
+	picked := rand.New(rand.NewSource(seed)).Perm(len(photos))[:n]
+	sort.Ints(picked)
+	sample := make([]Photo, n)
+	for i, idx := range picked {
+		sample[i] = photos[idx]
+	}
+	return sample
+}
+
+// Values -download-order accepts
+const (
+	orderAPI      = "api"      // the order the API listed photos in
+	orderBalanced = "balanced" // round-robin across locations
+)
+
+// balanceLocations interleaves photos round-robin across their LocationID so
+// an interrupted run has some photos of every location. Locations take turns
+// in the order they first appear and keep their own photos in listing order.
+func balanceLocations(photos []Photo) []Photo {
+	var order []string
+	byLocation := make(map[string][]Photo)
+	for _, p := range photos {
+		if _, ok := byLocation[p.LocationID]; !ok {
+			order = append(order, p.LocationID)
+		}
+		byLocation[p.LocationID] = append(byLocation[p.LocationID], p)
+	}
+
+	balanced := make([]Photo, 0, len(photos))
+	for round := 0; len(balanced) < len(photos); round++ {
+		for _, loc := range order {
+			if group := byLocation[loc]; round < len(group) {
+				balanced = append(balanced, group[round])
+			}
+		}
+	}
+	return balanced
+}
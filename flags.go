@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// listFlag is a flag.Value that may be given multiple times or as a comma list
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// paramFlag collects repeated key=value flags into query parameters
+type paramFlag struct {
+	values url.Values
+}
+
+func (p *paramFlag) String() string {
+	if p.values == nil {
+		return ""
+	}
+	return p.values.Encode()
+}
+
+func (p *paramFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	if p.values == nil {
+		p.values = url.Values{}
+	}
+	p.values.Add(key, val)
+	return nil
+}
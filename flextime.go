@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// FlexTime is a timestamp that tolerates the layouts the API has been seen
+// to use. Values it cannot parse decode as the zero time instead of failing
+// the whole response.
+type FlexTime time.Time
+
+// flexLayouts are tried in order when decoding a FlexTime string
+var flexLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.000Z0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006/01/02 15:04:05",
+	"2006-01-02",
+}
+
+// UnmarshalJSON accepts any of flexLayouts, Unix milliseconds, or null
+func (t *FlexTime) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		*t = FlexTime{}
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		// Some endpoints send epoch milliseconds as a bare number
+		if ms, err := strconv.ParseInt(string(data), 10, 64); err == nil {
+			*t = FlexTime(time.UnixMilli(ms).UTC())
+			return nil
+		}
+		logf("Warning: ignoring unparseable timestamp %s\n", data)
+		*t = FlexTime{}
+		return nil
+	}
+	if s == "" {
+		*t = FlexTime{}
+		return nil
+	}
+
+	for _, layout := range flexLayouts {
+		if parsed, err := time.Parse(layout, s); err == nil {
+			*t = FlexTime(parsed)
+			return nil
+		}
+	}
+	logf("Warning: ignoring unparseable timestamp %q\n", s)
+	*t = FlexTime{}
+	return nil
+}
+
+// MarshalJSON writes the time in RFC 3339 so it reads back unchanged
+func (t FlexTime) MarshalJSON() ([]byte, error) {
+	return time.Time(t).MarshalJSON()
+}
+
+// Time returns the value as a time.Time
+func (t FlexTime) Time() time.Time {
+	return time.Time(t)
+}
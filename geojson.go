@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// geoCollection is a GeoJSON FeatureCollection of photo locations
+type geoCollection struct {
+	Type     string       `json:"type"`
+	Features []geoFeature `json:"features"`
+}
+
+// geoFeature is one photo placed at its location's coordinates
+type geoFeature struct {
+	Type       string        `json:"type"`
+	Geometry   geoPoint      `json:"geometry"`
+	Properties geoProperties `json:"properties"`
+}
+
+// geoPoint is a GeoJSON Point; coordinates are [longitude, latitude]
+type geoPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+// geoProperties describe the photo behind a feature
+type geoProperties struct {
+	ID         string `json:"id"`
+	PhotoCode  string `json:"photoCode"`
+	LocationID string `json:"locationId"`
+	ShootOn    string `json:"shootOn,omitempty"`
+	File       string `json:"file,omitempty"` // relative to the GeoJSON file
+}
+
+// writeGeoJSON writes a feature for each photo with known coordinates to
+// path, linking the file saved for size. Photos without coordinates are left
+// out with a warning.
+func (pd *PhotoDownloader) writeGeoJSON(photos []Photo, size, path string) error {
+	base, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return fmt.Errorf("error resolving %s: %v", path, err)
+	}
+	out, err := filepath.Abs(outputDir)
+	if err != nil {
+		return fmt.Errorf("error resolving %s: %v", outputDir, err)
+	}
+
+	collection := geoCollection{Type: "FeatureCollection", Features: []geoFeature{}}
+	unmapped := 0
+	for _, photo := range photos {
+		c, ok := pd.locationCoords[photo.LocationID]
+		if !ok {
+			unmapped++
+			continue
+		}
+		props := geoProperties{ID: photo.ID, PhotoCode: photo.PhotoCode, LocationID: photo.LocationID}
+		if shootOn := shootTime(photo); !shootOn.IsZero() {
+			props.ShootOn = shootOn.Format(time.RFC3339)
+		}
+		name := pd.manifest.fileFor(photo, size)
+		if name == "" {
+			// Sizes chosen by -width or -all-thumbnails have other keys
+			if names := pd.manifest.filesFor(photo); len(names) > 0 {
+				sort.Strings(names)
+				name = names[0]
+			}
+		}
+		if name != "" {
+			if rel, err := filepath.Rel(base, filepath.Join(out, name)); err == nil {
+				props.File = filepath.ToSlash(rel)
+			}
+		}
+		collection.Features = append(collection.Features, geoFeature{
+			Type:       "Feature",
+			Geometry:   geoPoint{Type: "Point", Coordinates: [2]float64{c.lon, c.lat}},
+			Properties: props,
+		})
+	}
+	if unmapped > 0 {
+		logf("Warning: %d photos have no coordinates in -location-coords and were left out of %s\n", unmapped, path)
+	}
+
+	data, err := json.MarshalIndent(collection, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding GeoJSON: %v", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing GeoJSON: %v", err)
+	}
+	logf("Wrote %d photo locations to %s\n", len(collection.Features), path)
+	return nil
+}
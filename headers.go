@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// extraHeaders are set on every API and download request, for WAFs and CDNs
+// that reject requests without a Referer, Origin or similar
+var extraHeaders http.Header
+
+// readHeadersFile reads one "Name: value" header per line from path. Blank
+// lines and # comments are ignored; repeating a name sends every value.
+func readHeadersFile(path string) (http.Header, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening headers file: %v", err)
+	}
+	defer f.Close()
+
+	h := make(http.Header)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(text, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("%s:%d: expected Name: value, got %q", path, line, text)
+		}
+		h.Add(name, strings.TrimSpace(value))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading headers file: %v", err)
+	}
+	return h, nil
+}
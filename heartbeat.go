@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// startHeartbeat prints the running totals every interval, even with -quiet,
+// so long unattended runs show in their logs whether they are still moving.
+// The returned func stops it.
+func startHeartbeat(stats *downloadStats, interval time.Duration) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		started := time.Now()
+		lastBytes := int64(0)
+		for {
+			select {
+			case <-ticker.C:
+				bytes := stats.bytes.Load()
+				rate := float64(bytes-lastBytes) / interval.Seconds() / (1 << 20)
+				lastBytes = bytes
+				if progressLine.Load() {
+					fmt.Print("\r\033[K")
+				}
+				state := ""
+				if stats.paused.Load() {
+					state = " (paused)"
+				}
+				fmt.Printf("[%v] %d downloaded, %d failed, %d skipped, %d in flight, %.1f MB, %.2f MB/s%s\n",
+					time.Since(started).Round(time.Second), stats.downloaded.Load(), stats.failed.Load(),
+					stats.skipped.Load(), stats.inFlight.Load(), float64(bytes)/(1<<20), rate, state)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
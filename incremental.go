@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// catalogTimeName is the file in outputDir holding the API's Result.Time of
+// the last fully successful -incremental-catalog run, per token
+const catalogTimeName = ".catalog-time.json"
+
+// incrementalParam is the query parameter the stored Result.Time is sent as
+var incrementalParam = "time"
+
+// sinceKey carries a token's catalog time through a list call's context
+type sinceKey struct{}
+
+// withCatalogSince asks photoConditions to request only photos after t
+func withCatalogSince(ctx context.Context, t int64) context.Context {
+	return context.WithValue(ctx, sinceKey{}, t)
+}
+
+// catalogSince returns the time set by withCatalogSince, if any
+func catalogSince(ctx context.Context) (int64, bool) {
+	t, ok := ctx.Value(sinceKey{}).(int64)
+	return t, ok
+}
+
+// catalogClock remembers the server time of each token's listing, so the
+// next run can ask the API for only what was added since
+type catalogClock struct {
+	mu      sync.Mutex
+	path    string
+	since   map[string]int64 // loaded from the last run
+	latest  map[string]int64 // seen during this run
+	ignored map[string]bool  // tokens whose listing came back whole despite the cursor
+}
+
+// loadCatalogClock reads the times saved in path; a missing file means every
+// token is listed in full
+func loadCatalogClock(path string) (*catalogClock, error) {
+	c := &catalogClock{path: path, since: make(map[string]int64), latest: make(map[string]int64), ignored: make(map[string]bool)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading catalog time: %v", err)
+	}
+	if err := json.Unmarshal(data, &c.since); err != nil {
+		return nil, fmt.Errorf("error parsing catalog time in %s: %v", path, err)
+	}
+	return c, nil
+}
+
+// serverTime converts a Result.Time, which may be in seconds or milliseconds
+func serverTime(t int64) time.Time {
+	if t > 1e11 {
+		return time.UnixMilli(t)
+	}
+	return time.Unix(t, 0)
+}
+
+// list wraps list so tokens with a saved time only fetch newer photos. A
+// request the API rejects with the cursor is retried without it.
+func (c *catalogClock) list(list listFunc) listFunc {
+	return func(ctx context.Context, token string, page, limit int) (*APIResponse, error) {
+		c.mu.Lock()
+		since, ok := c.since[token]
+		c.mu.Unlock()
+
+		var resp *APIResponse
+		var err error
+		if !ok {
+			resp, err = list(ctx, token, page, limit)
+		} else {
+			resp, err = list(withCatalogSince(ctx, since), token, page, limit)
+			if err != nil && exitCodeFor(err) != exitAuth {
+				logf("Incremental listing for token %s failed, listing everything: %v\n", tokenLabel(token), err)
+				c.mu.Lock()
+				delete(c.since, token)
+				c.mu.Unlock()
+				ok = false
+				resp, err = list(ctx, token, page, limit)
+			}
+		}
+		if err != nil {
+			return resp, err
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if resp.Result.Time > c.latest[token] {
+			c.latest[token] = resp.Result.Time
+		}
+		if ok && !c.ignored[token] {
+			cutoff := serverTime(since)
+			for _, p := range resp.Result.Photos {
+				if !newerThan(p, cutoff) {
+					logf("The API ignored the catalog time for token %s, listing everything\n", tokenLabel(token))
+					c.ignored[token] = true
+					break
+				}
+			}
+		}
+		return resp, nil
+	}
+}
+
+// save records this run's times for the next one. Tokens the API returned no
+// time for keep their previous one.
+func (c *catalogClock) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	times := make(map[string]int64, len(c.since)+len(c.latest))
+	for token, t := range c.since {
+		times[token] = t
+	}
+	for token, t := range c.latest {
+		times[token] = t
+	}
+	data, err := json.MarshalIndent(times, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding catalog time: %v", err)
+	}
+	if err := os.WriteFile(c.path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error saving catalog time: %v", err)
+	}
+	return nil
+}
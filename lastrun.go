@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// lastRunName is the file in outputDir holding the start time of the last
+// fully successful run, for -newer-than-last-run
+const lastRunName = ".last-run"
+
+// readLastRun returns the time saved in path, or false if no run has been
+// recorded yet
+func readLastRun(path string) (time.Time, bool, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("error reading last run time: %v", err)
+	}
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(data)))
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("error parsing last run time in %s: %v", path, err)
+	}
+	return t, true, nil
+}
+
+// writeLastRun saves started to path
+func writeLastRun(path string, started time.Time) error {
+	if err := os.WriteFile(path, []byte(started.UTC().Format(time.RFC3339Nano)+"\n"), 0644); err != nil {
+		return fmt.Errorf("error saving last run time: %v", err)
+	}
+	return nil
+}
+
+// newerThan reports whether photo was taken or changed after t
+func newerThan(photo Photo, t time.Time) bool {
+	return photo.ShootOn.Time().After(t) || photo.ModifiedOn.Time().After(t)
+}
@@ -0,0 +1,28 @@
+package main
+
+import "fmt"
+
+// quiet suppresses progress output so that only failures are reported
+var quiet bool
+
+// logf prints progress output unless quiet mode is enabled
+func logf(format string, args ...interface{}) {
+	if quiet {
+		return
+	}
+	if progressLine.Load() {
+		// Clear the live progress line; the next tick redraws it
+		fmt.Print("\r\033[K")
+	}
+	fmt.Printf(format, args...)
+}
+
+// verbose enables debugf output
+var verbose bool
+
+// debugf prints diagnostic output when -verbose is set
+func debugf(format string, args ...interface{}) {
+	if verbose {
+		logf(format, args...)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// rotatingLog is an append-only log file. Once a write would take it past
+// maxSize bytes, it is gzipped to path.1.gz, older copies move up one to
+// path.2.gz and so on, and copies past maxFiles are deleted.
+type rotatingLog struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64 // 0 never rotates
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+// openRotatingLog opens path for appending, creating it if needed
+func openRotatingLog(path string, maxSize int64, maxFiles int) (*rotatingLog, error) {
+	l := &rotatingLog{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens path and picks up the size it already has
+func (l *rotatingLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening log file: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("error opening log file: %v", err)
+	}
+	l.f, l.size = f, info.Size()
+	return nil
+}
+
+// Write appends p, rotating first if it would not fit. A failed rotation
+// keeps writing to the current file rather than losing the message.
+func (l *rotatingLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			fmt.Fprintf(l.f, "Warning: %v\n", err)
+		}
+	}
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate compresses the current file into path.1.gz and starts a new one
+func (l *rotatingLog) rotate() error {
+	if l.maxFiles < 1 {
+		if err := l.f.Truncate(0); err != nil {
+			return fmt.Errorf("error rotating log file: %v", err)
+		}
+		l.size = 0
+		return nil
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d.gz", l.path, l.maxFiles))
+	for i := l.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d.gz", l.path, i), fmt.Sprintf("%s.%d.gz", l.path, i+1))
+	}
+	if err := gzipFile(l.path, l.path+".1.gz"); err != nil {
+		return fmt.Errorf("error rotating log file: %v", err)
+	}
+	l.f.Close()
+	removeErr := os.Remove(l.path)
+	if err := l.open(); err != nil {
+		return err
+	}
+	if removeErr != nil {
+		return fmt.Errorf("error rotating log file: %v", removeErr)
+	}
+	return nil
+}
+
+// gzipFile writes a gzip-compressed copy of src to dst
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if gzErr := gz.Close(); err == nil {
+		err = gzErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// Close closes the current file
+func (l *rotatingLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// closeLogFile flushes and closes the -logfile, if any. It runs after the
+// interrupt hooks so their messages still reach the log.
+var closeLogFile func()
+
+// redirectStdout sends everything printed to os.Stdout, from any goroutine,
+// to w instead. The returned func flushes what is still in flight and must
+// be called before the process exits.
+func redirectStdout(w io.Writer) (func(), error) {
+	r, pw, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("error redirecting output: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		io.Copy(w, r)
+		close(done)
+	}()
+	orig := os.Stdout
+	os.Stdout = pw
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			os.Stdout = orig
+			pw.Close()
+			<-done
+		})
+	}, nil
+}
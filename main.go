@@ -1,14 +1,23 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"math"
 	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 )
 
@@ -41,11 +50,11 @@ type Photo struct {
 	SiteID        string    `json:"siteId"`
 	PhotoCode     string    `json:"photoCode"`
 	LocationID    string    `json:"locationId"`
-	ShootOn       time.Time `json:"shootOn"`
-	ExtractOn     time.Time `json:"extractOn"`
+	ShootOn       FlexTime  `json:"shootOn"`
+	ExtractOn     FlexTime  `json:"extractOn"`
 	Thumbnail     Thumbnail `json:"thumbnail"`
 	ParentID      string    `json:"parentId"`
-	ModifiedOn    time.Time `json:"modifiedOn"`
+	ModifiedOn    FlexTime  `json:"modifiedOn"`
 	MimeType      string    `json:"mimeType"`
 	BundleWithPPP bool      `json:"bundleWithPPP"`
 	CreatedBy     string    `json:"createdBy"`
@@ -69,6 +78,9 @@ type Photo struct {
 		CType   string   `json:"cType"`
 		UserIDs []string `json:"userIds"`
 	} `json:"customerIds"`
+
+	SourceToken string `json:"-"` // token whose catalog listed this photo
+	DirectURL   string `json:"-"` // set for -urls-file entries, downloaded as-is under PhotoCode
 }
 
 // Thumbnail represents the thumbnail structure
@@ -89,131 +101,2469 @@ type ThumbnailSize struct {
 
 const (
 	baseURL    = "https://www.disneyphotopass.com.hk/"
-	outputDir  = "disney_photos" // The directory where photos will be saved
+	apiBaseURL = "https://api.disneyphotopass.com.hk/shoppingapi/p/"
 )
 
+// outputDir is the directory where photos will be saved, set by -out
+var outputDir = "disney_photos"
+
 // PhotoDownloader handles concurrent downloads of photos
 type PhotoDownloader struct {
-	client *http.Client
-	wg     sync.WaitGroup
+	client       *http.Client
+	wg           sync.WaitGroup
+	manifest     *Manifest
+	resume       bool          // skip sizes the manifest already records with a present file
+	tokenDir     bool          // save each photo under a subfolder named after its source token
+	regionDirs   bool          // save each photo under a subfolder named after the region it was listed from
+	statusDirs   bool          // save each photo under paid/, watermarked/, free/ or unpaid/ first
+	sizeDirs     bool          // save each size in its own subfolder instead of suffixing the filename
+	maxSize      int64         // largest file accepted in bytes, 0 for no limit
+	minBytes     int64         // smallest body accepted; shorter ones are failed and retried
+	maxIdle      time.Duration // abort and retry a download receiving no bytes for this long, 0 for no limit
+	timeout      time.Duration // with timeoutPerMB, the time every download gets before its size is known
+	timeoutPerMB time.Duration // extra time per megabyte of the response; 0 keeps the client's fixed timeout
+	stats        downloadStats
+	proxies      *proxyPool // optional; when set, requests rotate across its clients
+	validate     bool       // decode each downloaded file to confirm it is a real image
+	checkDims    string     // dimsWarn, dimsRetry or dimsFail to compare each image's size with the API's; empty skips it
+	dimsSlack    float64    // fraction either side may be off by before checkDims steps in
+
+	overwriteIfLarger   bool               // replace existing files only when the remote copy is bigger
+	skipExisting        bool               // keep non-empty existing files without asking the server
+	overwrite           bool               // download every file again, ignoring existing copies
+	retries             int                // extra attempts for a failed download
+	width               int                // when set, pick the variant closest to this width instead of sizes
+	followEdits         bool               // also download every version in OriginalInfo.EditHistorys
+	nameTemplate        *template.Template // optional override for the filename of each size
+	onTemplateError     string             // templateSkip, templateFallback or templateAbort
+	templateFailure     string             // first render failure under templateAbort, guarded by mu
+	stopAfter           time.Time          // when set, start no new downloads after this time
+	refresher           *urlRefresher      // re-lists the catalog when a signed URL expires
+	allSizes            bool               // download every populated thumbnail variant instead of sizes
+	withOriginal        bool               // with allSizes, also download the original
+	tryUnpurchased      bool               // attempt originals that are neither paid for nor downloadable
+	preferAspect        bool               // replace thumbnails cropped to another aspect ratio than the original
+	fallbackToThumbnail bool               // save the largest thumbnail when the original is paywalled
+	dedupeSizes         bool               // delete sizes of a photo that are byte-identical to another
+	dedupeLink          string             // with dedupeSizes or contents, replace duplicates with this kind of link instead
+	contents            *contentIndex      // with -dedupe, the files kept by content hash; nil to keep every copy
+	sem                 chan struct{}      // bounds concurrent downloads; nil for no limit
+	writeSem            chan struct{}      // bounds files being written at once; nil for no limit
+	conversions         *conversionPool    // runs post-processing apart from download slots; nil to run it in the slot
+	skips               *skipLog           // photos and sizes not downloaded, for skipped.json
+	breaker             *throttleBreaker   // pauses and slows all downloads on bursts of 429s; nil when off
+	buffers             *copyBuffers       // buffers download bodies are copied through
+	locationCoords      map[string]coord   // GPS position to embed for each LocationID
+	exifDates           bool               // embed ShootOn as the EXIF capture date of JPEGs that have none
+	archive             sink               // when set, downloads go here instead of outputDir
+	groupByDate         bool               // save each photo under a subfolder named after its shoot date
+	dateTree            bool               // save each photo under YYYY/MM/DD folders of its shoot date
+	preserveTimestamps  bool               // date files by ShootOn when the server sends no Last-Modified
+	autoOrient          bool               // rotate JPEGs upright according to their EXIF orientation
+	queue               *downloadQueue     // when set, completed downloads are removed from this persisted queue
+	xmpSidecars         bool               // write an .xmp sidecar next to each downloaded image
+	precheck            bool               // HEAD each URL first and skip ones the server does not have
+	hostLimits          *hostLimits        // per-host request rates, nil for unlimited
+	names               *nameRegistry      // output paths claimed so far this run
+	sharedURLs          *sharedURLs        // URLs several downloads of the run fetch
+	watermark           *watermark         // overlay composited onto each downloaded JPEG
+	jpegQuality         int                // re-encode JPEGs at this quality when smaller; 0 to keep them as served
+	stripExif           bool               // remove EXIF, XMP and comments from downloaded JPEGs
+	derivatives         []derivative       // extra formats and widths made from each JPEG or PNG download
+	abortOnAuthError    bool               // stop the run at the first download refused with 401/403
+	maxTotalBytes       int64              // start no download that would take the run past this many bytes; 0 for no cap
+	authFailed          atomic.Bool        // set once a download was refused under abortOnAuthError
+
+	// SanitizeName makes one element of a file path safe for the target
+	// filesystem. Defaults to sanitizePortable.
+	SanitizeName func(name string) string
+
+	// ShouldRetry decides whether a failed download is attempted again, up to
+	// the configured number of retries. resp is nil when no response arrived.
+	// Defaults to defaultShouldRetry.
+	ShouldRetry func(resp *http.Response, err error, attempt int) bool
+
+	// Doer sends every download request, so tests can substitute a stub or
+	// an httptest.Server's client. Defaults to client, or with -proxy-list
+	// to the pool's clients.
+	Doer HTTPDoer
+
+	// Filter, when set, is asked about each photo before its downloads are
+	// dispatched; photos it rejects are skipped and counted as filtered.
+	Filter func(photo Photo) bool
+
+	mu       sync.Mutex
+	failures []failure // every download that failed
+
+	retrySizes map[string]map[string]bool // with -retry-failed, the sizes to download for each photoKey
+	webhook    *webhook                   // receives an event per finished download; nil for none
+	checksums  *checksumList              // -checksums file each completed file is appended to; nil for none
+	window     *successWindow             // recent attempt outcomes for -adaptive-retry; nil for a fixed retry count
+}
+
+// failure is a download that failed permanently. The photo fields are set
+// when it was one size of a photo.
+type failure struct {
+	filename  string
+	err       error
+	photoID   string
+	region    string
+	photoCode string
+	size      string
 }
 
-func NewPhotoDownloader() *PhotoDownloader {
+func NewPhotoDownloader(manifest *Manifest) *PhotoDownloader {
 	return &PhotoDownloader{
-		client: &http.Client{Timeout: 30 * time.Second},
+		client:       &http.Client{Timeout: 30 * time.Second, Transport: newDownloadTransport(true)},
+		manifest:     manifest,
+		ShouldRetry:  defaultShouldRetry,
+		SanitizeName: sanitizePortable,
+		names:        newNameRegistry(collideSuffix),
+		sharedURLs:   newSharedURLs(),
+		minBytes:     1,
+	}
+}
+
+// SetConcurrency caps how many downloads run at once and returns the cap.
+// A limit of 0 or below falls back to defaultConcurrency, so downloads are
+// always bounded.
+func (pd *PhotoDownloader) SetConcurrency(n int) int {
+	if n <= 0 {
+		n = defaultConcurrency()
+	}
+	pd.sem = make(chan struct{}, n)
+	return n
+}
+
+// maxIdlePerHost keeps enough idle connections to the CDN for every
+// concurrent download to reuse one instead of reconnecting
+const maxIdlePerHost = 32
+
+// newDownloadTransport returns the transport downloads use, with keep-alives
+// on and HTTP/2 attempted unless http2 is false
+func newDownloadTransport(http2 bool) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConnsPerHost = maxIdlePerHost
+	t.MaxIdleConns = 4 * maxIdlePerHost
+	t.DisableKeepAlives = false
+	t.ForceAttemptHTTP2 = http2
+	if !http2 {
+		// A non-nil empty map stops the transport from negotiating h2
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return t
+}
+
+// defaultShouldRetry is the built-in retry policy: every failure is retried
+// except a file the server says does not exist
+func defaultShouldRetry(resp *http.Response, err error, attempt int) bool {
+	return resp == nil || (resp.StatusCode != http.StatusNotFound && resp.StatusCode != http.StatusGone)
+}
+
+// maxRetryDelay caps the wait between attempts at a download
+const maxRetryDelay = 30 * time.Second
+
+// retryDelay is how long to wait before the given retry of a download: a
+// second before the first, doubling each time up to maxRetryDelay
+func retryDelay(attempt int) time.Duration {
+	if attempt > 5 {
+		return maxRetryDelay
+	}
+	return min(time.Second<<(attempt-1), maxRetryDelay)
+}
+
+// attemptsError notes how many attempts a download failed after
+func attemptsError(err error, attempts int) error {
+	if attempts == 1 {
+		return fmt.Errorf("%w (1 attempt)", err)
+	}
+	return fmt.Errorf("%w (%d attempts)", err, attempts)
+}
+
+// shouldRetry consults pd.ShouldRetry about a failed attempt
+func (pd *PhotoDownloader) shouldRetry(err error, attempt int) bool {
+	if runCtx.Err() != nil {
+		return false
+	}
+	var resp *http.Response
+	var se *statusError
+	if errors.As(err, &se) {
+		resp = se.resp
+		// Every failed attempt passes through here, so this is where the
+		// breaker counts them
+		if se.code == http.StatusTooManyRequests && pd.breaker != nil {
+			pd.breaker.hit()
+		}
 	}
+	policy := pd.ShouldRetry
+	if policy == nil {
+		policy = defaultShouldRetry
+	}
+	return policy(resp, err, attempt)
+}
+
+// pickClient waits for req's host to allow another request, then returns the
+// client to send it with and a callback reporting whether it went through
+func (pd *PhotoDownloader) pickClient(req *http.Request) (HTTPDoer, func(ok bool)) {
+	requestLimit.wait()
+	pd.hostLimits.wait(req.URL.Hostname())
+	if pd.Doer != nil {
+		return pd.Doer, func(bool) {}
+	}
+	if pd.proxies == nil {
+		return pd.client, func(bool) {}
+	}
+	pc := pd.proxies.pick()
+	return pc.client, func(ok bool) { pd.proxies.report(pc, ok) }
+}
+
+// requestOK reports whether a request reached a healthy server
+func requestOK(resp *http.Response, err error) bool {
+	return err == nil && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500
+}
+
+// errNotModified is returned by downloadPhoto when the server reports the
+// local copy is still current
+var errNotModified = errors.New("not modified")
+
+// validators describe the local copy of a file for a conditional request
+type validators struct {
+	since time.Time // sent as If-Modified-Since when non-zero
+	etag  string    // sent as If-None-Match when non-empty
+}
+
+// conditional reports whether v would make a request conditional
+func (v validators) conditional() bool {
+	return !v.since.IsZero() || v.etag != ""
 }
 
-func (pd *PhotoDownloader) downloadPhoto(url, filepath string) error {
-	resp, err := pd.client.Get(url)
+// fetched describes a file saved by downloadPhoto
+type fetched struct {
+	contentType string // sniffed from the body
+	etag        string // the server's ETag, empty if it sent none
+	status      int    // HTTP status of the response that completed the file
+	bytes       int64  // size of the file as served
+	attempts    int    // requests made, set by fetchWithRetry
+	finalURL    string // the URL redirects led to, empty when not redirected
+}
+
+// downloadPhoto saves url to filepath and returns the content type sniffed
+// from the body along with the server's ETag. The body is written to a .part
+// file first, which a later attempt resumes with a Range request. When cond
+// holds validators the request is conditional and errNotModified is returned
+// if the local copy is still current. The saved file takes the server's
+// Last-Modified time, or fallback when the header is missing and fallback is
+// non-zero.
+func (pd *PhotoDownloader) downloadPhoto(url, filepath string, cond validators, fallback time.Time) (fetched, error) {
+	part := filepath + partSuffix
+	var offset int64
+	if info, err := os.Stat(part); err == nil && !cond.conditional() {
+		offset = info.Size()
+	}
+
+	req, err := newRequest(http.MethodGet, url)
 	if err != nil {
-		return fmt.Errorf("error downloading image: %v", err)
+		return fetched{}, fmt.Errorf("error creating request: %v", err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	} else {
+		// Servers give If-None-Match precedence when both are sent
+		if !cond.since.IsZero() {
+			req.Header.Set("If-Modified-Since", cond.since.UTC().Format(http.TimeFormat))
+		}
+		if cond.etag != "" {
+			req.Header.Set("If-None-Match", cond.etag)
+		}
+	}
+
+	client, done := pd.pickClient(req)
+	req, deadline, stop := pd.bounded(req)
+	defer stop()
+	var idle *idleWatch
+	if pd.maxIdle > 0 {
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		req = req.WithContext(ctx)
+		idle = watchIdle(pd.maxIdle, cancel)
+		defer idle.stop()
+	}
+	resp, err := client.Do(req)
+	done(requestOK(resp, err))
+	if err != nil {
+		if idle != nil {
+			err = idle.explain(err)
+		}
+		err = deadline.explain(err)
+		return fetched{}, fmt.Errorf("error downloading image: %w", err)
 	}
 	defer resp.Body.Close()
+	deadline.scale(resp.ContentLength)
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("received non-200 status code: %d", resp.StatusCode)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		offset = 0 // the server ignored the range, start over
+	case http.StatusPartialContent:
+		if offset == 0 || !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			os.Remove(part)
+			return fetched{}, fmt.Errorf("server returned an unexpected range %q", resp.Header.Get("Content-Range"))
+		}
+	case http.StatusNotModified:
+		return fetched{}, errNotModified
+	case http.StatusRequestedRangeNotSatisfiable:
+		os.Remove(part)
+		return fetched{}, fmt.Errorf("partial download no longer matches the remote file")
+	case http.StatusForbidden:
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fetched{}, &statusError{code: resp.StatusCode, expired: looksExpired(url, snippet), resp: resp}
+	default:
+		return fetched{}, &statusError{code: resp.StatusCode, resp: resp}
+	}
+
+	if pd.maxSize > 0 && resp.ContentLength >= 0 && offset+resp.ContentLength > pd.maxSize {
+		os.Remove(part)
+		return fetched{}, fmt.Errorf("file size %d exceeds limit of %d bytes", offset+resp.ContentLength, pd.maxSize)
+	}
+
+	// Keep the first bytes of the whole file for sniffing, including any part
+	// already on disk from an earlier attempt
+	var sniff sniffBuffer
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		if f, err := os.Open(part); err == nil {
+			io.CopyN(&sniff, f, sniffLen)
+			f.Close()
+		}
+	}
+
+	if pd.writeSem != nil {
+		pd.writeSem <- struct{}{}
+		defer func() { <-pd.writeSem }()
+	}
+	out, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return fetched{}, fmt.Errorf("error creating file: %v", err)
+	}
+
+	var body io.Reader = resp.Body
+	if idle != nil {
+		body = idle.reader(body)
+	}
+	if pd.maxSize > 0 {
+		// Read one byte past the limit so an oversized body is detectable
+		body = io.LimitReader(body, pd.maxSize-offset+1)
+	}
+	body = io.TeeReader(body, &sniff)
+
+	n, err := pd.buffers.copy(out, body)
+	pd.stats.bytes.Add(n)
+	if idle != nil {
+		err = idle.explain(err)
+	}
+	err = deadline.explain(err)
+	oversized := pd.maxSize > 0 && offset+n > pd.maxSize
+	if err == nil && oversized {
+		err = fmt.Errorf("file exceeds limit of %d bytes", pd.maxSize)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// Keep the partial file to resume from unless it can never succeed
+		if oversized {
+			os.Remove(part)
+		}
+		return fetched{}, err
+	}
+	if size := offset + n; size < pd.minBytes {
+		// A 200 with an empty or truncated body; retry rather than keep it
+		os.Remove(part)
+		return fetched{}, fmt.Errorf("server sent only %d bytes, below the %d byte minimum", size, pd.minBytes)
+	}
+
+	if err := os.Rename(part, filepath); err != nil {
+		return fetched{}, fmt.Errorf("error finalizing file: %v", err)
+	}
+
+	// Match the server's timestamp so the next conditional request compares like with like
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		os.Chtimes(filepath, modified, modified)
+	} else if !fallback.IsZero() {
+		os.Chtimes(filepath, fallback, fallback)
+	}
+	got := fetched{
+		contentType: sniffImageType(sniff.Bytes()),
+		etag:        resp.Header.Get("ETag"),
+		status:      resp.StatusCode,
+		bytes:       offset + n,
+	}
+	if final := resp.Request.URL.String(); final != url {
+		got.finalURL = final
+	}
+	return got, nil
+}
+
+// fetchWithRetry downloads url to filepath, retrying failures up to
+// pd.retryLimit times, and describes the saved file. want is checked when
+// pd.checkDims is set. The number of attempts is set even when it fails.
+func (pd *PhotoDownloader) fetchWithRetry(url, filepath string, cond validators, fallback time.Time, want dimensions) (fetched, error) {
+	var got fetched
+	var err error
+	attempts := 0
+	for attempt := 0; attempt <= pd.retryLimit(); attempt++ {
+		attempts++
+		if attempt > 0 {
+			pd.stats.retryAttempts.Add(1)
+			sleep(retryDelay(attempt))
+			pd.breaker.wait()
+		}
+
+		if pd.window != nil {
+			pd.window.wait()
+		}
+		got, err = pd.downloadPhoto(url, filepath, cond, fallback)
+		if err == nil && pd.validate {
+			if err = validateImage(filepath, got.contentType); err != nil {
+				os.Remove(filepath)
+			}
+		}
+		if err == nil && pd.checkDims != "" {
+			if err = checkDimensions(filepath, want, pd.dimsSlack); err != nil {
+				pd.stats.wrongDimensions.Add(1)
+				if pd.checkDims == dimsWarn {
+					logf("Warning: %s: %v\n", filepath, err)
+					err = nil
+				} else {
+					os.Remove(filepath)
+				}
+			}
+		}
+		if pd.window != nil {
+			pd.window.add(err == nil || err == errNotModified)
+		}
+		if err == nil || err == errNotModified {
+			if err == nil && attempt > 0 {
+				pd.stats.retriedSuccess.Add(1)
+			}
+			got.attempts = attempts
+			return got, err
+		}
+		if errors.Is(err, errStalled) {
+			pd.stats.stalls.Add(1)
+			logf("Download of %s stalled: %v\n", url, err)
+		}
+		if pd.checkDims == dimsFail && errors.Is(err, errWrongDimensions) {
+			break
+		}
+		if !pd.shouldRetry(err, attempt) {
+			break
+		}
+	}
+	return fetched{attempts: attempts}, attemptsError(err, attempts)
+}
+
+// head fetches the headers for url. The returned response's body is closed.
+func (pd *PhotoDownloader) head(url string) (*http.Response, error) {
+	req, err := newRequest(http.MethodHead, url)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
 	}
+	client, done := pd.pickClient(req)
+	req, deadline, stop := pd.bounded(req)
+	defer stop()
+	resp, err := client.Do(req)
+	done(requestOK(resp, err))
+	if err != nil {
+		return nil, fmt.Errorf("error requesting headers: %w", deadline.explain(err))
+	}
+	resp.Body.Close()
+	return resp, nil
+}
 
-	out, err := os.Create(filepath)
+// remoteSize asks the server for the size of url without downloading it
+func (pd *PhotoDownloader) remoteSize(url string) (int64, error) {
+	resp, err := pd.head(url)
 	if err != nil {
-		return fmt.Errorf("error creating file: %v", err)
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("received non-200 status code: %d", resp.StatusCode)
+	}
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("server did not report a content length")
+	}
+	return resp.ContentLength, nil
+}
+
+// recordFailure remembers a failed download for the end-of-run summary
+func (pd *PhotoDownloader) recordFailure(filename string, err error) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	pd.failures = append(pd.failures, failure{filename: filename, err: err})
+}
+
+// download is a single file to fetch for a photo
+type download struct {
+	photo    Photo
+	key      string // manifest key: the size name, or edit-vN for edit history
+	url      string
+	filename string // relative to outputDir
+	optional bool   // failures are logged as skips rather than counted
+	fallback bool   // a thumbnail standing in for an original that is not available
+}
+
+// plan resolves the files to fetch for photo, along with messages about
+// requested sizes it cannot provide
+func (pd *PhotoDownloader) plan(photo Photo, sizes []string) ([]download, []string) {
+	var downloads []download
+	var problems []string
+
+	subdir := ""
+	if pd.statusDirs {
+		subdir = statusDir(photo)
+	}
+	if pd.regionDirs {
+		subdir = filepath.Join(subdir, photoRegion(photo))
+	}
+	if pd.tokenDir {
+		subdir = filepath.Join(subdir, photo.SourceToken)
+	}
+	if pd.groupByDate {
+		subdir = filepath.Join(subdir, dateDir(photo))
+	} else if pd.dateTree {
+		subdir = filepath.Join(subdir, dateTree(photo))
+	}
+
+	if photo.DirectURL != "" {
+		name := pd.sanitizePath(filepath.Join(subdir, photo.PhotoCode))
+		d := download{photo: photo, key: "url", url: photo.DirectURL, filename: name}
+		var ok bool
+		if d.filename, ok = pd.names.claim(d); !ok {
+			return nil, []string{fmt.Sprintf("Skipping %s, another URL is already saved as %s", photo.DirectURL, name)}
+		}
+		pd.sharedURLs.plan(d)
+		return []download{d}, nil
+	}
+
+	var keep func(ThumbnailSize) bool
+	if pd.preferAspect {
+		keep = fullFrame(photo)
+	}
+	if pd.width > 0 {
+		name, ok := pickByWidth(photo.Thumbnail, pd.width, keep)
+		if !ok {
+			pd.skips.add(photo, "", skipUnavailable, "no thumbnails")
+			return nil, []string{fmt.Sprintf("No thumbnails found for photo %s", photo.PhotoCode)}
+		}
+		sizes = []string{name}
+	} else if pd.allSizes {
+		sizes = availableSizes(photo, pd.withOriginal)
 	}
-	defer out.Close()
 
-	_, err = io.Copy(out, resp.Body)
-	return err
+	ext := extensionFor(photo.MimeType)
+	planned := make(map[string]bool)
+	for _, size := range sizes {
+		fallback := false
+		if size == originalSize && pd.fallbackToThumbnail && !originalAvailable(photo) {
+			if thumb, ok := largestThumbnail(photo); ok {
+				problems = append(problems, fmt.Sprintf("Original of %s is not available, saving the %s thumbnail instead", photo.PhotoCode, thumb))
+				size, fallback = thumb, true
+			}
+		}
+		if size == originalSize && !pd.tryUnpurchased && photo.OriginalInfo.URL != "" && !originalAvailable(photo) {
+			dims := ""
+			if w, h := photo.OriginalInfo.Width, photo.OriginalInfo.Height; w > 0 && h > 0 {
+				dims = fmt.Sprintf("%dx%d", w, h)
+			}
+			pd.skips.add(photo, size, skipNotPurchased, dims)
+			if dims != "" {
+				dims = " (" + dims + ")"
+			}
+			problems = append(problems, fmt.Sprintf("Skipping original of %s%s, it is neither paid for nor downloadable", photo.PhotoCode, dims))
+			continue
+		}
+		if v, ok := lookupVariant(size); ok && keep != nil {
+			if ts := v.get(photo.Thumbnail); ts.URL != "" && !keep(ts) {
+				alt, ok := pickByWidth(photo.Thumbnail, ts.Width, keep)
+				if !ok {
+					pd.skips.add(photo, size, skipUnavailable, "cropped, with no full-frame thumbnail")
+					problems = append(problems, fmt.Sprintf("Skipping %s of %s, it is cropped and no full-frame thumbnail exists", size, photo.PhotoCode))
+					continue
+				}
+				problems = append(problems, fmt.Sprintf("Saving %s of %s instead of the cropped %s", alt, photo.PhotoCode, size))
+				size = alt
+			}
+		}
+		if planned[size] {
+			continue
+		}
+		planned[size] = true
+
+		fullURL, sizeStr, ok := sizeURL(photo, size)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("Unsupported size: %s", size))
+			continue
+		}
+
+		if fullURL == "" {
+			pd.skips.add(photo, size, skipUnavailable, "no URL for this size")
+			problems = append(problems, fmt.Sprintf("No URL found for size %s in photo %s", size, photo.PhotoCode))
+			continue
+		}
+
+		filename := filepath.Join(subdir, fmt.Sprintf("%s_%s%s", fileCode(photo), sizeStr, ext))
+		if pd.sizeDirs {
+			filename = filepath.Join(subdir, size, fileCode(photo)+ext)
+		}
+		if pd.nameTemplate != nil {
+			name, err := renderName(pd.nameTemplate, photo, size, sizeStr)
+			switch {
+			case err == nil:
+				filename = filepath.Join(filepath.Dir(filename), name+ext)
+			case pd.onTemplateError == templateFallback:
+				problems = append(problems, fmt.Sprintf("Saving %s %s as %s: %v", photo.PhotoCode, size, filename, err))
+			default:
+				if pd.onTemplateError == templateAbort {
+					pd.mu.Lock()
+					if pd.templateFailure == "" {
+						pd.templateFailure = fmt.Sprintf("%s %s: %v", photo.PhotoCode, size, err)
+					}
+					pd.mu.Unlock()
+				}
+				pd.skips.add(photo, size, skipNameError, err.Error())
+				problems = append(problems, fmt.Sprintf("Skipping %s %s: %v", photo.PhotoCode, size, err))
+				continue
+			}
+		}
+		downloads = append(downloads, download{photo: photo, key: size, url: fullURL, filename: filename, fallback: fallback})
+	}
+
+	if pd.followEdits {
+		downloads = append(downloads, editDownloads(photo, subdir, ext)...)
+	}
+	var claimed []download
+	for _, d := range downloads {
+		d.filename = pd.sanitizePath(d.filename)
+		if !filepath.IsLocal(d.filename) {
+			// sanitizePath should never allow this; refuse rather than write elsewhere
+			pd.skips.add(photo, d.key, skipNameError, "the name leaves the output folder")
+			problems = append(problems, fmt.Sprintf("Skipping %s %s, %s is outside the output folder", photo.PhotoCode, d.key, d.filename))
+			continue
+		}
+		name, ok := pd.names.claim(d)
+		if !ok {
+			pd.skips.add(photo, d.key, skipDuplicate, "another photo is saved as "+d.filename)
+			problems = append(problems, fmt.Sprintf("Skipping %s %s, another photo is already saved as %s", photo.PhotoCode, d.key, d.filename))
+			continue
+		}
+		d.filename = name
+		pd.sharedURLs.plan(d)
+		claimed = append(claimed, d)
+	}
+	return claimed, problems
+}
+
+// editDownloads lists every entry in the photo's edit history, saved into an
+// edits/ subfolder. Unreachable entries are skipped rather than counted as failures.
+func editDownloads(photo Photo, subdir, ext string) []download {
+	var downloads []download
+	for i, entry := range photo.OriginalInfo.EditHistorys {
+		if entry == "" {
+			continue
+		}
+		version := fmt.Sprintf("v%d", i+1)
+		downloads = append(downloads, download{
+			photo:    photo,
+			key:      "edit-" + version,
+			url:      assetURL(photo, entry),
+			filename: filepath.Join(subdir, "edits", fmt.Sprintf("%s_%s%s", fileCode(photo), version, ext)),
+			optional: true,
+		})
+	}
+	return downloads
 }
 
 func (pd *PhotoDownloader) processPhoto(photo Photo, sizes []string) {
+	if pd.filtered(photo) {
+		return
+	}
+	downloads, problems := pd.plan(photo, sizes)
+	for _, p := range problems {
+		logf("%s\n", p)
+	}
+	if pd.retrySizes != nil {
+		downloads = pd.onlyFailedSizes(photo, downloads)
+	}
+	pd.processDownloads(photo, downloads)
+}
+
+// filtered reports whether pd.Filter rejects photo, counting it if so
+func (pd *PhotoDownloader) filtered(photo Photo) bool {
+	if pd.Filter == nil || pd.Filter(photo) {
+		return false
+	}
+	pd.stats.filtered.Add(1)
+	pd.skips.add(photo, "", skipFiltered, "rejected by the filter")
+	return true
+}
+
+// processDownloads fetches the planned downloads of one photo in the background
+func (pd *PhotoDownloader) processDownloads(photo Photo, downloads []download) {
 	pd.wg.Add(1)
 	go func() {
 		defer pd.wg.Done()
 
-		for _, size := range sizes {
-			var thumbnailURL string
-			var sizeStr string
-
-			switch size {
-			case "x1024":
-				thumbnailURL = photo.Thumbnail.X1024.URL
-				sizeStr = "1024x"
-			case "x128":
-				thumbnailURL = photo.Thumbnail.X128.URL
-				sizeStr = "128x"
-			default:
-				fmt.Printf("Unsupported size: %s\n", size)
+		for _, d := range downloads {
+			pd.waitWhilePaused()
+			pd.breaker.wait()
+			if !pd.stopAfter.IsZero() && time.Now().After(pd.stopAfter) {
+				pd.stats.timeLimited.Add(1)
+				pd.skips.add(d.photo, d.key, skipTimeLimit, "")
 				continue
 			}
-
-			if thumbnailURL == "" {
-				fmt.Printf("No URL found for size %s in photo %s\n", size, photo.PhotoCode)
+			if pd.sem != nil {
+				pd.sem <- struct{}{}
+			}
+			if runCtx.Err() != nil {
+				if pd.sem != nil {
+					<-pd.sem
+				}
+				pd.stats.canceled.Add(1)
+				pd.skips.add(d.photo, d.key, skipCanceled, "")
 				continue
 			}
+			if pd.authFailed.Load() {
+				if pd.sem != nil {
+					<-pd.sem
+				}
+				pd.stats.authAborted.Add(1)
+				pd.skips.add(d.photo, d.key, skipAuth, "")
+				continue
+			}
+			if pd.maxTotalBytes > 0 && pd.stats.bytes.Load()+estimateSize(d) > pd.maxTotalBytes {
+				if pd.sem != nil {
+					<-pd.sem
+				}
+				pd.stats.byteCapped.Add(1)
+				pd.skips.add(d.photo, d.key, skipByteLimit, "")
+				continue
+			}
+			post, err := pd.saveFile(d)
+			if fb, ok := pd.paywalled(d, err); ok {
+				logf("Original of %s was refused, saving the %s thumbnail instead\n", photo.PhotoCode, fb.key)
+				d = fb
+				post, err = pd.saveFile(fb)
+			}
+			// Without a conversion pool, post-processing keeps the download
+			// slot so it stays bounded; with one, the slot goes to the next
+			// download while the pool has the file
+			if post != nil && pd.conversions == nil {
+				err = post()
+			}
+			if pd.sem != nil {
+				<-pd.sem
+			}
+			if post != nil && pd.conversions != nil {
+				err = pd.conversions.run(post)
+			}
+			if err == nil && d.fallback {
+				pd.stats.substituted.Add(1)
+			}
+			if pd.queue != nil && (err == nil || d.optional) {
+				pd.queue.complete(d)
+			}
+			interrupted := err != nil && runCtx.Err() != nil && errors.Is(err, context.Canceled)
+			if err == nil || !d.optional && !interrupted {
+				pd.notifyDownload(d, err)
+			}
+			switch {
+			case err == nil:
+			case interrupted:
+				pd.stats.canceled.Add(1)
+				pd.skips.add(d.photo, d.key, skipCanceled, "stopped part way")
+			case d.optional:
+				logf("Skipping %s: %v\n", d.filename, err)
+			default:
+				pd.stats.failed.Add(1)
+				pd.recordDownloadFailure(d, err)
+				logf("Error downloading %s: %v\n", d.filename, err)
+				if pd.abortOnAuthError && exitCodeFor(err) == exitAuth && !pd.authFailed.Swap(true) {
+					fmt.Printf("Error: authentication failed, check your token: %s was refused (%v)\n", d.filename, err)
+				}
+			}
+		}
 
-			fullURL := baseURL + thumbnailURL
-			filename := fmt.Sprintf("%s_%s.jpg", photo.PhotoCode, sizeStr)
-			filepath := filepath.Join(outputDir, filename)
-
-			fmt.Printf("Downloading %s...\n", filename)
-			err := pd.downloadPhoto(fullURL, filepath)
-			if err != nil {
-				fmt.Printf("Error downloading %s: %v\n", filename, err)
-			} else {
-				fmt.Printf("Successfully downloaded %s\n", filename)
+		if pd.dedupeSizes && pd.archive == nil {
+			var keys []string
+			for _, d := range downloads {
+				if !d.optional {
+					keys = append(keys, d.key)
+				}
 			}
+			pd.removeDuplicateSizes(photo, keys)
 		}
 	}()
 }
 
-func getAPIResponse(apiURL string) (*APIResponse, error) {
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Get(apiURL)
-	if err != nil {
-		return nil, fmt.Errorf("error making request: %v", err)
+// paywalled returns the thumbnail download to try instead of d when d is an
+// original the server refused and -fallback-to-thumbnail is set
+func (pd *PhotoDownloader) paywalled(d download, err error) (download, bool) {
+	var se *statusError
+	if !pd.fallbackToThumbnail || d.key != originalSize || !errors.As(err, &se) || se.code != http.StatusForbidden {
+		return download{}, false
 	}
-	defer resp.Body.Close()
+	thumb, ok := largestThumbnail(d.photo)
+	if !ok {
+		return download{}, false
+	}
+	downloads, _ := pd.plan(d.photo, []string{thumb})
+	for _, fb := range downloads {
+		if fb.key == thumb {
+			fb.fallback = true
+			return fb, true
+		}
+	}
+	return download{}, false
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("error reading response body: %v", err)
+// resolveURL returns the URL photo currently lists for a manifest key
+func (pd *PhotoDownloader) resolveURL(photo Photo, key string) string {
+	if url, _, ok := sizeURL(photo, key); ok {
+		return url
+	}
+	for _, d := range editDownloads(photo, "", "") {
+		if d.key == key {
+			return d.url
+		}
+	}
+	return ""
+}
+
+// saveFile fetches d. Files that are already current are skipped. For a
+// file it saved, it returns the post-processing that still has to run on it
+// and record it in the manifest.
+func (pd *PhotoDownloader) saveFile(d download) (func() error, error) {
+	if pd.archive != nil {
+		return nil, pd.archiveFile(d)
+	}
+	photo, filename := d.photo, d.filename
+	if pd.resume && pd.manifest.hasFile(photo, d.key) {
+		pd.stats.skipped.Add(1)
+		pd.skips.add(photo, d.key, skipExists, "already in manifest")
+		logf("Skipping %s %s, already in manifest\n", photo.PhotoCode, d.key)
+		return nil, nil
+	}
+	// A file renamed to its sniffed type is found under the name the
+	// manifest recorded, so it is skipped or revalidated rather than fetched again
+	if stored := pd.manifest.fileFor(photo, d.key); stored != "" && stored != filename && entryStem(stored) == entryStem(filename) {
+		filename = stored
+	}
+
+	target := filepath.Join(outputDir, filename)
+	var cond validators
+	// An empty file is what a crashed run may leave, so it counts as missing
+	if info, err := os.Stat(target); err == nil && info.Size() > 0 && !pd.overwrite {
+		if pd.skipExisting {
+			pd.stats.skipped.Add(1)
+			pd.skips.add(photo, d.key, skipExists, "file exists")
+			logf("Skipping %s, already exists\n", filename)
+			pd.manifest.record(photo, d.key, filename, fetched{etag: pd.manifest.etagFor(photo, d.key)})
+			return nil, nil
+		}
+		if pd.overwriteIfLarger {
+			remote, err := pd.remoteSize(d.url)
+			if err != nil {
+				pd.stats.skipped.Add(1)
+				pd.skips.add(photo, d.key, skipExists, "could not compare sizes: "+err.Error())
+				logf("Skipping %s, could not compare sizes: %v\n", filename, err)
+				return nil, nil
+			}
+			if remote <= info.Size() {
+				pd.stats.skipped.Add(1)
+				pd.skips.add(photo, d.key, skipExists, "local copy is not smaller than remote")
+				logf("Skipping %s, local copy is not smaller than remote\n", filename)
+				return nil, nil
+			}
+			logf("Replacing %s (%d bytes) with larger remote copy (%d bytes)\n", filename, info.Size(), remote)
+		} else {
+			cond = validators{since: info.ModTime(), etag: pd.manifest.etagFor(photo, d.key)}
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return nil, fmt.Errorf("error creating directory: %v", err)
+	}
+
+	if pd.precheck {
+		if err := pd.checkURL(d.url); err == errNotFound {
+			pd.stats.notFound.Add(1)
+			pd.skips.add(photo, d.key, skipNotFound, "")
+			logf("Skipping %s, not found on server\n", filename)
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
 	}
 
-	var result APIResponse
-	err = json.Unmarshal(body, &result)
+	logf("Downloading %s...\n", filename)
+	pd.stats.inFlight.Add(1)
+	defer pd.stats.inFlight.Add(-1)
+
+	var fallback time.Time
+	if pd.preserveTimestamps {
+		fallback = photo.ShootOn.Time()
+	}
+	want := expectedDimensions(photo, d.key)
+	fetchStart := time.Now()
+	got, err := pd.fetchShared(d.url, target, cond, fallback, want)
+	var se *statusError
+	if errors.As(err, &se) && se.expired && pd.refresher != nil {
+		if fresh, rerr := pd.refresher.refresh(photo); rerr != nil {
+			logf("Could not refresh expired URL for %s: %v\n", filename, rerr)
+		} else if url := pd.resolveURL(fresh, d.key); url != "" && url != d.url {
+			logf("URL for %s expired, retrying with a fresh one\n", filename)
+			expired := got.attempts
+			got, err = pd.fetchWithRetry(url, target, cond, fallback, want)
+			got.attempts += expired
+		}
+	}
+	phases.add(&phases.download, fetchStart)
+	if err == errNotModified {
+		pd.stats.skipped.Add(1)
+		pd.skips.add(photo, d.key, skipExists, "unchanged on server")
+		logf("Skipping %s, unchanged on server\n", filename)
+		pd.manifest.record(photo, d.key, filename, fetched{etag: cond.etag})
+		if pd.xmpSidecars {
+			if _, err := os.Stat(filepath.Join(outputDir, sidecarName(filename))); os.IsNotExist(err) {
+				pd.sidecar(photo, filename)
+			}
+		}
+		return nil, nil
+	}
 	if err != nil {
-		return nil, fmt.Errorf("error parsing JSON: %v", err)
+		return nil, err
+	}
+
+	detected := got.contentType
+	if detected != photo.MimeType && photo.MimeType != "" {
+		logf("Photo %s declared %s but content is %s\n", photo.PhotoCode, photo.MimeType, detected)
+	}
+	if ext := filepath.Ext(filename); strings.HasPrefix(detected, "image/") && extensionFor(detected) != ext {
+		// Name the file after what was actually served
+		renamed := strings.TrimSuffix(filename, ext) + extensionFor(detected)
+		if err := os.Rename(target, filepath.Join(outputDir, renamed)); err != nil {
+			return nil, fmt.Errorf("error renaming file: %v", err)
+		}
+		filename = renamed
 	}
 
-	return &result, nil
+	return func() error {
+		return pd.postProcess(d, filename, detected, got)
+	}, nil
 }
 
-func main() {
-	// Create output directory
-	err := os.MkdirAll(outputDir, 0755)
-	if err != nil {
-		fmt.Printf("Error creating output directory: %v\n", err)
-		return
+// postProcess runs the CPU-bound steps enabled for a freshly saved file, then
+// counts it and records it in the manifest
+func (pd *PhotoDownloader) postProcess(d download, filename, detected string, got fetched) error {
+	photo := d.photo
+	postStart := time.Now()
+	if pd.autoOrient && detected == "image/jpeg" {
+		if rotated, err := autoOrient(filepath.Join(outputDir, filename)); err != nil {
+			logf("Could not auto-orient %s: %v\n", filename, err)
+		} else if rotated {
+			logf("Rotated %s upright\n", filename)
+		}
+	}
+	if pd.watermark != nil && detected == "image/jpeg" {
+		if err := pd.watermark.apply(filepath.Join(outputDir, filename)); err != nil {
+			logf("Could not watermark %s: %v\n", filename, err)
+		}
+	}
+	if pd.jpegQuality > 0 && detected == "image/jpeg" {
+		if before, after, err := recompress(filepath.Join(outputDir, filename), pd.jpegQuality); err != nil {
+			logf("Could not re-encode %s: %v\n", filename, err)
+		} else {
+			pd.stats.recompressedFrom.Add(before)
+			pd.stats.recompressedTo.Add(after)
+		}
+	}
+	if pd.stripExif && detected == "image/jpeg" {
+		if before, after, err := stripMetadata(filepath.Join(outputDir, filename)); err != nil {
+			logf("Could not strip metadata from %s: %v\n", filename, err)
+		} else if after < before {
+			pd.stats.stripped.Add(1)
+			pd.stats.strippedBytes.Add(before - after)
+		}
+	}
+	if pd.wantsMetadata() && detected == "image/jpeg" {
+		if err := pd.writeMetadata(photo, filepath.Join(outputDir, filename)); err != nil {
+			logf("Could not write metadata to %s: %v\n", filename, err)
+		}
+	}
+	if (pd.autoOrient || pd.watermark != nil || pd.jpegQuality > 0 || pd.stripExif || pd.wantsMetadata()) && detected == "image/jpeg" {
+		phases.add(&phases.post, postStart)
+		phases.posts.Add(1)
+		if info, err := os.Stat(filepath.Join(outputDir, filename)); err == nil {
+			phases.postBytes.Add(info.Size())
+		}
 	}
 
-	apiURL := "https://api.disneyphotopass.com.hk/shoppingapi/p/getPhotosByConditions?tokenId=c8cad990-83d3-11ef-bc1f-4f799151c3b9&currentPageIndex=1&limit=400&sortField=shootOn&order=-1"
+	if len(pd.derivatives) > 0 && (detected == "image/jpeg" || detected == "image/png") {
+		if err := pd.derive(photo, d.key, filename, detected); err != nil {
+			logf("Could not derive from %s: %v\n", filename, err)
+		}
+	}
 
-	response, err := getAPIResponse(apiURL)
-	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		return
+	if pd.xmpSidecars {
+		pd.sidecar(photo, filename)
 	}
 
-	fmt.Printf("Found %d photos to download\n", len(response.Result.Photos))
+	pd.stats.downloaded.Add(1)
+	logf("Successfully downloaded %s\n", filename)
+	sum := pd.manifest.record(photo, d.key, filename, got)
+	if pd.contents != nil && pd.collapseDuplicate(photo, d.key, filename, sum) {
+		return nil
+	}
+	pd.addChecksum(filename, sum)
+	return nil
+}
 
-	downloader := NewPhotoDownloader()
-	sizes := []string{"x1024", "x128"}
+func main() {
+	os.Exit(run())
+}
 
-	for _, photo := range response.Result.Photos {
-		downloader.processPhoto(photo, sizes)
+// run executes the downloader and returns the process exit code
+func run() int {
+	var tokens listFlag
+	var hostRPS listFlag
+	flag.Var(&hostRPS, "host-rps", "limit requests to a host, as host=rps; repeat per host, or use *=rps for every other host")
+	flag.Var(&tokens, "token", "photo pass tokenId, optionally as region:tokenId; repeat or comma-separate to combine several accounts (required unless -cookie-file gives one)")
+	flag.StringVar(&outputDir, "out", outputDir, "folder to save photos and the run's own files, such as manifest.json, in")
+	sizesFlag := flag.String("sizes", "x1024,x128", "comma-separated sizes to download: x128, w512, x512, x1024 or original")
+	flag.IntVar(&pageLimit, "limit", pageLimit, "photos to request per listing page")
+	var regionEntries paramFlag
+	flag.Var(&regionEntries, "region", "add a PhotoPass region for region:tokenId tokens, as name=apiURL,cdnURL; repeat for several")
+	timezone := flag.String("timezone", "", "IANA time zone to date photos in, e.g. Asia/Hong_Kong (default: the parks' zone when all tokens share a region)")
+	statusDirs := flag.Bool("status-dirs", false, "save each photo under paid/, watermarked/, free/ or unpaid/ before any other subfolder")
+	regionDirs := flag.Bool("region-dirs", false, "save each photo under a subfolder named after its region, e.g. hk/")
+	cookieFile := flag.String("cookie-file", "", "read the tokenId from a browser cookie export (cookies.txt or JSON)")
+	cookieName := flag.String("cookie-name", "tokenId", "name of the PhotoPass cookie holding the token in -cookie-file")
+	resumeManifest := flag.Bool("resume-manifest", false, "skip photos whose files are already recorded in manifest.json")
+	favorites := flag.Bool("favorites", false, "only download photos marked as favorites, filtered by the server where supported")
+	mimeTypes := flag.String("mime-types", "image/*", "comma-separated content types to download, e.g. image/jpeg,image/png; image/* allows every image type")
+	bundleOnly := flag.Bool("bundle-only", false, "only download photos included in a PhotoPass+ bundle")
+	createdBy := flag.String("created-by", "", "only download photos whose createdBy matches this value")
+	shotAfter := flag.String("after", "", "only download photos taken on or after this date (YYYY-MM-DD) or RFC 3339 time")
+	shotBefore := flag.String("before", "", "only download photos taken before this RFC 3339 time, or up to the end of this date (YYYY-MM-DD)")
+	nameTemplate := flag.String("name-template", "", "filename template without extension, e.g. {{.CreatedBy}}_{{.PhotoCode}}_{{.Suffix}}")
+	onTemplateError := flag.String("on-template-error", templateSkip, "what to do when -name-template cannot name a photo: skip, fallback to the default name, or abort")
+	idsFile := flag.String("ids-file", "", "only download the photo IDs listed in this file, one per line")
+	excludeIDsFile := flag.String("exclude-ids-file", "", "skip the photo IDs listed in this file, one per line")
+	expectCount := flag.Int("expect-count", -1, "fail unless exactly this many photos remain after filtering")
+	minCount := flag.Int("min-count", 0, "fail if fewer photos than this remain after filtering")
+	maxCount := flag.Int("max-count", -1, "fail if more photos than this remain after filtering")
+	shard := flag.String("shard", "", "only download shard i of n, e.g. 0/4, to split a library across machines")
+	includeDisabled := flag.Bool("include-disabled", false, "also download photos the API marks as disabled")
+	includeExpired := flag.Bool("include-expired", false, "also try photos whose expireDate has passed")
+	freshManifest := flag.Bool("fresh-manifest", false, "rewrite manifest.json from this run only instead of merging into it")
+	manifestJournal := flag.Bool("manifest-journal", false, "append each manifest update to disney_photos/.manifest.jsonl as it happens, so a killed run keeps its record")
+	tokenDirs := flag.Bool("token-dirs", false, "save each token's photos in its own subfolder")
+	fsProfile := flag.String("fs-profile", "fat32", "filename rules to follow: fat32 (safe everywhere, the default) or unix (only / is replaced)")
+	groupByDate := flag.Bool("group-by-date", false, "save each photo in a subfolder named after its shoot date, e.g. 2024-10-01/")
+	dateTreeDirs := flag.Bool("date-tree", false, "save each photo under year/month/day subfolders of its shoot date, e.g. 2024/10/01/")
+	flatSingleDay := flag.Bool("no-subdir-when-single-day", false, "with -group-by-date, skip the date subfolder when every photo shares one date")
+	sizeDirs := flag.Bool("size-dirs", false, "save each size in its own subfolder, e.g. x128/ and x1024/")
+	minInodes := flag.Uint64("min-inodes", 0, "abort before downloading if fewer inodes than this are free on the output filesystem")
+	maxFileSize := flag.Int64("max-file-size", 0, "abort any download larger than this many bytes (0 for no limit)")
+	maxTotalBytes := flag.Int64("max-total-bytes", 0, "stop starting downloads once the run would download more than this many bytes, letting in-flight ones finish (0 for no limit)")
+	overwriteIfLarger := flag.Bool("overwrite-if-larger", false, "re-download existing files only when the remote copy is larger")
+	skipExisting := flag.Bool("skip-existing", false, "keep files that already exist and are not empty without asking the server whether they changed")
+	overwrite := flag.Bool("overwrite", false, "download every file again, replacing existing copies")
+	proxyList := flag.String("proxy-list", "", "file of proxy URLs to rotate downloads across, one per line")
+	retries := flag.Int("retries", 3, "extra attempts for each failed download")
+	adaptiveRetry := flag.Bool("adaptive-retry", false, "retry more while recent downloads mostly succeed and less, with a pause, while they mostly fail")
+	retryWindow := flag.Int("retry-window", 50, "with -adaptive-retry, how many recent attempts the success rate is taken over")
+	width := flag.Int("width", 0, "download the smallest thumbnail at least this many pixels wide instead of fixed sizes")
+	preferAspect := flag.String("prefer-aspect", "", "set to original to replace thumbnails cropped to another aspect ratio with a full-frame one")
+	followEdits := flag.Bool("follow-edits", false, "also download each photo's edit history into an edits/ subfolder")
+	allThumbnails := flag.Bool("all-thumbnails", false, "download every thumbnail variant each photo has")
+	everything := flag.Bool("everything", false, "download every thumbnail variant plus the original")
+	statsInterval := flag.Duration("stats-interval", 0, "print completed, failed, bytes and transfer rate this often while downloading, even with -quiet")
+	verboseTiming := flag.Bool("verbose-timing", false, "report the time and bytes spent listing, downloading and post-processing")
+	tryUnpurchased := flag.Bool("try-unpurchased", false, "attempt originals the API marks as neither paid for nor downloadable instead of skipping them")
+	fallbackToThumbnail := flag.Bool("fallback-to-thumbnail", false, "save the largest thumbnail when the original is not paid for or the server refuses it")
+	maxRuntime := flag.Duration("max-runtime", 0, "stop starting new downloads after this long, letting in-flight ones finish")
+	locationCoords := flag.String("location-coords", "", "file of locationId,lat,lon lines; embeds GPS EXIF into downloaded JPEGs")
+	contactSheet := flag.String("contact-sheet", "", "instead of downloading, write the x128 thumbnails as a captioned grid to this JPEG")
+	sheetColumns := flag.Int("sheet-columns", 6, "thumbnails per row of a -contact-sheet")
+	sheetRows := flag.Int("sheet-rows", 0, "rows per -contact-sheet before starting another file (0 for one sheet)")
+	sheetCell := flag.Int("sheet-cell", 160, "pixel size each -contact-sheet thumbnail is fitted into")
+	pdfOut := flag.String("pdf", "", "instead of saving files, write the first of -sizes of every photo to this PDF, one page each in order of shoot time")
+	s3Target := flag.String("s3", "", "upload downloads to this S3 bucket/prefix instead of saving them to the output folder")
+	tarPath := flag.String("tar", "", "stream downloads into this .tar.gz instead of saving them to the output folder")
+	resumeArchive := flag.Bool("resume-archive", false, "with -tar, finalize each entry on disk as it is written and continue an archive an earlier run left behind")
+	verifyExisting := flag.Bool("verify-existing", false, "check local files against the checksums in manifest.json without contacting the API; exits 1 if any are corrupt or missing")
+	maxRedirects := flag.Int("max-redirects", defaultMaxRedirects, "most redirects to follow for a download (0 to fail on any redirect)")
+	checksumsFile := flag.String("checksums", "", "append a sha256sum line for each downloaded file to this file, for checking with sha256sum -c")
+	webhookURL := flag.String("webhook", "", "POST a JSON event to this URL for each finished download and a summary at the end")
+	failuresFile := flag.String("failures-file", "", "write the photo sizes that failed to this JSON file, for -retry-failed")
+	retryFailed := flag.Bool("retry-failed", false, "only download the photo sizes listed in -failures-file")
+	repair := flag.Bool("repair", false, "with -verify-existing, re-download corrupt and missing files")
+	pipeline := flag.Bool("pipeline", false, "start downloading each page of the listing while later pages are still being fetched")
+	onCollision := flag.String("on-collision", collideSuffix, "what to do when two files would be saved to the same path: suffix, skip, overwrite or error")
+	verifyTokenExpiry := flag.Bool("verify-token-expiry", false, "before starting, check each token: read the expiry of JWT tokens, or try a one-photo listing with opaque ones")
+	skipIfUnchanged := flag.Bool("skip-if-unchanged", false, "exit straight away when the listing matches the one of the last fully successful run with this flag")
+	incrementalCatalog := flag.Bool("incremental-catalog", false, "ask the API only for photos added since the last fully successful run with this flag, using the server time it reported")
+	flag.StringVar(&incrementalParam, "incremental-param", incrementalParam, "query parameter -incremental-catalog sends the saved server time in")
+	sinceID := flag.String("since-id", "", "stop listing at the photo with this ID, taking it and everything older as downloaded by an earlier run")
+	autoSince := flag.Bool("auto-since", false, "stop listing at the newest photo of each token as of the last fully successful run with this flag")
+	newerThanLastRun := flag.Bool("newer-than-last-run", false, "only download photos taken or changed since the last fully successful run with this flag")
+	photoCode := flag.String("photo-code", "", "with -stdout, the PhotoCode of the photo to write")
+	toStdout := flag.Bool("stdout", false, "write the photo chosen by -photo-code to stdout instead of saving files; messages go to stderr")
+	rps := flag.Float64("rps", 0, "most API and download requests to send per second, however many run at once (0 for unlimited)")
+	pageConcurrency := flag.Int("page-concurrency", 0, "most listing pages to request at once across all tokens, independent of -max-concurrency (0 for one per token)")
+	flag.DurationVar(&pageTimeout, "page-timeout", pageTimeout, "time allowed for each listing page request before it is retried (0 for no limit)")
+	flag.IntVar(&maxPages, "max-pages", maxPages, "most listing pages to fetch per token before stopping with a warning (0 for no limit)")
+	watermarkPath := flag.String("watermark", "", "PNG to composite onto each downloaded JPEG")
+	watermarkPos := flag.String("watermark-pos", "bottom-right", "where -watermark goes: top-left, top-right, bottom-left, bottom-right or center")
+	watermarkOpacity := flag.Float64("watermark-opacity", 0.5, "opacity of -watermark, above 0 and at most 1")
+	flag.BoolVar(&abortOnAuthError, "abort-on-auth-error", false, "stop the whole run at the first 401/403 from the API for any token or from a download")
+	derive := flag.String("derive", "", "also write these versions of each downloaded image, e.g. original,jpeg@512,png")
+	stripExif := flag.Bool("strip-exif", false, "remove EXIF, XMP and comments from downloaded JPEGs before sharing them, without re-encoding")
+	jpegQuality := flag.Int("jpeg-quality", 0, "re-encode downloaded JPEGs at this quality (1-100) when that makes them smaller")
+	timeoutBase := flag.Duration("timeout-base", 30*time.Second, "time allowed for each download; with -timeout-per-mb, the time before its size is known")
+	timeoutPerMB := flag.Duration("timeout-per-mb", 0, "give each download -timeout-base plus this much per megabyte it turns out to be, e.g. 5s")
+	maxIdle := flag.Duration("max-idle", 0, "abort and retry a download when no bytes arrive for this long, e.g. 20s (0 to rely on the overall timeout)")
+	minBytes := flag.Int64("min-bytes", 1, "fail and retry downloads shorter than this many bytes, catching empty 200 responses")
+	geoJSON := flag.String("geojson", "", "with -location-coords, write the downloaded photos' locations to this GeoJSON file")
+	trace := flag.Bool("trace", false, "log each request's headers and DNS, connect, TLS and first-byte timings to stderr (credentials redacted)")
+	sample := flag.Int("sample", 0, "download only this many photos, picked at random from those left after filtering")
+	samplePercent := flag.Float64("sample-percent", 0, "download only this percentage of the filtered photos, picked at random")
+	promptLarge := flag.Bool("prompt-before-large-download", false, "ask for confirmation before a run larger than -large-download-files or -large-download-bytes")
+	largeFiles := flag.Int("large-download-files", 1000, "with -prompt-before-large-download, files above which to ask (0 to not count files)")
+	largeBytes := flag.Int64("large-download-bytes", 10<<30, "with -prompt-before-large-download, estimated bytes above which to ask (0 to not count bytes)")
+	assumeYes := flag.Bool("yes", false, "skip the -prompt-before-large-download confirmation, for scripts")
+	downloadOrder := flag.String("download-order", orderAPI, "order to download photos in: api, or balanced to interleave photos across locations")
+	seed := flag.Int64("seed", 0, "random seed for -sample and -sample-percent, to repeat a sample (default: a new one each run)")
+	diffOnly := flag.Bool("diff", false, "list present, missing and orphaned local files without downloading; exits 1 if anything is missing")
+	dryRun := flag.Bool("dry-run", false, "list the files a run would download with estimated sizes, without downloading; with -diff, only those not on disk")
+	dedupe := flag.Bool("dedupe", false, "delete downloads byte-identical to a file already kept, this run or an earlier one, whatever photo it belongs to")
+	dedupeLink := flag.Bool("dedupe-link", false, "with -dedupe or -dedupe-sizes, replace duplicates with symlinks to the kept file instead of deleting them; on its own it implies -dedupe-sizes")
+	dedupeHardlink := flag.Bool("dedupe-hardlink", false, "with -dedupe or -dedupe-sizes, replace duplicates with hard links to the kept file instead of deleting them; on its own it implies -dedupe-sizes")
+	dedupeSizes := flag.Bool("dedupe-sizes", false, "delete sizes of a photo that are byte-identical to a larger size")
+	maxConcurrency := flag.Int("max-concurrency", 0, "most downloads to run at once; 0 or less for the default of 4 per CPU up to 32 (16 with -auto-concurrency)")
+	flag.IntVar(maxConcurrency, "concurrency", 0, "same as -max-concurrency")
+	copyBufferSize := flag.Int("copy-buffer-size", defaultCopyBuffer, "bytes of the buffer each download is copied through; larger can be faster on fast, high-latency links")
+	parallelConversion := flag.Bool("parallel-conversion", false, "post-process downloaded files on a separate pool of workers so CPU work does not hold download slots")
+	conversionWorkers := flag.Int("conversion-workers", 0, "with -parallel-conversion, how many files to post-process at once (default: one per CPU)")
+	writeConcurrency := flag.Int("write-concurrency", 0, "most files to write to disk at once, independent of -max-concurrency (0 for no limit)")
+	minConcurrency := flag.Int("min-concurrency", 1, "fewest downloads -auto-concurrency will run at once")
+	warmup := flag.Duration("warmup", 0, "ramp concurrency from 1 up to -max-concurrency over this long at the start of a run")
+	throttleOn429 := flag.Bool("throttle-on-429", false, "when the server answers a burst of downloads with 429, pause them all for a cooldown and resume at half concurrency")
+	throttleBurst := flag.Int("throttle-burst", 5, "with -throttle-on-429, how many 429s within 10s count as a burst")
+	throttleCooldown := flag.Duration("throttle-cooldown", 30*time.Second, "with -throttle-on-429, how long downloads pause after a burst")
+	autoConcurrency := flag.Bool("auto-concurrency", false, "adjust concurrency to measured throughput and error rate")
+	preserveTimestamps := flag.Bool("preserve-response-timestamps", false, "date files by the photo's shoot time when the server sends no Last-Modified")
+	animate := flag.Bool("animate", false, "combine frames sharing a parentId into an animated GIF instead of separate files")
+	exifDates := flag.Bool("exif-date", false, "embed the shoot time as the EXIF capture date of downloaded JPEGs that have none (with -overwrite, replace it)")
+	xmpSidecars := flag.Bool("xmp", false, "write an XMP sidecar with shoot date, location and photographer next to each image")
+	autoOrient := flag.Bool("auto-orient", false, "rotate JPEGs upright according to their EXIF orientation and drop the tag")
+	precheck := flag.Bool("precheck", false, "check each URL with a HEAD request first, skipping ones that no longer exist")
+	validate := flag.Bool("validate", false, "check each downloaded file decodes as an image, discarding it otherwise")
+	checkDims := flag.String("check-dimensions", "", "compare each downloaded image's width and height with the API's and warn, retry or fail on a mismatch (default off)")
+	dimsSlack := flag.Float64("dimension-tolerance", 0.02, "with -check-dimensions, the fraction either side may be off by")
+	recordDir := flag.String("record", "", "save API responses and a sample of images to this directory for later -replay")
+	replayDir := flag.String("replay", "", "serve requests from a -record directory instead of the network")
+	queueFile := flag.String("queue", "", "persist pending downloads to this file and resume from it after a crash without refetching the listing")
+	validateSchema := flag.Bool("validate-schema", false, "warn about fields of API responses that are new, missing or of an unexpected type")
+	listSizesOnly := flag.Bool("list-sizes", false, "print which sizes each photo has and their dimensions instead of downloading")
+	exportURLs := flag.String("export-urls", "", "write the resolved URLs and output names of the chosen sizes to this file in aria2 input format instead of downloading")
+	urlsFile := flag.String("urls-file", "", "download the URLs listed in this file (optionally followed by a name) instead of querying the API")
+	resumeCatalog := flag.Bool("resume-catalog", false, "save catalog listing progress page by page and continue an interrupted listing from the last page fetched instead of page 1")
+	metadataCache := flag.String("metadata-cache", "", "cache the photo listing in this file and reuse it while fresh")
+	cacheTTL := flag.Duration("cache-ttl", time.Hour, "how long a -metadata-cache listing stays fresh")
+	refresh := flag.Bool("refresh", false, "ignore a fresh -metadata-cache and refetch the listing")
+	disableHTTP2 := flag.Bool("disable-http2", false, "download over HTTP/1.1 only, for servers that misbehave over HTTP/2")
+	logFile := flag.String("logfile", "", "append all output to this file instead of printing it")
+	logMaxSize := flag.Int64("log-max-size", 0, "with -logfile, megabytes after which the log is gzipped and a new one started (0 for no rotation)")
+	logMaxFiles := flag.Int("log-max-files", 5, "with -log-max-size, how many rotated logs to keep")
+	headersFile := flag.String("headers-file", "", "file of Name: value lines, one per header, added to every API and download request")
+	flag.StringVar(&userAgent, "user-agent", defaultUserAgent, "User-Agent header sent to the API and CDN")
+	flag.StringVar(&authMode, "auth-mode", authQuery, "how the token is sent to the API: query (tokenId parameter), header or bearer")
+	flag.StringVar(&authHeaderName, "auth-header-name", authHeaderName, "header that carries the token with -auth-mode header")
+	summaryJSON := flag.String("summary-json", "", "write the run's results as JSON to this file, or - for stdout")
+	metricsAddr := flag.String("metrics-addr", "", "serve Prometheus-style metrics on this address, e.g. :9090")
+	var params paramFlag
+	flag.Var(&params, "param", "extra key=value query parameter for the photo listing; repeat for several")
+	flag.BoolVar(&verbose, "verbose", false, "print diagnostic detail such as the API URLs requested")
+	flag.BoolVar(&quiet, "quiet", false, "print nothing unless something fails, then only a failure summary (for cron)")
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitConfig
 	}
 
-	// Wait for all downloads to complete
-	downloader.wg.Wait()
-	fmt.Println("All downloads completed!")
-}
\ No newline at end of file
+	exitOnSignal()
+	extraParams = params.values
+	imageOut := os.Stdout
+	if *toStdout {
+		if *photoCode == "" {
+			fmt.Printf("Error: -stdout needs -photo-code\n")
+			return exitConfig
+		}
+		// Keep every message off the image stream
+		os.Stdout = os.Stderr
+	}
+	if *logMaxSize < 0 || *logMaxFiles < 0 {
+		fmt.Printf("Error: -log-max-size and -log-max-files cannot be negative\n")
+		return exitConfig
+	}
+	if *logFile != "" {
+		log, err := openRotatingLog(*logFile, *logMaxSize<<20, *logMaxFiles)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+		flush, err := redirectStdout(log)
+		if err != nil {
+			log.Close()
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+		closeLog := func() {
+			flush()
+			log.Close()
+		}
+		defer closeLog()
+		closeLogFile = closeLog
+	}
+	if authMode != authQuery && authMode != authHeader && authMode != authBearer {
+		fmt.Printf("Error: unknown -auth-mode %q, expected query, header or bearer\n", authMode)
+		return exitConfig
+	}
+	if authMode == authHeader && authHeaderName == "" {
+		fmt.Printf("Error: -auth-mode header needs -auth-header-name\n")
+		return exitConfig
+	}
+	if *headersFile != "" {
+		h, err := readHeadersFile(*headersFile)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+		extraHeaders = h
+	}
+	started := time.Now()
+
+	var fixtures http.RoundTripper
+
+	// Check the template before listing, which can take a while
+	var tmpl *template.Template
+	if *nameTemplate != "" {
+		var err error
+		if tmpl, err = parseNameTemplate(*nameTemplate); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+	}
+	if !slices.Contains(templatePolicies, *onTemplateError) {
+		fmt.Printf("Error: unknown -on-template-error %q, expected skip, fallback or abort\n", *onTemplateError)
+		return exitConfig
+	}
+
+	if *sample < 0 || *samplePercent < 0 || *samplePercent > 100 {
+		fmt.Printf("Error: -sample must be positive and -sample-percent between 0 and 100\n")
+		return exitConfig
+	}
+
+	if *downloadOrder != orderAPI && *downloadOrder != orderBalanced {
+		fmt.Printf("Error: unknown -download-order %q, expected api or balanced\n", *downloadOrder)
+		return exitConfig
+	}
+
+	if *pipeline {
+		// These need the whole listing before the first download
+		incompatible := []struct {
+			name string
+			set  bool
+		}{
+			{"-urls-file", *urlsFile != ""}, {"-queue", *queueFile != ""}, {"-metadata-cache", *metadataCache != ""},
+			{"-diff", *diffOnly}, {"-contact-sheet", *contactSheet != ""}, {"-pdf", *pdfOut != ""}, {"-animate", *animate},
+			{"-expect-count", *expectCount >= 0}, {"-min-count", *minCount > 0}, {"-max-count", *maxCount >= 0},
+			{"-no-subdir-when-single-day", *flatSingleDay}, {"-stdout", *toStdout}, {"-geojson", *geoJSON != ""},
+			{"-sample", *sample > 0}, {"-sample-percent", *samplePercent > 0}, {"-dry-run", *dryRun}, {"-list-sizes", *listSizesOnly},
+			{"-download-order balanced", *downloadOrder == orderBalanced},
+			{"-prompt-before-large-download", *promptLarge && !*assumeYes},
+			{"-export-urls", *exportURLs != ""}, {"-skip-if-unchanged", *skipIfUnchanged},
+			{"photo codes", flag.NArg() > 0},
+		}
+		for _, f := range incompatible {
+			if f.set {
+				fmt.Printf("Error: -pipeline cannot be combined with %s\n", f.name)
+				return exitConfig
+			}
+		}
+	}
+
+	if *incrementalCatalog && (*metadataCache != "" || *diffOnly) {
+		fmt.Printf("Error: -incremental-catalog lists only new photos, so it cannot be combined with -metadata-cache or -diff\n")
+		return exitConfig
+	}
+
+	if (*sinceID != "" || *autoSince) && (*metadataCache != "" || *diffOnly) {
+		fmt.Printf("Error: -since-id and -auto-since list only new photos, so they cannot be combined with -metadata-cache or -diff\n")
+		return exitConfig
+	}
+	if *sinceID != "" && *autoSince {
+		fmt.Printf("Error: -since-id and -auto-since cannot be combined\n")
+		return exitConfig
+	}
+
+	if *recordDir != "" || *replayDir != "" {
+		transport, err := fixtureTransport(http.DefaultTransport, *recordDir, *replayDir)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+		apiClient.Transport = transport
+		fixtures = transport
+	}
+	if *trace {
+		apiClient.Transport = traced(apiClient.Transport)
+	}
+
+	if *cookieFile != "" {
+		token, err := tokenFromCookies(*cookieFile, *cookieName)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+		tokens = append(tokens, token)
+	}
+	if len(tokens) == 0 && !*verifyExisting && *urlsFile == "" {
+		fmt.Printf("Error: no token given; pass -token=<tokenId>, copied from the tokenId cookie of the PhotoPass site, or export your cookies and pass -cookie-file\n")
+		return exitConfig
+	}
+	sizes, err := parseSizes(*sizesFlag)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return exitConfig
+	}
+	if pageLimit < 1 {
+		fmt.Printf("Error: -limit must be positive\n")
+		return exitConfig
+	}
+	if *pageConcurrency < 0 {
+		fmt.Printf("Error: -page-concurrency cannot be negative\n")
+		return exitConfig
+	}
+	if *pageConcurrency > 0 {
+		pageSem = make(chan struct{}, *pageConcurrency)
+	}
+	if *rps < 0 {
+		fmt.Printf("Error: -rps cannot be negative\n")
+		return exitConfig
+	}
+	if *rps > 0 {
+		requestLimit = newRateLimiter(*rps)
+	}
+	if *validateSchema {
+		responseSchema = &schemaCheck{warned: make(map[string]bool)}
+	}
+	if err := addRegions(regionEntries.values); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return exitConfig
+	}
+	if err := checkTokenRegions(tokens); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return exitConfig
+	}
+	if *timezone == "" {
+		*timezone = tokensZone(tokens)
+	}
+	if *timezone != "" {
+		zone, err := time.LoadLocation(*timezone)
+		if err != nil {
+			fmt.Printf("Error: invalid -timezone: %v\n", err)
+			return exitConfig
+		}
+		shootZone = zone
+	}
+
+	// Create output directory
+	err = os.MkdirAll(outputDir, 0755)
+	if err != nil {
+		fmt.Printf("Error creating output directory: %v\n", err)
+		return exitConfig
+	}
+
+	var repairIDs map[string]bool
+	if *verifyExisting {
+		m, err := loadManifest(outputDir)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+		report, err := m.verify()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitPartial
+		}
+		report.print()
+		if len(report.damaged) == 0 {
+			return exitOK
+		}
+		if !*repair {
+			return exitPartial
+		}
+		if err := report.removeCorrupt(outputDir); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitPartial
+		}
+		repairIDs = report.damaged
+	}
+
+	var retrySizes map[string]map[string]bool
+	if *retryFailed {
+		if *failuresFile == "" {
+			fmt.Printf("Error: -retry-failed needs -failures-file\n")
+			return exitConfig
+		}
+		if retrySizes, err = loadFailures(*failuresFile); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+	}
+
+	allowedTypes, err := parseMimeTypes(*mimeTypes)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return exitConfig
+	}
+
+	var includeIDs, excludeIDs map[string]bool
+	if *idsFile != "" {
+		includeIDs, err = readIDs(*idsFile)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+	}
+	if *excludeIDsFile != "" {
+		excludeIDs, err = readIDs(*excludeIDsFile)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+	}
+	// Photo codes may follow the flags, to grab a few shots by hand
+	var wantCodes map[string]bool
+	if flag.NArg() > 0 {
+		wantCodes = make(map[string]bool, flag.NArg())
+		for _, code := range flag.Args() {
+			wantCodes[code] = true
+		}
+	}
+	var after, before time.Time
+	if *shotAfter != "" {
+		if after, err = parseShootBound(*shotAfter, false); err != nil {
+			fmt.Printf("Error: -after: %v\n", err)
+			return exitConfig
+		}
+	}
+	if *shotBefore != "" {
+		if before, err = parseShootBound(*shotBefore, true); err != nil {
+			fmt.Printf("Error: -before: %v\n", err)
+			return exitConfig
+		}
+	}
+	if !after.IsZero() && !before.IsZero() && !after.Before(before) {
+		fmt.Printf("Error: -after must come before -before\n")
+		return exitConfig
+	}
+
+	var shardI, shardN int
+	if *shard != "" {
+		shardI, shardN, err = parseShard(*shard)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+	}
+
+	lastRunPath := filepath.Join(outputDir, lastRunName)
+	var lastRun time.Time
+	if *newerThanLastRun {
+		var ok bool
+		lastRun, ok, err = readLastRun(lastRunPath)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+		if !ok {
+			logf("No previous run recorded, downloading everything\n")
+		}
+	}
+
+	// selectPhotos applies the filter flags to a listing, or to each page of
+	// it with -pipeline
+	var disabled, expired, wrongType int
+	skips := &skipLog{}
+	selectPhotos := func(photos []Photo) []Photo {
+		if *favorites {
+			before := photos
+			photos = favoritesOnly(photos)
+			skips.dropped(before, photos, skipFiltered, "not a favorite")
+		}
+
+		if *createdBy != "" {
+			var dropped int
+			before := photos
+			photos, dropped = filterPhotos(photos, func(p Photo) bool { return strings.EqualFold(p.CreatedBy, *createdBy) })
+			logf("%d photos created by %s (%d others skipped)\n", len(photos), *createdBy, dropped)
+			skips.dropped(before, photos, skipFiltered, "not created by "+*createdBy)
+		}
+
+		if !after.IsZero() || !before.IsZero() {
+			var dropped int
+			kept := photos
+			photos, dropped = filterPhotos(photos, func(p Photo) bool { return shotBetween(p, after, before) })
+			logf("%d photos were taken in the -after/-before range (%d others skipped)\n", len(photos), dropped)
+			skips.dropped(kept, photos, skipFiltered, "taken outside -after/-before")
+		}
+
+		if *bundleOnly {
+			var dropped int
+			before := photos
+			photos, dropped = filterPhotos(photos, func(p Photo) bool { return p.BundleWithPPP })
+			logf("%d photos are bundled with PhotoPass+ (%d others skipped)\n", len(photos), dropped)
+			skips.dropped(before, photos, skipFiltered, "not bundled with PhotoPass+")
+		}
+
+		before := photos
+		var dropped int
+		photos, dropped = filterPhotos(photos, func(p Photo) bool { return allowedTypes.allows(p.MimeType) })
+		if dropped > 0 {
+			wrongType += dropped
+			logf("Skipping %d photos whose type is not in -mime-types\n", dropped)
+			for _, p := range before {
+				if !allowedTypes.allows(p.MimeType) {
+					skips.add(p, "", skipFiltered, p.MimeType+" is not in -mime-types")
+				}
+			}
+		}
+
+		if !*includeDisabled {
+			var dropped int
+			before := photos
+			photos, dropped = filterPhotos(photos, func(p Photo) bool { return !p.Disabled })
+			if dropped > 0 {
+				logf("Skipping %d disabled photos\n", dropped)
+			}
+			disabled += dropped
+			skips.dropped(before, photos, skipDisabled, "")
+		}
+
+		if !*includeExpired {
+			var dropped int
+			before := photos
+			now := time.Now()
+			photos, dropped = filterPhotos(photos, func(p Photo) bool { return !hasExpired(p, now) })
+			if dropped > 0 {
+				logf("Skipping %d expired photos\n", dropped)
+			}
+			expired += dropped
+			skips.dropped(before, photos, skipExpired, "")
+		}
+
+		if includeIDs != nil {
+			before := photos
+			photos = allowedIDs(photos, includeIDs)
+			skips.dropped(before, photos, skipFiltered, "not listed in "+*idsFile)
+			logf("%d photos are listed in %s\n", len(photos), *idsFile)
+		}
+
+		if wantCodes != nil {
+			before := photos
+			photos, _ = filterPhotos(photos, func(p Photo) bool { return wantCodes[p.PhotoCode] })
+			skips.dropped(before, photos, skipFiltered, "not among the photo codes given")
+		}
+
+		if excludeIDs != nil {
+			var dropped int
+			before := photos
+			photos, dropped = filterPhotos(photos, func(p Photo) bool { return !excludeIDs[p.ID] })
+			logf("Excluding %d photos listed in %s\n", dropped, *excludeIDsFile)
+			skips.dropped(before, photos, skipFiltered, "listed in "+*excludeIDsFile)
+		}
+
+		if shardN > 0 {
+			var dropped int
+			before := photos
+			photos, dropped = filterPhotos(photos, func(p Photo) bool { return inShard(p, shardI, shardN) })
+			logf("Shard %d/%d has %d photos (%d in other shards)\n", shardI, shardN, len(photos), dropped)
+			skips.dropped(before, photos, skipFiltered, "in another -shard")
+		}
+
+		if !lastRun.IsZero() {
+			var dropped int
+			before := photos
+			photos, dropped = filterPhotos(photos, func(p Photo) bool { return newerThan(p, lastRun) })
+			logf("%d photos are new since %s (%d older skipped)\n", len(photos), lastRun.Local().Format(time.DateTime), dropped)
+			skips.dropped(before, photos, skipFiltered, "not new since the last run")
+		}
+
+		if repairIDs != nil {
+			photos, _ = filterPhotos(photos, func(p Photo) bool { return repairIDs[photoKey(p)] })
+			logf("Repairing %d photos\n", len(photos))
+		}
+		if retrySizes != nil {
+			photos, _ = filterPhotos(photos, func(p Photo) bool { return retrySizes[photoKey(p)] != nil })
+			logf("Retrying the failed sizes of %d photos\n", len(photos))
+		}
+		return photos
+	}
+
+	list, listing := listFunc(GetPhotosByConditions), "all"
+	if *favorites {
+		list, listing = GetFavorites, "favorites"
+	}
+	if *verifyTokenExpiry {
+		if err := verifyTokens(tokens, list, time.Now()); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitCodeFor(err)
+		}
+	}
+	key := cacheKey(tokens, listing)
+	fullList := list
+	var clock *catalogClock
+	if *incrementalCatalog {
+		clock, err = loadCatalogClock(filepath.Join(outputDir, catalogTimeName))
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+		list = clock.list(list)
+	}
+	var since *sinceMarker
+	if *sinceID != "" || *autoSince {
+		since, err = loadSinceMarker(filepath.Join(outputDir, sinceIDName), *sinceID)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+		list = since.list(list)
+	}
+	var hashes *catalogHashes
+	var listingHash string
+	if *skipIfUnchanged {
+		hashes, err = loadCatalogHashes(filepath.Join(outputDir, catalogHashName))
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+	}
+	var photos []Photo
+	cached := false
+	var queue *downloadQueue
+	if *queueFile != "" {
+		queue, err = loadQueue(*queueFile)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+	}
+	resumed := queue != nil && len(queue.pending) > 0
+	if *urlsFile != "" {
+		photos, err = readURLList(*urlsFile)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+		cached = true // nothing to fetch from the API
+	} else if resumed {
+		photos, _ = queue.photos()
+		cached = true
+		logf("Resuming %d queued downloads from %s\n", len(queue.pending), *queueFile)
+	} else if *metadataCache != "" && !*refresh {
+		photos, cached = loadMetadataCache(*metadataCache, key, *cacheTTL)
+	}
+	// With -pipeline the listing is fetched in the background and each page
+	// is downloaded as it arrives
+	var pages chan []Photo
+	var fetchErr error
+	// Saved pages only line up with a listing of the same page size
+	cursorKey := key
+	if pageLimit != defaultPageLimit {
+		cursorKey = fmt.Sprintf("%s:limit=%d", key, pageLimit)
+	}
+	if *pipeline {
+		var cursor *catalogCursor
+		if *resumeCatalog {
+			cursor = loadCatalogCursor(outputDir, cursorKey)
+		}
+		pages = make(chan []Photo)
+		go func() {
+			defer close(pages)
+			if fetchErr = streamTokens(tokens, list, cursor, pages); fetchErr == nil {
+				cursor.clear(tokens)
+			}
+		}()
+		cached = true
+		logf("Downloading photos as the listing is fetched\n")
+	}
+	if !cached {
+		var cursor *catalogCursor
+		if *resumeCatalog {
+			cursor = loadCatalogCursor(outputDir, cursorKey)
+		}
+		photos, err = fetchTokens(tokens, list, cursor)
+		if errors.Is(err, errPartialListing) {
+			// Download what was listed; the run still reports the gap
+			fetchErr = err
+		} else if err != nil {
+			if exitCodeFor(err) == exitAuth {
+				fmt.Printf("Error: authentication failed, check your token: %v\n", err)
+				return exitAuth
+			}
+			fmt.Printf("Error: %v\n", err)
+			return exitCodeFor(err)
+		}
+		// A partial listing is neither resumed past, cached nor compared
+		if fetchErr == nil {
+			cursor.clear(tokens)
+		}
+		if *metadataCache != "" && fetchErr == nil {
+			if err := saveMetadataCache(*metadataCache, key, photos); err != nil {
+				logf("Warning: %v\n", err)
+			}
+		}
+		// An incremental listing only holds what is new, so any photo in it
+		// is a change
+		if hashes != nil && fetchErr == nil {
+			listingHash = catalogHash(photos)
+			incremental := clock != nil || since != nil
+			if (incremental && len(photos) == 0) || (!incremental && hashes.unchanged(key, listingHash)) {
+				logf("No changes since last run\n")
+				return exitOK
+			}
+		}
+	}
+	wholeCatalog := false
+	if pages == nil {
+		if missing := missingCodes(photos, flag.Args()); len(missing) > 0 {
+			fmt.Printf("Error: %d photo codes are not in the catalog: %s\n", len(missing), strings.Join(missing, ", "))
+			return exitConfig
+		}
+		catalogSize := len(photos)
+		photos = selectPhotos(photos)
+		logf("Found %d photos to download\n", len(photos))
+		if err := checkCount(len(photos), *expectCount, *minCount, *maxCount); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitPartial
+		}
+		if *sample > 0 || *samplePercent > 0 {
+			n := *sample
+			if *samplePercent > 0 {
+				n = int(math.Ceil(float64(len(photos)) * *samplePercent / 100))
+				if *sample > 0 {
+					n = min(n, *sample)
+				}
+			}
+			if *seed == 0 {
+				*seed = time.Now().UnixNano()
+			}
+			all, before := len(photos), photos
+			photos = samplePhotos(photos, n, *seed)
+			skips.dropped(before, photos, skipFiltered, "not in the sample")
+			logf("Sampled %d of %d photos (-seed %d repeats this sample)\n", len(photos), all, *seed)
+		}
+		if *downloadOrder == orderBalanced {
+			photos = balanceLocations(photos)
+		}
+		// Only a run planning every photo of a full listing can tell which
+		// partial downloads no photo will complete
+		wholeCatalog = len(photos) == catalogSize && listing == "all" && clock == nil && since == nil &&
+			!resumed && *urlsFile == "" && fetchErr == nil && retrySizes == nil
+	}
+
+	manifest := newManifest(outputDir)
+	if !*freshManifest {
+		manifest, err = loadManifest(outputDir)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+	}
+	if *manifestJournal {
+		if err := manifest.openJournal(*freshManifest); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+	}
+
+	downloader := NewPhotoDownloader(manifest)
+	downloader.skips = skips
+	downloader.retrySizes = retrySizes
+	if *checksumsFile != "" {
+		if downloader.checksums, err = openChecksumList(*checksumsFile); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+		defer downloader.checksums.Close()
+	}
+	if *webhookURL != "" {
+		if !isHTTPURL(*webhookURL) {
+			fmt.Printf("Error: -webhook must be an http or https URL\n")
+			return exitConfig
+		}
+		downloader.webhook = startWebhook(*webhookURL)
+	}
+	if *disableHTTP2 {
+		downloader.client.Transport = newDownloadTransport(false)
+	}
+	transport := downloader.client.Transport.(*http.Transport)
+	if fixtures != nil {
+		downloader.client.Transport = fixtures
+	}
+	if *urlsFile == "" {
+		downloader.refresher = newURLRefresher(fullList)
+	}
+	downloader.resume = *resumeManifest
+	downloader.tokenDir = *tokenDirs
+	downloader.regionDirs = *regionDirs
+	downloader.statusDirs = *statusDirs
+	downloader.sizeDirs = *sizeDirs
+	downloader.groupByDate = *groupByDate
+	if *groupByDate && *dateTreeDirs {
+		fmt.Printf("Error: choose one of -group-by-date and -date-tree\n")
+		return exitConfig
+	}
+	downloader.dateTree = *dateTreeDirs
+	sanitize, ok := fsProfiles[*fsProfile]
+	if !ok {
+		fmt.Printf("Error: unknown -fs-profile %q, expected fat32 or unix\n", *fsProfile)
+		return exitConfig
+	}
+	downloader.SanitizeName = sanitize
+	if !slices.Contains(collisionPolicies, *onCollision) {
+		fmt.Printf("Error: unknown -on-collision %q, expected suffix, skip, overwrite or error\n", *onCollision)
+		return exitConfig
+	}
+	downloader.names = newNameRegistry(*onCollision)
+	downloader.preserveTimestamps = *preserveTimestamps
+	downloader.autoOrient = *autoOrient
+	downloader.xmpSidecars = *xmpSidecars
+	downloader.precheck = *precheck
+	downloader.hostLimits, err = parseHostLimits(hostRPS)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return exitConfig
+	}
+	if *groupByDate && *flatSingleDay {
+		if days := distinctDays(photos); len(days) == 1 {
+			logf("All photos were taken on %s, saving them without a date subfolder\n", days[0])
+			downloader.groupByDate = false
+		}
+	}
+	downloader.maxSize = *maxFileSize
+	downloader.maxTotalBytes = *maxTotalBytes
+	downloader.minBytes = *minBytes
+	downloader.maxIdle = *maxIdle
+	if *timeoutBase <= 0 || *timeoutPerMB < 0 {
+		fmt.Printf("Error: -timeout-base must be positive and -timeout-per-mb not negative\n")
+		return exitConfig
+	}
+	downloader.client.Timeout = *timeoutBase
+	if *timeoutPerMB > 0 {
+		// The per-download deadline replaces the client's fixed one
+		downloader.client.Timeout = 0
+		downloader.timeout, downloader.timeoutPerMB = *timeoutBase, *timeoutPerMB
+	}
+	if (*overwrite && (*skipExisting || *overwriteIfLarger)) || (*skipExisting && *overwriteIfLarger) {
+		fmt.Printf("Error: only one of -overwrite, -skip-existing and -overwrite-if-larger can be given\n")
+		return exitConfig
+	}
+	downloader.overwriteIfLarger = *overwriteIfLarger
+	downloader.skipExisting, downloader.overwrite = *skipExisting, *overwrite
+	downloader.validate = *validate
+	if *checkDims != "" && !slices.Contains(dimensionPolicies, *checkDims) {
+		fmt.Printf("Error: unknown -check-dimensions %q, expected warn, retry or fail\n", *checkDims)
+		return exitConfig
+	}
+	if *dimsSlack < 0 {
+		fmt.Printf("Error: -dimension-tolerance cannot be negative\n")
+		return exitConfig
+	}
+	downloader.checkDims, downloader.dimsSlack = *checkDims, *dimsSlack
+	downloader.retries = *retries
+	if *adaptiveRetry {
+		if *retryWindow < adaptiveMinSamples {
+			fmt.Printf("Error: -retry-window must be at least %d\n", adaptiveMinSamples)
+			return exitConfig
+		}
+		downloader.window = newSuccessWindow(*retryWindow)
+	}
+	switch *preferAspect {
+	case "", "original":
+	default:
+		fmt.Printf("Error: -prefer-aspect must be original, got %q\n", *preferAspect)
+		return exitConfig
+	}
+	downloader.preferAspect = *preferAspect == "original"
+	downloader.width = *width
+	downloader.followEdits = *followEdits
+	downloader.allSizes = *allThumbnails || *everything
+	downloader.withOriginal = *everything
+	downloader.fallbackToThumbnail = *fallbackToThumbnail
+	downloader.tryUnpurchased = *tryUnpurchased
+	downloader.dedupeSizes = *dedupeSizes || (*dedupeLink || *dedupeHardlink) && !*dedupe
+	switch {
+	case *dedupeLink && *dedupeHardlink:
+		fmt.Printf("Error: choose one of -dedupe-link and -dedupe-hardlink\n")
+		return exitConfig
+	case *dedupeLink:
+		downloader.dedupeLink = linkSymbolic
+	case *dedupeHardlink:
+		downloader.dedupeLink = linkHard
+	}
+	if *dedupe {
+		downloader.contents = newContentIndex(downloader.manifest)
+	}
+	if *maxRuntime > 0 {
+		downloader.stopAfter = time.Now().Add(*maxRuntime)
+	}
+	downloader.nameTemplate = tmpl
+	downloader.onTemplateError = *onTemplateError
+
+	if *jpegQuality < 0 || *jpegQuality > 100 {
+		fmt.Printf("Error: -jpeg-quality must be between 1 and 100\n")
+		return exitConfig
+	}
+	downloader.jpegQuality = *jpegQuality
+	if *stripExif && (*locationCoords != "" || *xmpSidecars || *exifDates) {
+		fmt.Printf("Error: -strip-exif cannot be combined with -location-coords, -exif-date or -xmp, which add the metadata it removes\n")
+		return exitConfig
+	}
+	downloader.exifDates = *exifDates
+	downloader.stripExif = *stripExif
+	downloader.abortOnAuthError = abortOnAuthError
+	if downloader.derivatives, err = parseDerivatives(*derive); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return exitConfig
+	}
+
+	if *watermarkPath != "" {
+		downloader.watermark, err = loadWatermark(*watermarkPath, *watermarkPos, *watermarkOpacity)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+	}
+
+	if *locationCoords != "" {
+		downloader.locationCoords, err = loadLocationCoords(*locationCoords)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+	} else if *geoJSON != "" {
+		fmt.Printf("Error: -geojson needs -location-coords to place photos\n")
+		return exitConfig
+	}
+
+	if *proxyList != "" {
+		downloader.proxies, err = loadProxyPool(*proxyList, downloader.client.Timeout, transport)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+		if fixtures != nil {
+			for _, pc := range downloader.proxies.clients {
+				pc.client.Transport, _ = fixtureTransport(pc.client.Transport, *recordDir, *replayDir)
+			}
+		}
+		logf("Rotating downloads across %d proxies\n", len(downloader.proxies.clients))
+	}
+	if *trace {
+		downloader.client.Transport = traced(downloader.client.Transport)
+		if downloader.proxies != nil {
+			for _, pc := range downloader.proxies.clients {
+				pc.client.Transport = traced(pc.client.Transport)
+			}
+		}
+	}
+
+	if *maxRedirects < 0 {
+		fmt.Printf("Error: -max-redirects cannot be negative\n")
+		return exitConfig
+	}
+	downloader.client.CheckRedirect = limitRedirects(*maxRedirects)
+	if downloader.proxies != nil {
+		for _, pc := range downloader.proxies.clients {
+			pc.client.CheckRedirect = limitRedirects(*maxRedirects)
+		}
+	}
+
+	if *metricsAddr != "" {
+		stopMetrics := startMetricsServer(*metricsAddr, &downloader.stats)
+		defer stopMetrics()
+	}
+	if *autoConcurrency && *maxConcurrency <= 0 {
+		*maxConcurrency = 16
+	}
+	explicit := *maxConcurrency > 0
+	*maxConcurrency = downloader.SetConcurrency(*maxConcurrency)
+	if !explicit {
+		logf("Running up to %d downloads at once (%d CPUs)\n", *maxConcurrency, runtime.NumCPU())
+	}
+	if *copyBufferSize <= 0 {
+		fmt.Printf("Error: -copy-buffer-size must be positive\n")
+		return exitConfig
+	}
+	downloader.buffers = newCopyBuffers(*copyBufferSize)
+	if *parallelConversion {
+		if *conversionWorkers < 0 {
+			fmt.Printf("Error: -conversion-workers cannot be negative\n")
+			return exitConfig
+		}
+		if *conversionWorkers == 0 {
+			*conversionWorkers = runtime.NumCPU()
+		}
+		downloader.conversions = startConversionPool(*conversionWorkers)
+	}
+	if *writeConcurrency < 0 {
+		fmt.Printf("Error: -write-concurrency cannot be negative\n")
+		return exitConfig
+	}
+	if *writeConcurrency > 0 {
+		downloader.writeSem = make(chan struct{}, *writeConcurrency)
+	}
+	if *autoConcurrency && *warmup > 0 {
+		fmt.Printf("Error: -warmup cannot be combined with -auto-concurrency, which already starts low\n")
+		return exitConfig
+	}
+	// The breaker, the tuner and the warmup each hold slots of the same
+	// semaphore without knowing of the others
+	if *throttleOn429 && (*autoConcurrency || *warmup > 0) {
+		fmt.Printf("Error: -throttle-on-429 cannot be combined with -auto-concurrency or -warmup\n")
+		return exitConfig
+	}
+	if *autoConcurrency {
+		if *minConcurrency < 1 || *minConcurrency > *maxConcurrency {
+			fmt.Printf("Error: -min-concurrency must be between 1 and -max-concurrency\n")
+			return exitConfig
+		}
+		tuner := startTuner(downloader.sem, *minConcurrency, *maxConcurrency, &downloader.stats)
+		defer tuner.Stop()
+	} else if *warmup > 0 {
+		defer warmUp(downloader.sem, *warmup)()
+	}
+	if *throttleOn429 {
+		if *throttleBurst < 1 || *throttleCooldown <= 0 {
+			fmt.Printf("Error: -throttle-burst and -throttle-cooldown must be positive\n")
+			return exitConfig
+		}
+		downloader.breaker = startBreaker(*throttleBurst, *throttleCooldown, downloader.sem)
+		defer downloader.breaker.Stop()
+	}
+
+	if *toStdout {
+		if err := downloader.streamPhoto(photos, *photoCode, sizes, imageOut); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitCodeFor(err)
+		}
+		return exitOK
+	}
+
+	if *contactSheet != "" {
+		layout := sheetLayout{columns: *sheetColumns, rows: *sheetRows, cell: *sheetCell}
+		if err := downloader.contactSheet(photos, *contactSheet, layout); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitCodeFor(err)
+		}
+		return exitOK
+	}
+
+	if *pdfOut != "" {
+		if err := downloader.writePDF(photos, sizes[0], *pdfOut); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitCodeFor(err)
+		}
+		return exitOK
+	}
+
+	if *listSizesOnly {
+		listSizes(photos)
+		return exitOK
+	}
+
+	if *dryRun {
+		downloader.dryRun(photos, sizes, *diffOnly)
+		return exitOK
+	}
+
+	if *exportURLs != "" {
+		n, err := downloader.exportURLs(photos, sizes, *exportURLs)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+		logf("Wrote %d URLs to %s\n", n, *exportURLs)
+		return exitOK
+	}
+
+	if *diffOnly {
+		d, err := downloader.diff(photos, sizes)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+		d.print()
+		if len(d.missing) > 0 {
+			return exitPartial
+		}
+		return exitOK
+	}
+
+	if *tarPath != "" && *s3Target != "" {
+		fmt.Printf("Error: choose one of -tar and -s3\n")
+		return exitConfig
+	}
+	if *resumeArchive && *tarPath == "" {
+		fmt.Printf("Error: -resume-archive needs -tar\n")
+		return exitConfig
+	}
+	if *resumeArchive {
+		downloader.archive, err = openResumableTar(*tarPath)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+	} else if *tarPath != "" {
+		downloader.archive, err = createTarArchive(*tarPath)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+	} else if *s3Target != "" {
+		downloader.archive, err = newS3Sink(*s3Target)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+	} else if pages == nil {
+		// Stale partials can only be told apart once the whole listing is known
+		photos = downloader.resumePartials(photos, sizes, wholeCatalog)
+	}
+
+	var animations []animation
+	if *animate && downloader.archive == nil {
+		photos, animations = groupAnimations(photos)
+		if len(animations) > 0 {
+			logf("Combining frames into %d animations\n", len(animations))
+		}
+	}
+
+	// With a queue, every download is planned up front and persisted
+	var queued map[string][]download
+	if queue != nil {
+		if !resumed {
+			var all []download
+			for _, photo := range photos {
+				downloads, problems := downloader.plan(photo, sizes)
+				for _, p := range problems {
+					logf("%s\n", p)
+				}
+				all = append(all, downloads...)
+			}
+			if err := queue.reset(all); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return exitConfig
+			}
+		}
+		_, queued = queue.photos()
+		downloader.queue = queue
+	}
+
+	total := 0
+	var estimated int64
+	for _, photo := range photos {
+		downloads := queued[photoKey(photo)]
+		if queued == nil {
+			downloads, _ = downloader.plan(photo, sizes)
+			if downloader.retrySizes != nil {
+				downloads = downloader.onlyFailedSizes(photo, downloads)
+			}
+		}
+		total += len(downloads)
+		for _, d := range downloads {
+			estimated += estimateSize(d)
+		}
+	}
+
+	if failure := downloader.templateFailure; failure != "" {
+		fmt.Printf("Error: name template failed for %s\n", failure)
+		return exitConfig
+	}
+	if *onCollision == collideError {
+		if c := downloader.names.collision(); c != "" {
+			fmt.Printf("Error: %s\n", c)
+			return exitConfig
+		}
+	}
+
+	if downloader.archive == nil {
+		if err := preflightDisk(outputDir, total, *minInodes); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+	}
+
+	if *promptLarge && !*assumeYes && isLargeDownload(total, estimated, *largeFiles, *largeBytes) {
+		if err := confirmDownload(total, estimated, os.Stdin); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitConfig
+		}
+	}
+
+	// Keep the record of what completed if the run is interrupted
+	atInterrupt(func() {
+		if err := manifest.save(); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+		if err := skips.write(outputDir); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+		if *summaryJSON != "" {
+			if err := downloader.writeSummary(*summaryJSON, started, exitCanceled); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+		}
+	})
+
+	stopPauseWatch := watchPauseFile(outputDir, &downloader.stats)
+	defer stopPauseWatch()
+
+	stopHeartbeat := func() {}
+	if *statsInterval > 0 {
+		stopHeartbeat = startHeartbeat(&downloader.stats, *statsInterval)
+	}
+
+	var prog *progress
+	if !quiet {
+		prog = startProgress(&downloader.stats, total)
+	}
+
+	for _, photo := range photos {
+		if queued != nil {
+			if !downloader.filtered(photo) {
+				downloader.processDownloads(photo, queued[photoKey(photo)])
+			}
+			continue
+		}
+		downloader.processPhoto(photo, sizes)
+	}
+
+	if pages != nil {
+		listed := 0
+		for page := range pages {
+			listed += len(page)
+			for _, photo := range selectPhotos(page) {
+				downloads, _ := downloader.plan(photo, sizes)
+				if prog != nil {
+					prog.add(len(downloads))
+				}
+				downloader.processPhoto(photo, sizes)
+			}
+		}
+		if fetchErr != nil && exitCodeFor(fetchErr) == exitAuth {
+			fmt.Printf("Error: authentication failed, check your token: %v\n", fetchErr)
+			if abortOnAuthError {
+				downloader.authFailed.Store(true)
+			}
+		} else if exitCodeFor(fetchErr) == exitCanceled {
+			logf("Listing stopped by the interrupt after %d photos\n", listed)
+		} else if fetchErr != nil {
+			fmt.Printf("Error: %v\n", fetchErr)
+		} else {
+			logf("Listed %d photos\n", listed)
+		}
+	}
+
+	// Wait for all downloads to complete
+	downloader.wg.Wait()
+	if downloader.conversions != nil {
+		downloader.conversions.Close()
+	}
+	downloader.sharedURLs.cleanup()
+	for _, a := range animations {
+		if err := downloader.saveAnimation(a, sizes[0]); err != nil {
+			downloader.stats.failed.Add(1)
+			downloader.recordFailure(a.name+".gif", err)
+			logf("Error creating %s.gif: %v\n", a.name, err)
+		}
+	}
+	stopHeartbeat()
+	if prog != nil {
+		prog.Stop()
+	}
+	if downloader.archive != nil {
+		if err := downloader.archive.Close(); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			downloader.recordFailure(*tarPath+*s3Target, err)
+		}
+	}
+	if queue != nil {
+		if err := queue.finish(); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+	}
+
+	// Merge this run's results into the existing manifest
+	if err := manifest.save(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+	if err := skips.write(outputDir); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+
+	errs := make([]error, len(downloader.failures))
+	for i, f := range downloader.failures {
+		errs[i] = f.err
+	}
+	code := dominantExitCode(errs)
+	if fetchErr != nil && code == exitOK {
+		code = exitCodeFor(fetchErr)
+	}
+	if runCtx.Err() != nil {
+		code = exitCanceled
+	}
+	if *geoJSON != "" {
+		if err := downloader.writeGeoJSON(photos, sizes[0], *geoJSON); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+	}
+	if clock != nil && code == exitOK {
+		if err := clock.save(); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+	}
+	if since != nil && code == exitOK {
+		if err := since.save(tokens); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+	}
+	if listingHash != "" && code == exitOK {
+		if err := hashes.save(key, listingHash); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+	}
+	if *newerThanLastRun && code == exitOK {
+		if err := writeLastRun(lastRunPath, started); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+	}
+	if downloader.webhook != nil {
+		summary := downloader.summary(started, code)
+		downloader.webhook.send(webhookEvent{Event: "summary", Summary: &summary})
+		downloader.webhook.Close()
+	}
+	if *failuresFile != "" {
+		if err := downloader.writeFailures(*failuresFile); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+	}
+	if *summaryJSON != "" {
+		if err := downloader.writeSummary(*summaryJSON, started, code); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+	}
+	if *verboseTiming {
+		phases.print(downloader.stats.bytes.Load(), time.Since(started))
+	}
+
+	if quiet {
+		if len(downloader.failures) == 0 {
+			return code
+		}
+		fmt.Printf("%d of %d downloads failed:\n", len(downloader.failures), downloader.stats.downloaded.Load()+downloader.stats.failed.Load())
+		for _, f := range downloader.failures {
+			fmt.Printf("  %s: %v\n", f.filename, f.err)
+		}
+		return code
+	}
+	if code == exitCanceled {
+		fmt.Println("Interrupted!")
+	} else {
+		fmt.Println("All downloads completed!")
+	}
+	stats := &downloader.stats
+	fmt.Printf("%d downloaded (%d needed retries, %d total retry attempts), %d failed permanently\n",
+		stats.downloaded.Load(), stats.retriedSuccess.Load(), stats.retryAttempts.Load(), stats.failed.Load())
+	if n := stats.skipped.Load(); n > 0 {
+		total := n + stats.downloaded.Load() + stats.failed.Load()
+		fmt.Printf("%d of %d files were skipped as already downloaded or unchanged\n", n, total)
+	}
+	if len(downloader.failures) > 0 {
+		failures := append([]failure(nil), downloader.failures...)
+		sort.Slice(failures, func(i, j int) bool { return failures[i].filename < failures[j].filename })
+		fmt.Println("Failed downloads:")
+		for _, f := range failures {
+			fmt.Printf("  %s: %v\n", f.filename, f.err)
+		}
+	}
+	if disabled > 0 {
+		fmt.Printf("%d disabled photos were skipped (use -include-disabled to download them)\n", disabled)
+	}
+	if expired > 0 {
+		fmt.Printf("%d expired photos were skipped (use -include-expired to try them)\n", expired)
+	}
+	if wrongType > 0 {
+		fmt.Printf("%d photos were skipped because their type is not in -mime-types\n", wrongType)
+	}
+	if n := stats.filtered.Load(); n > 0 {
+		fmt.Printf("%d photos were skipped by the filter\n", n)
+	}
+	if n := stats.wrongDimensions.Load(); n > 0 {
+		fmt.Printf("%d download attempts were served at other dimensions than the API reported\n", n)
+	}
+	if n := stats.stalls.Load(); n > 0 {
+		fmt.Printf("%d download attempts stalled for -max-idle and were aborted\n", n)
+	}
+	if b := downloader.breaker; b != nil && b.trips.Load() > 0 {
+		fmt.Printf("The server throttled downloads %d times (%d 429 responses in all)\n", b.trips.Load(), b.hits.Load())
+	}
+	if n := stats.notFound.Load(); n > 0 {
+		fmt.Printf("%d files no longer exist on the server and were skipped\n", n)
+	}
+	if n := stats.collapsed.Load(); n > 0 {
+		fmt.Printf("%d duplicate files were collapsed into identical files already kept\n", n)
+	}
+	if n := stats.stripped.Load(); n > 0 {
+		fmt.Printf("Stripped metadata from %d JPEGs, saving %s\n", n, approxSize(stats.strippedBytes.Load()))
+	}
+	if from := stats.recompressedFrom.Load(); from > 0 {
+		to := stats.recompressedTo.Load()
+		fmt.Printf("Re-encoding at quality %d shrank JPEGs from %s to %s\n", *jpegQuality, approxSize(from), approxSize(to))
+	}
+	if n := stats.authAborted.Load(); n > 0 {
+		fmt.Printf("%d downloads were not started after authentication failed\n", n)
+	}
+	if n := stats.substituted.Load(); n > 0 {
+		fmt.Printf("%d originals were not available and were replaced by their largest thumbnail\n", n)
+	}
+	if n := stats.timeLimited.Load(); n > 0 {
+		fmt.Printf("%d downloads were not started because -max-runtime was reached\n", n)
+	}
+	if n := stats.byteCapped.Load(); n > 0 {
+		fmt.Printf("%d downloads were not started because they would exceed -max-total-bytes\n", n)
+	}
+	if n := stats.canceled.Load(); n > 0 {
+		fmt.Printf("%d downloads were stopped or not started because of the interrupt\n", n)
+	}
+	return code
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDownloadPhoto(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		code   int // statusError code expected; 0 for success
+	}{
+		{name: "ok", status: http.StatusOK, body: "\xff\xd8\xff\xe0 jpeg bytes"},
+		{name: "not found", status: http.StatusNotFound, body: "missing", code: http.StatusNotFound},
+		{name: "server error", status: http.StatusBadGateway, body: "bad gateway", code: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pd := NewPhotoDownloader(nil)
+			pd.Doer = &stubDoer{status: tt.status, body: tt.body}
+			path := filepath.Join(t.TempDir(), "photo.jpg")
+
+			_, err := pd.downloadPhoto("https://cdn.example.com/photo.jpg", path, validators{}, time.Time{})
+			if tt.code == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				data, err := os.ReadFile(path)
+				if err != nil || string(data) != tt.body {
+					t.Fatalf("saved %q (%v), want %q", data, err, tt.body)
+				}
+				return
+			}
+			var se *statusError
+			if !errors.As(err, &se) || se.code != tt.code {
+				t.Fatalf("error %v, want status %d", err, tt.code)
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("%s was saved for a %d response", path, tt.status)
+			}
+		})
+	}
+}
+
+func TestSetConcurrency(t *testing.T) {
+	tests := []struct {
+		n, want int
+	}{
+		{n: 5, want: 5},
+		{n: 1, want: 1},
+		{n: 0, want: defaultConcurrency()},
+		{n: -3, want: defaultConcurrency()},
+	}
+	for _, tt := range tests {
+		pd := NewPhotoDownloader(nil)
+		if got := pd.SetConcurrency(tt.n); got != tt.want || cap(pd.sem) != tt.want {
+			t.Errorf("SetConcurrency(%d) = %d with %d slots, want %d", tt.n, got, cap(pd.sem), tt.want)
+		}
+	}
+	if d := defaultConcurrency(); d < 1 || d > maxDefaultConcurrency {
+		t.Errorf("defaultConcurrency() = %d, want 1 to %d", d, maxDefaultConcurrency)
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const manifestName = "manifest.json"
+
+// manifestJournalName is the file in outputDir that -manifest-journal
+// appends each updated entry to, one JSON object per line, until the
+// manifest is next saved
+const manifestJournalName = ".manifest.jsonl"
+
+// ManifestEntry records the files saved for a single photo
+type ManifestEntry struct {
+	ID             string             `json:"id"`
+	Region         string             `json:"region,omitempty"` // region the photo was listed from; empty for the default
+	PhotoCode      string             `json:"photoCode"`
+	ShootOn        time.Time          `json:"shootOn"`
+	LocationID     string             `json:"locationId"`
+	SiteID         string             `json:"siteId"`
+	IsFavorite     bool               `json:"isFavorite"`
+	CreatedBy      string             `json:"createdBy"`
+	Files          map[string]string  `json:"files"`                // size -> filename relative to outputDir
+	Checksums      map[string]string  `json:"checksums,omitempty"`  // size -> SHA-256 of the file as saved
+	ETags          map[string]string  `json:"etags,omitempty"`      // size -> ETag the server sent with the file
+	Outcomes       map[string]outcome `json:"outcomes,omitempty"`   // size -> how the download went
+	Duplicates     map[string]string  `json:"duplicates,omitempty"` // dropped size -> reason it was removed
+	LastDownloaded time.Time          `json:"lastDownloaded"`
+}
+
+// key is the regionKey the entry is stored under. Entries written before
+// regions were recorded belong to the default region.
+func (e *ManifestEntry) key() string {
+	region := e.Region
+	if region == "" {
+		region = defaultRegion
+	}
+	return regionKey(region, e.ID)
+}
+
+// outcome records how a file's download went, for spotting flaky photos
+type outcome struct {
+	Attempts int    `json:"attempts"`           // 1 when it succeeded first try, 0 when copied from a download of the same URL
+	Status   int    `json:"status"`             // HTTP status of the final response
+	Bytes    int64  `json:"bytes"`              // size as served, before any post-processing
+	FinalURL string `json:"finalUrl,omitempty"` // where redirects led, when the file was redirected
+}
+
+// Manifest maps photos, by photoKey, to the files downloaded for them
+type Manifest struct {
+	mu      sync.Mutex
+	dir     string
+	entries map[string]*ManifestEntry
+	journal *os.File // nil unless -manifest-journal is on
+}
+
+// newManifest returns an empty manifest that will be saved in dir
+func newManifest(dir string) *Manifest {
+	return &Manifest{dir: dir, entries: make(map[string]*ManifestEntry)}
+}
+
+// loadManifest reads manifest.json from dir. A missing file yields an empty manifest.
+func loadManifest(dir string) (*Manifest, error) {
+	m := newManifest(dir)
+
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading manifest: %v", err)
+	}
+	if err == nil {
+		var entries []*ManifestEntry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("error parsing manifest: %v", err)
+		}
+		for _, e := range entries {
+			m.entries[e.key()] = e
+		}
+	}
+	if err := m.replayJournal(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// replayJournal applies the entries a run that died before saving left in
+// the journal. A line cut short by the crash ends the replay.
+func (m *Manifest) replayJournal() error {
+	f, err := os.Open(filepath.Join(m.dir, manifestJournalName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading manifest journal: %v", err)
+	}
+	defer f.Close()
+	recovered := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		var e ManifestEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			logf("Warning: manifest journal ends in an unreadable line, ignoring it\n")
+			break
+		}
+		m.entries[e.key()] = &e
+		recovered++
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading manifest journal: %v", err)
+	}
+	if recovered > 0 {
+		logf("Recovered %d manifest updates from a run that did not finish\n", recovered)
+	}
+	return nil
+}
+
+// openJournal starts appending every change to the journal, so a run that
+// is killed keeps its record. fresh discards a journal left by such a run.
+func (m *Manifest) openJournal(fresh bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if fresh {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(filepath.Join(m.dir, manifestJournalName), flags, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening manifest journal: %v", err)
+	}
+	m.mu.Lock()
+	m.journal = f
+	m.mu.Unlock()
+	return nil
+}
+
+// logEntry appends e to the journal, if there is one. The caller holds m.mu,
+// which keeps lines whole and in order.
+func (m *Manifest) logEntry(e *ManifestEntry) {
+	if m.journal == nil {
+		return
+	}
+	data, err := json.Marshal(e)
+	if err == nil {
+		_, err = m.journal.Write(append(data, '\n'))
+	}
+	if err != nil {
+		logf("Warning: could not write manifest journal: %v\n", err)
+	}
+}
+
+// hasFile reports whether the manifest lists a file for that size of photo
+// that is still present on disk, regardless of what it would be named today.
+func (m *Manifest) hasFile(photo Photo, size string) bool {
+	m.mu.Lock()
+	e, ok := m.entries[photoKey(photo)]
+	var name string
+	if ok {
+		name = e.Files[size]
+	}
+	m.mu.Unlock()
+
+	if name == "" {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(m.dir, name))
+	return err == nil && info.Size() > 0
+}
+
+// record adds a downloaded file, its checksum, the server's ETag and how the
+// download went to the photo's entry, creating the entry if needed, and
+// returns the checksum. The previous outcome is kept when got has no status,
+// e.g. for a 304.
+func (m *Manifest) record(photo Photo, size, filename string, got fetched) string {
+	sum, err := hashFile(filepath.Join(m.dir, filename))
+	if err != nil {
+		logf("Could not checksum %s: %v\n", filename, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := photoKey(photo)
+	e, ok := m.entries[key]
+	if !ok {
+		e = &ManifestEntry{ID: photo.ID, Files: make(map[string]string)}
+		if region := photoRegion(photo); region != defaultRegion {
+			e.Region = region
+		}
+		m.entries[key] = e
+	}
+	e.PhotoCode = photo.PhotoCode
+	e.ShootOn = photo.ShootOn.Time()
+	e.LocationID = photo.LocationID
+	e.SiteID = photo.SiteID
+	e.IsFavorite = photo.IsFavorite
+	e.CreatedBy = photo.CreatedBy
+	if e.Files == nil {
+		e.Files = make(map[string]string)
+	}
+	e.Files[size] = filename
+	if e.Checksums == nil {
+		e.Checksums = make(map[string]string)
+	}
+	if sum != "" {
+		e.Checksums[size] = sum
+	} else {
+		delete(e.Checksums, size)
+	}
+	if e.ETags == nil {
+		e.ETags = make(map[string]string)
+	}
+	if got.etag != "" {
+		e.ETags[size] = got.etag
+	} else {
+		delete(e.ETags, size)
+	}
+	if got.status != 0 {
+		if e.Outcomes == nil {
+			e.Outcomes = make(map[string]outcome)
+		}
+		e.Outcomes[size] = outcome{Attempts: got.attempts, Status: got.status, Bytes: got.bytes, FinalURL: got.finalURL}
+	}
+	e.LastDownloaded = time.Now()
+	m.logEntry(e)
+	return sum
+}
+
+// etagFor returns the ETag recorded for that size of photo, if any
+func (m *Manifest) etagFor(photo Photo, size string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.entries[photoKey(photo)]; ok {
+		return e.ETags[size]
+	}
+	return ""
+}
+
+// fileFor returns the filename recorded for that size of photo, if any
+func (m *Manifest) fileFor(photo Photo, size string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.entries[photoKey(photo)]; ok {
+		return e.Files[size]
+	}
+	return ""
+}
+
+// bytesFor returns the size recorded for the last download of that size of
+// photo, or 0 when none is known
+func (m *Manifest) bytesFor(photo Photo, size string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.entries[photoKey(photo)]; ok {
+		return e.Outcomes[size].Bytes
+	}
+	return 0
+}
+
+// checksummedFiles maps each checksum of a recorded file to the files that have it
+func (m *Manifest) checksummedFiles() map[string][]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	files := make(map[string][]string)
+	for _, e := range m.entries {
+		for size, sum := range e.Checksums {
+			if name := e.Files[size]; name != "" {
+				files[sum] = append(files[sum], name)
+			}
+		}
+	}
+	return files
+}
+
+// filesFor returns every file recorded for photo
+func (m *Manifest) filesFor(photo Photo) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	if e, ok := m.entries[photoKey(photo)]; ok {
+		for _, name := range e.Files {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// markDuplicate records that size was removed as an exact copy of kept
+func (m *Manifest) markDuplicate(photo Photo, size, kept string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[photoKey(photo)]
+	if !ok {
+		return
+	}
+	delete(e.Files, size)
+	delete(e.Checksums, size)
+	delete(e.ETags, size)
+	delete(e.Outcomes, size)
+	if e.Duplicates == nil {
+		e.Duplicates = make(map[string]string)
+	}
+	e.Duplicates[size] = "identical to " + kept
+	m.logEntry(e)
+}
+
+// markLinked records that size was replaced by a link to the identical kept size
+func (m *Manifest) markLinked(photo Photo, size, kept string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[photoKey(photo)]
+	if !ok {
+		return
+	}
+	if e.Duplicates == nil {
+		e.Duplicates = make(map[string]string)
+	}
+	e.Duplicates[size] = "linked to " + kept
+	m.logEntry(e)
+}
+
+// save writes the manifest sorted by shoot time so diffs between runs stay readable
+func (m *Manifest) save() error {
+	// Hold the lock throughout, as an interrupted run saves while downloads
+	// are still recording and the run's own save may be under way
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := make([]*ManifestEntry, 0, len(m.entries))
+	for _, e := range m.entries {
+		entries = append(entries, e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].ShootOn.Equal(entries[j].ShootOn) {
+			return entries[i].ShootOn.Before(entries[j].ShootOn)
+		}
+		return entries[i].ID < entries[j].ID
+	})
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding manifest: %v", err)
+	}
+
+	path := filepath.Join(m.dir, manifestName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("error writing manifest: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error writing manifest: %v", err)
+	}
+	// Everything in the journal is in the manifest now, including what
+	// loadManifest recovered from one without the flag
+	if m.journal != nil {
+		err = m.journal.Truncate(0)
+	} else if err = os.Remove(filepath.Join(m.dir, manifestJournalName)); os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("error clearing manifest journal: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestManifestKeysByRegion(t *testing.T) {
+	dir := t.TempDir()
+	hk := Photo{ID: "id0", PhotoCode: "HK", SourceToken: "tok-hk"}
+	sh := Photo{ID: "id0", PhotoCode: "SH", SourceToken: "sh:tok-sh"}
+	for _, name := range []string{"hk.jpg", "sh.jpg"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := newManifest(dir)
+	m.record(hk, "x128", "hk.jpg", fetched{})
+	m.record(sh, "x1024", "sh.jpg", fetched{})
+	if err := m.save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same ID in two regions is two photos
+	for _, mm := range []*Manifest{m, loaded} {
+		if !mm.hasFile(hk, "x128") || mm.hasFile(hk, "x1024") {
+			t.Errorf("hk sizes = %v, want only x128", mm.filesFor(hk))
+		}
+		if !mm.hasFile(sh, "x1024") || mm.hasFile(sh, "x128") {
+			t.Errorf("sh sizes = %v, want only x1024", mm.filesFor(sh))
+		}
+	}
+}
+
+func TestManifestRecordsPhotoMetadata(t *testing.T) {
+	dir := t.TempDir()
+	shot := time.Date(2024, 10, 1, 10, 0, 0, 0, time.UTC)
+	photos := []Photo{
+		{ID: "id1", PhotoCode: "LATE", ShootOn: FlexTime(shot.Add(time.Hour)), LocationID: "loc2", SiteID: "site1"},
+		{ID: "id0", PhotoCode: "EARLY", ShootOn: FlexTime(shot), LocationID: "loc1", SiteID: "site1", IsFavorite: true},
+	}
+	m := newManifest(dir)
+	for _, p := range photos {
+		for _, size := range []string{"x128", "x1024"} {
+			name := p.PhotoCode + "_" + size + ".jpg"
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+				t.Fatal(err)
+			}
+			m.record(p, size, name, fetched{})
+		}
+	}
+	if err := m.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []ManifestEntry
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	// Sorted by shoot time, so the earlier photo comes first
+	if len(got) != 2 || got[0].PhotoCode != "EARLY" || got[1].PhotoCode != "LATE" {
+		t.Fatalf("manifest = %s, want EARLY then LATE", data)
+	}
+	e := got[0]
+	if !e.ShootOn.Equal(shot) || e.LocationID != "loc1" || e.SiteID != "site1" || !e.IsFavorite {
+		t.Errorf("entry = %+v, want the photo's shoot time, location, site and favorite flag", e)
+	}
+	if e.Files["x128"] != "EARLY_x128.jpg" || e.Files["x1024"] != "EARLY_x1024.jpg" {
+		t.Errorf("files = %v, want each size's filename", e.Files)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GPS IFD tags
+const (
+	tagGPSVersionID    = 0x0000
+	tagGPSLatitudeRef  = 0x0001
+	tagGPSLatitude     = 0x0002
+	tagGPSLongitudeRef = 0x0003
+	tagGPSLongitude    = 0x0004
+)
+
+// Exif IFD tags for when the photo was taken
+const (
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTimeOriginal = 0x9011
+)
+
+// coord is a latitude/longitude pair in decimal degrees
+type coord struct {
+	lat, lon float64
+}
+
+// loadLocationCoords reads a file of "locationId,lat,lon" lines. Blank lines
+// and lines starting with # are ignored.
+func loadLocationCoords(path string) (map[string]coord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening location coords: %v", err)
+	}
+	defer f.Close()
+
+	coords := make(map[string]coord)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected locationId,lat,lon", path, line)
+		}
+		lat, err := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64)
+		if err != nil || math.Abs(lat) > 90 {
+			return nil, fmt.Errorf("%s:%d: invalid latitude %q", path, line, fields[1])
+		}
+		lon, err := strconv.ParseFloat(strings.TrimSpace(fields[2]), 64)
+		if err != nil || math.Abs(lon) > 180 {
+			return nil, fmt.Errorf("%s:%d: invalid longitude %q", path, line, fields[2])
+		}
+		coords[strings.TrimSpace(fields[0])] = coord{lat: lat, lon: lon}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading location coords: %v", err)
+	}
+	return coords, nil
+}
+
+// wantsMetadata reports whether any metadata enrichment is enabled
+func (pd *PhotoDownloader) wantsMetadata() bool {
+	return pd.locationCoords != nil || pd.exifDates
+}
+
+// writeMetadata embeds photo details into a downloaded JPEG in a single
+// rewrite of the file
+func (pd *PhotoDownloader) writeMetadata(photo Photo, path string) error {
+	_, err := updateExif(path, func(x *exifData) bool {
+		changed := false
+		if c, ok := pd.locationCoords[photo.LocationID]; ok {
+			x.setGPS(c)
+			changed = true
+		}
+		if t := shootTime(photo); pd.exifDates && !t.IsZero() {
+			if _, ok := findEntry(x.exif, tagDateTimeOriginal); !ok || pd.overwrite {
+				x.setDateTaken(t)
+				changed = true
+			}
+		}
+		return changed
+	})
+	return err
+}
+
+// setGPS replaces the position in the GPS IFD
+func (x *exifData) setGPS(c coord) {
+	latRef, lonRef := "N", "E"
+	if c.lat < 0 {
+		latRef = "S"
+	}
+	if c.lon < 0 {
+		lonRef = "W"
+	}
+	setEntry(&x.gps, exifEntry{tag: tagGPSVersionID, typ: exifByte, count: 4, value: []byte{2, 3, 0, 0}})
+	setEntry(&x.gps, asciiEntry(tagGPSLatitudeRef, latRef))
+	setEntry(&x.gps, x.rationalEntry(tagGPSLatitude, dms(c.lat)...))
+	setEntry(&x.gps, asciiEntry(tagGPSLongitudeRef, lonRef))
+	setEntry(&x.gps, x.rationalEntry(tagGPSLongitude, dms(c.lon)...))
+}
+
+// setDateTaken records t as the capture time, with its UTC offset
+func (x *exifData) setDateTaken(t time.Time) {
+	setEntry(&x.exif, asciiEntry(tagDateTimeOriginal, t.Format("2006:01:02 15:04:05")))
+	setEntry(&x.exif, asciiEntry(tagOffsetTimeOriginal, t.Format("-07:00")))
+}
+
+// dms converts decimal degrees to degree, minute and second rationals
+func dms(deg float64) [][2]uint32 {
+	deg = math.Abs(deg)
+	d := math.Floor(deg)
+	m := math.Floor((deg - d) * 60)
+	s := ((deg-d)*60 - m) * 60
+	return [][2]uint32{{uint32(d), 1}, {uint32(m), 1}, {uint32(math.Round(s * 10000)), 10000}}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// downloadStats holds counters updated concurrently by download goroutines
+type downloadStats struct {
+	downloaded atomic.Int64
+	failed     atomic.Int64
+	bytes      atomic.Int64
+	inFlight   atomic.Int64
+	skipped    atomic.Int64
+
+	retriedSuccess  atomic.Int64 // files that succeeded only after retrying
+	retryAttempts   atomic.Int64 // total extra attempts across all files
+	timeLimited     atomic.Int64 // files not started because -max-runtime passed
+	notFound        atomic.Int64 // files -precheck found missing on the server
+	filtered        atomic.Int64 // photos rejected by PhotoDownloader.Filter
+	substituted     atomic.Int64 // thumbnails saved by -fallback-to-thumbnail in place of an original
+	authAborted     atomic.Int64 // files not started because -abort-on-auth-error tripped
+	byteCapped      atomic.Int64 // files not started because of -max-total-bytes
+	canceled        atomic.Int64 // files not started or cut short by an interrupt
+	stalls          atomic.Int64 // attempts aborted after -max-idle without data
+	wrongDimensions atomic.Int64 // attempts -check-dimensions found at another size than reported
+	collapsed       atomic.Int64 // files -dedupe removed or linked as identical to another
+	paused          atomic.Bool  // the pause file is present, new downloads wait
+
+	recompressedFrom atomic.Int64 // bytes of the JPEGs -jpeg-quality re-encoded, before
+	recompressedTo   atomic.Int64 // and after, counting files kept as served
+	stripped         atomic.Int64 // JPEGs -strip-exif removed metadata from
+	strippedBytes    atomic.Int64 // bytes of metadata those files shed
+}
+
+// writeMetrics renders the counters in the Prometheus text exposition format
+func (s *downloadStats) writeMetrics(w io.Writer) {
+	metrics := []struct {
+		name, kind, help string
+		value            int64
+	}{
+		{"downloads_total", "counter", "Files downloaded successfully.", s.downloaded.Load()},
+		{"failures_total", "counter", "Downloads that failed.", s.failed.Load()},
+		{"bytes_total", "counter", "Bytes written to disk.", s.bytes.Load()},
+		{"in_flight", "gauge", "Downloads currently in progress.", s.inFlight.Load()},
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+	}
+}
+
+// startMetricsServer serves the stats on /metrics at addr until the returned
+// function is called to shut it down
+func startMetricsServer(addr string, stats *downloadStats) func() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		stats.writeMetrics(w)
+	})
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fmt.Printf("Error serving metrics: %v\n", err)
+		}
+	}()
+	logf("Serving metrics on %s/metrics\n", addr)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}
+}
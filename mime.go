@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// sniffLen is how much of each download is kept for content type detection
+const sniffLen = 512
+
+// extensions maps image content types to the file extension used when saving them
+var extensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+	"image/heic": ".heic",
+	"image/heif": ".heif",
+}
+
+// extensionFor returns the extension for a content type, defaulting to .jpg
+func extensionFor(mimeType string) string {
+	if ext, ok := extensions[strings.ToLower(mimeType)]; ok {
+		return ext
+	}
+	return ".jpg"
+}
+
+// sniffImageType detects the content type from the first bytes of a file,
+// recognising HEIC/HEIF containers that http.DetectContentType does not
+func sniffImageType(b []byte) string {
+	if len(b) >= 12 && string(b[4:8]) == "ftyp" {
+		switch string(b[8:12]) {
+		case "heic", "heix", "hevc", "hevx", "heim", "heis":
+			return "image/heic"
+		case "mif1", "msf1", "heif":
+			return "image/heif"
+		}
+	}
+	mimeType := http.DetectContentType(b)
+	if i := strings.IndexByte(mimeType, ';'); i >= 0 {
+		mimeType = mimeType[:i]
+	}
+	return mimeType
+}
+
+// sniffBuffer keeps the first sniffLen bytes written to it and discards the rest
+type sniffBuffer struct {
+	bytes.Buffer
+}
+
+func (s *sniffBuffer) Write(p []byte) (int, error) {
+	if room := sniffLen - s.Len(); room > 0 {
+		if len(p) < room {
+			room = len(p)
+		}
+		s.Buffer.Write(p[:room])
+	}
+	return len(p), nil
+}
+
+// mimeAllowlist holds -mime-types entries: exact types such as image/png or
+// whole families such as image/*
+type mimeAllowlist []string
+
+// parseMimeTypes splits a comma-separated -mime-types value
+func parseMimeTypes(spec string) (mimeAllowlist, error) {
+	var list mimeAllowlist
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if major, minor, ok := strings.Cut(entry, "/"); !ok || major == "" || minor == "" {
+			return nil, fmt.Errorf("invalid -mime-types entry %q, expected e.g. image/jpeg or image/*", entry)
+		}
+		list = append(list, entry)
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("-mime-types lists no types")
+	}
+	return list, nil
+}
+
+// allows reports whether mimeType is on the list. Photos the API gives no
+// type for are allowed, as there is nothing to filter them by.
+func (l mimeAllowlist) allows(mimeType string) bool {
+	mimeType = strings.ToLower(mimeType)
+	if mimeType == "" {
+		return true
+	}
+	for _, entry := range l {
+		if entry == mimeType || (strings.HasSuffix(entry, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(entry, "*"))) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMimeAllowlist(t *testing.T) {
+	list, err := parseMimeTypes("image/jpeg,image/heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		mimeType string
+		want     bool
+	}{
+		{"image/jpeg", true},
+		{"IMAGE/HEIC", true},
+		{"image/png", false},
+		{"video/mp4", false},
+		{"", true},
+	}
+	for _, tt := range tests {
+		if got := list.allows(tt.mimeType); got != tt.want {
+			t.Errorf("allows(%q) = %v, want %v", tt.mimeType, got, tt.want)
+		}
+	}
+}
+
+// withOutputDir points outputDir at dir for the rest of the test
+func withOutputDir(t *testing.T, dir string) {
+	prev := outputDir
+	outputDir = dir
+	t.Cleanup(func() { outputDir = prev })
+}
+
+func TestSavedFileKeepsSniffedName(t *testing.T) {
+	const heic = "\x00\x00\x00\x18ftypheic\x00\x00\x00\x00 heic bytes"
+	tests := []struct {
+		name         string
+		skipExisting bool
+		status       int  // served on the second run
+		wantRequests int  // requests the second run sends
+		conditional  bool // the second request revalidates the stored file
+	}{
+		{name: "skip existing", skipExisting: true, wantRequests: 0},
+		{name: "revalidated", status: http.StatusNotModified, wantRequests: 1, conditional: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			withOutputDir(t, dir)
+			manifest := newManifest(dir)
+			photo := Photo{ID: "id0", PhotoCode: "CODE0"}
+			d := download{photo: photo, key: "x1024", url: "https://cdn.example.com/a.jpg", filename: "CODE0_1024x.jpg"}
+
+			first := NewPhotoDownloader(manifest)
+			first.skips = &skipLog{}
+			first.Doer = &stubDoer{status: http.StatusOK, body: heic}
+			post, err := first.saveFile(d)
+			if err != nil || post == nil {
+				t.Fatalf("first saveFile = %v", err)
+			}
+			if err := post(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "CODE0_1024x.heic")); err != nil {
+				t.Fatalf("not saved under the sniffed name: %v", err)
+			}
+
+			second := NewPhotoDownloader(manifest)
+			second.skips = &skipLog{}
+			second.skipExisting = tt.skipExisting
+			doer := &stubDoer{status: tt.status}
+			second.Doer = doer
+			if _, err := second.saveFile(d); err != nil {
+				t.Fatalf("second saveFile = %v", err)
+			}
+			if len(doer.seen) != tt.wantRequests {
+				t.Fatalf("second run sent %d requests, want %d", len(doer.seen), tt.wantRequests)
+			}
+			if tt.conditional && doer.seen[0].Header.Get("If-Modified-Since") == "" {
+				t.Errorf("second request was not conditional: %v", doer.seen[0].Header)
+			}
+			if second.stats.skipped.Load() != 1 {
+				t.Errorf("skipped = %d, want 1", second.stats.skipped.Load())
+			}
+			if _, err := os.Stat(filepath.Join(dir, "CODE0_1024x.jpg")); !os.IsNotExist(err) {
+				t.Errorf("a second copy was saved under the planned name")
+			}
+		})
+	}
+}
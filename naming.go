@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// nameFields are the values available to -name-template
+type nameFields struct {
+	ID         string
+	PhotoCode  string
+	Size       string // size name, e.g. x1024
+	Suffix     string // default filename suffix for the size, e.g. 1024x
+	ShootDate  string // YYYY-MM-DD
+	LocationID string
+	SiteID     string
+	CreatedBy  string // sanitized for use in filenames
+}
+
+// Policies for a photo -name-template cannot be rendered for
+const (
+	templateSkip     = "skip"     // log it and download nothing for the size
+	templateFallback = "fallback" // use the default filename instead
+	templateAbort    = "abort"    // stop the run before downloading
+)
+
+// templatePolicies lists the values -on-template-error accepts
+var templatePolicies = []string{templateSkip, templateFallback, templateAbort}
+
+// sampleFields are rendered once at startup so a template naming a field
+// that does not exist fails before any photo is listed
+var sampleFields = nameFields{
+	ID:         "0123456789abcdef",
+	PhotoCode:  "CODE",
+	Size:       "x1024",
+	Suffix:     "1024x",
+	ShootDate:  "2024-01-01",
+	LocationID: "location",
+	SiteID:     "site",
+	CreatedBy:  "photographer",
+}
+
+// parseNameTemplate compiles a -name-template value and checks it renders a
+// usable name for a sample photo
+func parseNameTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid name template: %v", err)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, sampleFields); err != nil {
+		return nil, fmt.Errorf("invalid name template: %v", err)
+	}
+	if strings.TrimSpace(b.String()) == "" {
+		return nil, fmt.Errorf("invalid name template: it renders an empty name")
+	}
+	return tmpl, nil
+}
+
+// shootZone is the time zone shoot times are shown in, from -timezone or the
+// parks' region; nil keeps them as the API sent them
+var shootZone *time.Location
+
+// shootTime returns when photo was taken in shootZone, or the zero time
+func shootTime(photo Photo) time.Time {
+	t := photo.ShootOn.Time()
+	if !t.IsZero() && shootZone != nil {
+		t = t.In(shootZone)
+	}
+	return t
+}
+
+// shootDay is the YYYY-MM-DD date a photo was taken, falling back to the
+// API's shootDate string when shootOn is missing
+func shootDay(photo Photo) string {
+	if shootOn := shootTime(photo); !shootOn.IsZero() {
+		return shootOn.Format("2006-01-02")
+	}
+	return photo.ShootDate
+}
+
+// renderName executes tmpl for one size of photo, returning the name without
+// extension. Slashes written in the template create subfolders; separators
+// inside field values are replaced so only the template decides the layout.
+func renderName(tmpl *template.Template, photo Photo, size, suffix string) (string, error) {
+	field := strings.NewReplacer("/", "_", "\\", "_").Replace
+
+	var b strings.Builder
+	err := tmpl.Execute(&b, nameFields{
+		ID:         field(photo.ID),
+		PhotoCode:  field(photo.PhotoCode),
+		Size:       field(size),
+		Suffix:     field(suffix),
+		ShootDate:  field(shootDay(photo)),
+		LocationID: field(photo.LocationID),
+		SiteID:     field(photo.SiteID),
+		CreatedBy:  sanitizeField(photo.CreatedBy),
+	})
+	if err != nil {
+		return "", fmt.Errorf("error rendering name template: %v", err)
+	}
+
+	name := strings.ReplaceAll(b.String(), "\\", "/")
+	for _, segment := range strings.Split(name, "/") {
+		switch strings.TrimSpace(segment) {
+		case "":
+			return "", fmt.Errorf("name template rendered %q, which has an empty path segment", name)
+		case ".", "..":
+			return "", fmt.Errorf("name template rendered %q, which leaves the output folder", name)
+		}
+	}
+	return name, nil
+}
+
+// fileCode is the name of photo's files before the size: its PhotoCode with
+// path separators replaced, or its ID when the code is blank
+func fileCode(photo Photo) string {
+	code := strings.TrimSpace(photo.PhotoCode)
+	if code == "" {
+		code = photo.ID
+	}
+	return strings.NewReplacer("/", "_", "\\", "_").Replace(code)
+}
+
+// sanitizeField replaces characters that are awkward in filenames with
+// underscores: spaces, control characters, path separators and the others
+// Windows rejects. Letters and digits of any script are kept.
+func sanitizeField(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(s))
+}
+
+// dateDir is the -group-by-date subfolder for photo
+func dateDir(photo Photo) string {
+	if day := sanitizeField(shootDay(photo)); day != "" {
+		return day
+	}
+	return "undated"
+}
+
+// statusDir is the -status-dirs folder for photo. A purchase wins over the
+// other flags, and a watermark over being free, so only photos bought
+// outright land in paid/.
+func statusDir(photo Photo) string {
+	switch {
+	case photo.IsPaid:
+		return "paid"
+	case photo.Watermarked:
+		return "watermarked"
+	case photo.IsFree:
+		return "free"
+	}
+	return "unpaid"
+}
+
+// dateTree is the -date-tree YYYY/MM/DD folder for photo, or "unknown" when
+// it has no usable shoot date
+func dateTree(photo Photo) string {
+	day, err := time.Parse("2006-01-02", shootDay(photo))
+	if err != nil {
+		return "unknown"
+	}
+	return filepath.Join(day.Format("2006"), day.Format("01"), day.Format("02"))
+}
+
+// distinctDays lists the different -group-by-date subfolders photos fall into
+func distinctDays(photos []Photo) []string {
+	seen := make(map[string]bool)
+	var days []string
+	for _, p := range photos {
+		if day := dateDir(p); !seen[day] {
+			seen[day] = true
+			days = append(days, day)
+		}
+	}
+	return days
+}
+
+// maxNameBytes is the longest file or folder name most filesystems accept
+const maxNameBytes = 255
+
+// reservedNames cannot be used as file names on Windows or FAT volumes,
+// with or without an extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// fsProfiles are the -fs-profile presets for PhotoDownloader.SanitizeName
+var fsProfiles = map[string]func(string) string{
+	"fat32": sanitizePortable,
+	"unix":  sanitizeUnix,
+}
+
+// sanitizePortable makes one path element safe on FAT32, exFAT, NTFS and
+// Unix filesystems: characters Windows rejects become underscores, trailing
+// dots and spaces are dropped, reserved device names are prefixed and the
+// name is shortened to maxNameBytes
+func sanitizePortable(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimRight(name, ". ")
+
+	base := name
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	if reservedNames[strings.ToUpper(base)] {
+		name = "_" + name
+	}
+	if name == "" {
+		name = "_"
+	}
+	return truncateName(name)
+}
+
+// sanitizeUnix only replaces the characters Unix filesystems cannot store
+func sanitizeUnix(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == 0 || r == '/' {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" || name == "." || name == ".." {
+		name = "_"
+	}
+	return truncateName(name)
+}
+
+// truncateName shortens name to maxNameBytes, keeping its extension and
+// never splitting a UTF-8 character
+func truncateName(name string) string {
+	if len(name) <= maxNameBytes {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if len(ext) > 16 {
+		ext = ""
+	}
+	stem := name[:len(name)-len(ext)]
+	limit := maxNameBytes - len(ext)
+	for limit > 0 && !utf8.RuneStart(stem[limit]) {
+		limit--
+	}
+	return stem[:limit] + ext
+}
+
+// sanitizePath applies pd.SanitizeName to every element of a relative path
+func (pd *PhotoDownloader) sanitizePath(name string) string {
+	sanitize := pd.SanitizeName
+	if sanitize == nil {
+		sanitize = sanitizePortable
+	}
+	parts := strings.Split(filepath.ToSlash(name), "/")
+	for i, part := range parts {
+		parts[i] = sanitize(part)
+	}
+	return filepath.Join(parts...)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileCode(t *testing.T) {
+	tests := []struct {
+		photo Photo
+		want  string
+	}{
+		{Photo{ID: "id1", PhotoCode: "ABC123"}, "ABC123"},
+		{Photo{ID: "id1", PhotoCode: ""}, "id1"},
+		{Photo{ID: "id1", PhotoCode: "   "}, "id1"},
+		{Photo{ID: "id1", PhotoCode: "../../etc/passwd"}, ".._.._etc_passwd"},
+		{Photo{ID: "id1", PhotoCode: `..\..\windows`}, ".._.._windows"},
+		{Photo{ID: "a/b", PhotoCode: ""}, "a_b"},
+	}
+	for _, tt := range tests {
+		if got := fileCode(tt.photo); got != tt.want {
+			t.Errorf("fileCode(%q, %q) = %q, want %q", tt.photo.ID, tt.photo.PhotoCode, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeField(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"Mickey", "Mickey"},
+		{" Mickey Mouse ", "Mickey_Mouse"},
+		{"米奇", "米奇"},
+		{"Pâtissière-2", "Pâtissière-2"},
+		{"a/b\\c", "a_b_c"},
+		{`what?<>:"|*`, "what_______"},
+		{"tab\there\x00", "tab_here_"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeField(tt.in); got != tt.want {
+			t.Errorf("sanitizeField(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizePath(t *testing.T) {
+	for _, profile := range []string{"fat32", "unix"} {
+		pd := &PhotoDownloader{SanitizeName: fsProfiles[profile]}
+		for _, name := range []string{"../../etc/passwd", "..", "a/../../b", "./.", "x/./..", "CON:1/..", ""} {
+			got := pd.sanitizePath(name)
+			if !filepath.IsLocal(got) {
+				t.Errorf("%s: sanitizePath(%q) = %q, which leaves the folder", profile, name, got)
+			}
+		}
+	}
+}
+
+func TestPlanStaysInOutputDir(t *testing.T) {
+	codes := []string{"../../etc/passwd", "..", "/abs/path", `C:\Windows\system32`, "a:b*c?", "", "  ", "ok/../../x"}
+	for _, profile := range []string{"fat32", "unix"} {
+		for _, sizeDirs := range []bool{false, true} {
+			pd := NewPhotoDownloader(nil)
+			pd.SanitizeName = fsProfiles[profile]
+			pd.names = newNameRegistry(collideSuffix)
+			pd.skips = &skipLog{}
+			pd.sizeDirs = sizeDirs
+			for i, code := range codes {
+				photo := Photo{ID: "id" + string(rune('0'+i)), PhotoCode: code}
+				photo.Thumbnail.X128 = ThumbnailSize{URL: "https://cdn.example.com/a.jpg"}
+				downloads, _ := pd.plan(photo, []string{"x128"})
+				if len(downloads) != 1 {
+					t.Fatalf("%s: planned %d downloads for %q, want 1", profile, len(downloads), code)
+				}
+				name := downloads[0].filename
+				if !filepath.IsLocal(name) {
+					t.Errorf("%s: %q is saved as %q, outside the output folder", profile, code, name)
+				}
+				target, err := filepath.Rel(outputDir, filepath.Join(outputDir, name))
+				if err != nil || target == ".." || strings.HasPrefix(target, ".."+string(filepath.Separator)) {
+					t.Errorf("%s: %q resolves to %q, outside %s", profile, code, target, outputDir)
+				}
+				if strings.TrimSpace(code) == "" && !strings.HasPrefix(filepath.Base(name), photo.ID) {
+					t.Errorf("%s: photo without a code saved as %q, want it named after ID %s", profile, name, photo.ID)
+				}
+			}
+		}
+	}
+}
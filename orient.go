@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"os"
+)
+
+// Tags touched when normalizing orientation
+const (
+	tagOrientation     = 0x0112
+	tagPixelXDimension = 0xA002
+	tagPixelYDimension = 0xA003
+)
+
+// orientQuality is the JPEG quality used when re-encoding a rotated or
+// watermarked photo
+const orientQuality = 95
+
+// autoOrient rotates or flips the JPEG at path so its pixels display upright
+// without relying on the EXIF orientation tag, then removes the tag. Files
+// that are already upright are left untouched. It reports whether the file
+// was rewritten.
+func autoOrient(path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	segments, _, err := splitJPEG(data)
+	if err != nil {
+		return false, err
+	}
+
+	exifIndex := -1
+	var x *exifData
+	for i, s := range segments {
+		if s.marker == markerAPP1 && bytes.HasPrefix(s.payload, exifHeader) {
+			if x, err = parseExif(s.payload); err != nil {
+				return false, fmt.Errorf("error reading EXIF: %v", err)
+			}
+			exifIndex = i
+			break
+		}
+	}
+	if x == nil {
+		return false, nil
+	}
+	e, ok := findEntry(x.ifd0, tagOrientation)
+	if !ok || e.typ != exifShort || len(e.value) < 2 {
+		return false, nil
+	}
+	orientation := int(x.order.Uint16(e.value))
+	if orientation < 2 || orientation > 8 {
+		return false, nil
+	}
+
+	src, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return false, fmt.Errorf("error decoding image: %v", err)
+	}
+
+	removeEntry(&x.ifd0, tagOrientation)
+	if orientation >= 5 {
+		swapEntries(x.exif, tagPixelXDimension, tagPixelYDimension)
+	}
+	segments[exifIndex] = jpegSegment{marker: markerAPP1, payload: x.encode()}
+
+	out, err := encodeKeepingSegments(reorient(src, orientation), segments, orientQuality)
+	if err != nil {
+		return false, err
+	}
+	return true, replaceFile(path, out)
+}
+
+// encodeKeepingSegments encodes img as a JPEG at quality carrying the
+// application segments (EXIF, ICC profile, ...) and comments of the original file
+func encodeKeepingSegments(img image.Image, segments []jpegSegment, quality int) ([]byte, error) {
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, fmt.Errorf("error encoding image: %v", err)
+	}
+	imageSegments, scan, err := splitJPEG(encoded.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	var out []jpegSegment
+	for _, s := range segments {
+		if (s.marker >= markerAPP0 && s.marker <= 0xEF) || s.marker == 0xFE {
+			out = append(out, s)
+		}
+	}
+	out = append(out, imageSegments...)
+	return joinJPEG(out, scan), nil
+}
+
+// reorient applies an EXIF orientation (2-8) to src
+func reorient(src image.Image, orientation int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				sx, sy = w-1-x, y
+			case 3: // rotated 180
+				sx, sy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // needs a 90 degree clockwise turn
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // needs a 90 degree counter-clockwise turn
+				sx, sy = w-1-y, x
+			}
+			dst.Set(x, y, src.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// partSuffix marks a download that has not finished yet
+const partSuffix = ".part"
+
+// findPartFiles returns the final paths of every interrupted download under dir
+func findPartFiles(dir string) (map[string]bool, error) {
+	parts := make(map[string]bool)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.HasSuffix(path, partSuffix) {
+			parts[strings.TrimSuffix(path, partSuffix)] = true
+		}
+		return nil
+	})
+	return parts, err
+}
+
+// resumePartials moves photos with interrupted downloads to the front of the
+// queue so they finish first. When photos is the whole catalog it also
+// removes partial files that no photo will ever complete; otherwise they may
+// belong to photos filtered out of this run and are left to resume later.
+func (pd *PhotoDownloader) resumePartials(photos []Photo, sizes []string, wholeCatalog bool) []Photo {
+	parts, err := findPartFiles(outputDir)
+	if err != nil {
+		logf("Error scanning for partial downloads: %v\n", err)
+		return photos
+	}
+	if len(parts) == 0 {
+		return photos
+	}
+
+	queued := make(map[string]bool)
+	var resumable, rest []Photo
+	for _, photo := range photos {
+		downloads, _ := pd.plan(photo, sizes)
+		hasPart := false
+		for _, d := range downloads {
+			target := filepath.Join(outputDir, d.filename)
+			queued[target] = true
+			hasPart = hasPart || parts[target]
+		}
+		if hasPart {
+			resumable = append(resumable, photo)
+		} else {
+			rest = append(rest, photo)
+		}
+	}
+
+	for target := range parts {
+		if wholeCatalog && !queued[target] {
+			os.Remove(target + partSuffix)
+			logf("Removed stale partial download %s\n", target+partSuffix)
+		}
+	}
+
+	if len(resumable) > 0 {
+		logf("Resuming %d interrupted downloads first\n", len(resumable))
+	}
+	return append(resumable, rest...)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResumePartials(t *testing.T) {
+	tests := []struct {
+		name         string
+		wholeCatalog bool
+		wantStale    bool // the partial of a photo outside the run survives
+	}{
+		{name: "whole catalog removes stale partials", wholeCatalog: true, wantStale: false},
+		{name: "filtered run keeps them", wholeCatalog: false, wantStale: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			withOutputDir(t, dir)
+			pd := NewPhotoDownloader(nil)
+			pd.names = newNameRegistry(collideSuffix)
+			pd.skips = &skipLog{}
+
+			var photos []Photo
+			for _, code := range []string{"CODE0", "CODE1"} {
+				p := Photo{ID: "id-" + code, PhotoCode: code}
+				p.Thumbnail.X128 = ThumbnailSize{URL: "https://cdn.example.com/" + code + ".jpg"}
+				photos = append(photos, p)
+			}
+			downloads, _ := pd.plan(photos[1], []string{"x128"})
+			resumable := filepath.Join(dir, downloads[0].filename+partSuffix)
+			stale := filepath.Join(dir, "OTHER_128x.jpg"+partSuffix)
+			for _, path := range []string{resumable, stale} {
+				if err := os.WriteFile(path, []byte("partial"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got := pd.resumePartials(photos, []string{"x128"}, tt.wholeCatalog)
+			if len(got) != 2 || got[0].ID != photos[1].ID {
+				t.Errorf("order = %v, want the photo with a partial first", got)
+			}
+			if _, err := os.Stat(resumable); err != nil {
+				t.Errorf("removed the partial of a queued photo: %v", err)
+			}
+			if _, err := os.Stat(stale); (err == nil) != tt.wantStale {
+				t.Errorf("stale partial kept = %v, want %v", err == nil, tt.wantStale)
+			}
+		})
+	}
+}
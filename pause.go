@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// pauseName is the file in outputDir that holds off new downloads while it
+// exists, e.g. after `touch disney_photos/.pause`
+const pauseName = ".pause"
+
+// pausePoll is how often the pause file is looked for
+const pausePoll = 2 * time.Second
+
+// watchPauseFile keeps stats.paused in step with the pause file in dir until
+// the returned func is called
+func watchPauseFile(dir string, stats *downloadStats) func() {
+	path := filepath.Join(dir, pauseName)
+	check := func() {
+		_, err := os.Stat(path)
+		if paused := err == nil; stats.paused.Swap(paused) != paused {
+			if paused {
+				logf("Paused: %s exists, remove it to resume\n", path)
+			} else {
+				logf("Resumed\n")
+			}
+		}
+	}
+	check()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(pausePoll)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				check()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// waitWhilePaused blocks while the pause file is present. Downloads already
+// running finish; only new ones wait. An interrupt ends the wait.
+func (pd *PhotoDownloader) waitWhilePaused() {
+	for pd.stats.paused.Load() && runCtx.Err() == nil {
+		time.Sleep(pausePoll)
+	}
+}
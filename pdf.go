@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	pdfPageShort = 595 // A4 in points, portrait width
+	pdfPageLong  = 842 // and height
+	pdfMargin    = 36  // points around the image
+	pdfFooter    = 20  // points below the image for the caption
+	pdfFontSize  = 9
+	pdfWorkers   = 4 // images fetched ahead of the page being written
+)
+
+// pdfImage is one page's image, ready to embed as a DCT-encoded XObject
+type pdfImage struct {
+	data          []byte // JPEG bytes
+	width, height int
+	colorSpace    string
+}
+
+// writePDF fetches size of every photo and writes them, in order of shoot
+// time, to out as an A4 PDF with one photo per page. Each page is turned to
+// suit its photo and captioned with its code, shoot time and location.
+func (pd *PhotoDownloader) writePDF(photos []Photo, size, out string) error {
+	photos = append([]Photo(nil), photos...)
+	sort.SliceStable(photos, func(i, j int) bool {
+		a, b := shootTime(photos[i]), shootTime(photos[j])
+		if a.IsZero() != b.IsZero() {
+			return b.IsZero() // undated photos go last
+		}
+		return a.Before(b)
+	})
+
+	part := out + ".part"
+	f, err := os.Create(part)
+	if err != nil {
+		return fmt.Errorf("error creating PDF: %v", err)
+	}
+
+	// Fetch ahead of the writer, but only pdfWorkers images at a time so
+	// memory stays bounded however long the listing
+	results := make([]chan *pdfImage, len(photos))
+	for i := range results {
+		results[i] = make(chan *pdfImage, 1)
+	}
+	ahead := make(chan struct{}, pdfWorkers)
+	go func() {
+		for i, photo := range photos {
+			ahead <- struct{}{}
+			go func(photo Photo, result chan<- *pdfImage) {
+				img, err := pd.fetchPDFImage(photo, size)
+				if err != nil {
+					logf("Leaving %s out of the PDF: %v\n", photo.PhotoCode, err)
+				}
+				result <- img
+			}(photo, results[i])
+		}
+	}()
+
+	w := newPDFWriter(f)
+	pages := 0
+	for i := range photos {
+		img := <-results[i]
+		<-ahead
+		if img == nil {
+			continue
+		}
+		w.page(img, pdfCaption(photos[i]))
+		pages++
+	}
+	err = w.finish()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && pages == 0 {
+		err = fmt.Errorf("none of the %d photos could be fetched", len(photos))
+	}
+	if err == nil {
+		err = os.Rename(part, out)
+	}
+	if err != nil {
+		os.Remove(part)
+		return fmt.Errorf("error writing PDF: %v", err)
+	}
+	logf("Wrote %s with %d pages\n", out, pages)
+	return nil
+}
+
+// fetchPDFImage downloads size of photo, re-encoding it as JPEG unless it
+// already is one a PDF viewer can show as served
+func (pd *PhotoDownloader) fetchPDFImage(photo Photo, size string) (*pdfImage, error) {
+	url := pd.resolveURL(photo, size)
+	if url == "" {
+		return nil, fmt.Errorf("no URL for size %s", size)
+	}
+	data, err := pd.fetchBytesWithRetry(url)
+	if err != nil {
+		return nil, err
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding image: %v", err)
+	}
+	if format == "jpeg" {
+		switch cfg.ColorModel {
+		case color.YCbCrModel:
+			return &pdfImage{data: data, width: cfg.Width, height: cfg.Height, colorSpace: "/DeviceRGB"}, nil
+		case color.GrayModel:
+			return &pdfImage{data: data, width: cfg.Width, height: cfg.Height, colorSpace: "/DeviceGray"}, nil
+		}
+	}
+	// PNGs, GIFs and CMYK JPEGs, whose inverted channels viewers disagree on
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding image: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		return nil, fmt.Errorf("error encoding image: %v", err)
+	}
+	b := img.Bounds()
+	return &pdfImage{data: buf.Bytes(), width: b.Dx(), height: b.Dy(), colorSpace: "/DeviceRGB"}, nil
+}
+
+// pdfCaption is the footer line of photo's page
+func pdfCaption(photo Photo) string {
+	parts := []string{photo.PhotoCode}
+	if t := shootTime(photo); !t.IsZero() {
+		parts = append(parts, t.Format("Mon 2 Jan 2006 15:04"))
+	} else if photo.ShootDate != "" {
+		parts = append(parts, photo.ShootDate)
+	}
+	if photo.LocationID != "" {
+		parts = append(parts, "location "+photo.LocationID)
+	}
+	return strings.Join(parts, " - ")
+}
+
+// pdfWriter writes a PDF one page at a time. Objects 1 to 3 are the
+// catalog, the page tree and the font; each page adds three more.
+type pdfWriter struct {
+	w       *bufio.Writer
+	n       int64   // bytes written so far
+	offsets []int64 // of each object, by number - 1
+	kids    []int   // page object numbers
+	err     error
+}
+
+// newPDFWriter starts a PDF on w
+func newPDFWriter(w io.Writer) *pdfWriter {
+	p := &pdfWriter{w: bufio.NewWriter(w), offsets: make([]int64, 3)}
+	p.printf("%%PDF-1.4\n%%\xe2\xe3\xcf\xd3\n")
+	p.object(1, "<< /Type /Catalog /Pages 2 0 R >>")
+	p.object(3, "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	return p
+}
+
+// printf writes to the file, keeping count of the offset
+func (p *pdfWriter) printf(format string, args ...interface{}) {
+	if p.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(p.w, format, args...)
+	p.n += int64(n)
+	p.err = err
+}
+
+// object writes object num with body, recording where it starts
+func (p *pdfWriter) object(num int, body string) {
+	p.offsets[num-1] = p.n
+	p.printf("%d 0 obj\n%s\nendobj\n", num, body)
+}
+
+// stream writes object num as a stream with dict's entries and data
+func (p *pdfWriter) stream(num int, dict string, data []byte) {
+	p.offsets[num-1] = p.n
+	p.printf("%d 0 obj\n<< %s /Length %d >>\nstream\n", num, dict, len(data))
+	if p.err == nil {
+		n, err := p.w.Write(data)
+		p.n += int64(n)
+		p.err = err
+	}
+	p.printf("\nendstream\nendobj\n")
+}
+
+// page adds a page showing img, fitted within the margins above caption.
+// Landscape images get a landscape page.
+func (p *pdfWriter) page(img *pdfImage, caption string) {
+	pageW, pageH := pdfPageShort, pdfPageLong
+	if img.width > img.height {
+		pageW, pageH = pageH, pageW
+	}
+	box := image.Rect(pdfMargin, pdfMargin+pdfFooter, pageW-pdfMargin, pageH-pdfMargin)
+	fit := fitRect(image.Rect(0, 0, img.width, img.height), box)
+
+	num := len(p.offsets) + 1
+	p.offsets = append(p.offsets, 0, 0, 0)
+	p.kids = append(p.kids, num)
+	p.object(num, fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R >> /XObject << /Im0 %d 0 R >> >> /Contents %d 0 R >>",
+		pageW, pageH, num+2, num+1))
+	content := fmt.Sprintf("q %d 0 0 %d %d %d cm /Im0 Do Q\nBT /F1 %d Tf %d %d Td (%s) Tj ET\n",
+		fit.Dx(), fit.Dy(), fit.Min.X, fit.Min.Y, pdfFontSize, pdfMargin, pdfMargin+(pdfFooter-pdfFontSize)/2, pdfString(caption))
+	p.stream(num+1, "", []byte(content))
+	p.stream(num+2, fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace %s /BitsPerComponent 8 /Filter /DCTDecode",
+		img.width, img.height, img.colorSpace), img.data)
+}
+
+// finish writes the page tree, the cross-reference table and the trailer
+func (p *pdfWriter) finish() error {
+	kids := make([]string, len(p.kids))
+	for i, k := range p.kids {
+		kids[i] = fmt.Sprintf("%d 0 R", k)
+	}
+	p.object(2, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(p.kids)))
+	xref := p.n
+	p.printf("xref\n0 %d\n0000000000 65535 f \n", len(p.offsets)+1)
+	for _, off := range p.offsets {
+		p.printf("%010d 00000 n \n", off)
+	}
+	p.printf("trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(p.offsets)+1, xref)
+	if p.err != nil {
+		return p.err
+	}
+	return p.w.Flush()
+}
+
+// pdfString escapes s for a literal string, replacing what the
+// WinAnsi-encoded standard font cannot show
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r > 0x7e:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
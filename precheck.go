@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// errNotFound is returned by checkURL when the server no longer has a file
+var errNotFound = errors.New("not found on server")
+
+// checkURL confirms with a HEAD request that url exists and serves an image,
+// retrying failed requests like a download. Statuses a HEAD cannot answer
+// reliably, such as 403 from expiring signed URLs or servers without HEAD
+// support, are left for the download itself to handle.
+func (pd *PhotoDownloader) checkURL(url string) error {
+	var err error
+	for attempt := 0; attempt <= pd.retries; attempt++ {
+		if attempt > 0 {
+			pd.stats.retryAttempts.Add(1)
+			sleep(retryDelay(attempt))
+		}
+
+		var resp *http.Response
+		if resp, err = pd.head(url); err == nil {
+			switch resp.StatusCode {
+			case http.StatusNotFound, http.StatusGone:
+				return errNotFound
+			case http.StatusOK:
+				if ct := resp.Header.Get("Content-Type"); ct != "" && !strings.HasPrefix(ct, "image/") && !strings.HasPrefix(ct, "application/octet-stream") {
+					return fmt.Errorf("server returned %s instead of an image", ct)
+				}
+				return nil
+			case http.StatusForbidden, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+				return nil
+			}
+			err = &statusError{code: resp.StatusCode, resp: resp}
+		}
+		if !pd.shouldRetry(err, attempt) {
+			break
+		}
+	}
+	return err
+}
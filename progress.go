@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const (
+	ttyProgressInterval  = 200 * time.Millisecond
+	pipeProgressInterval = 10 * time.Second
+)
+
+// progressLine is set while a single-line terminal progress display is active,
+// so logf knows to clear it before printing
+var progressLine atomic.Bool
+
+// progress periodically reports how many files have been handled. On a
+// terminal it redraws one line in place; otherwise it prints plain lines.
+type progress struct {
+	stats *downloadStats
+	total atomic.Int64
+	tty   bool
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// startProgress begins reporting progress towards total files
+func startProgress(stats *downloadStats, total int) *progress {
+	p := &progress{
+		stats: stats,
+		tty:   term.IsTerminal(int(os.Stdout.Fd())),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	p.total.Store(int64(total))
+
+	interval := pipeProgressInterval
+	if p.tty {
+		interval = ttyProgressInterval
+		progressLine.Store(true)
+	}
+
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.render()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+func (p *progress) render() {
+	done := p.stats.downloaded.Load() + p.stats.failed.Load() + p.stats.skipped.Load()
+	line := fmt.Sprintf("Progress: %d/%d files, %d failed, %.1f MB", done, p.total.Load(), p.stats.failed.Load(), float64(p.stats.bytes.Load())/(1<<20))
+	if p.tty {
+		fmt.Printf("\r\033[K%s", line)
+	} else {
+		fmt.Println(line)
+	}
+}
+
+// add raises the total as more files are planned
+func (p *progress) add(n int) {
+	p.total.Add(int64(n))
+}
+
+// Stop ends reporting and clears the terminal progress line
+func (p *progress) Stop() {
+	close(p.stop)
+	<-p.done
+	if p.tty {
+		progressLine.Store(false)
+		fmt.Print("\r\033[K")
+	}
+}
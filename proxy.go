@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	proxyMaxFailures = 3           // consecutive failures before a proxy is benched
+	proxyCooldown    = time.Minute // how long a benched proxy sits out
+)
+
+// proxyClient is an http.Client routed through a single proxy
+type proxyClient struct {
+	proxy        *url.URL
+	client       *http.Client
+	failures     int
+	benchedUntil time.Time
+}
+
+// proxyPool hands out proxy clients round-robin, skipping ones that keep failing
+type proxyPool struct {
+	mu      sync.Mutex
+	clients []*proxyClient
+	next    int
+}
+
+// loadProxyPool reads one proxy URL per line from path, ignoring blanks and #
+// comments. Each proxy gets its own copy of base routed through it.
+func loadProxyPool(path string, timeout time.Duration, base *http.Transport) (*proxyPool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening proxy list: %v", err)
+	}
+	defer f.Close()
+
+	pool := &proxyPool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		proxy, err := url.Parse(line)
+		if err != nil || proxy.Host == "" {
+			return nil, fmt.Errorf("invalid proxy %q in %s", line, path)
+		}
+		transport := base.Clone()
+		transport.Proxy = http.ProxyURL(proxy)
+		pool.clients = append(pool.clients, &proxyClient{
+			proxy:  proxy,
+			client: &http.Client{Timeout: timeout, Transport: transport},
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading proxy list: %v", err)
+	}
+	if len(pool.clients) == 0 {
+		return nil, fmt.Errorf("no proxies found in %s", path)
+	}
+	return pool, nil
+}
+
+// pick returns the next proxy that isn't benched. When every proxy is
+// benched it returns the one due back soonest rather than stalling.
+func (p *proxyPool) pick() *proxyClient {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var soonest *proxyClient
+	for range p.clients {
+		pc := p.clients[p.next]
+		p.next = (p.next + 1) % len(p.clients)
+		if now.After(pc.benchedUntil) {
+			return pc
+		}
+		if soonest == nil || pc.benchedUntil.Before(soonest.benchedUntil) {
+			soonest = pc
+		}
+	}
+	return soonest
+}
+
+// report records the outcome of a request made through pc
+func (p *proxyPool) report(pc *proxyClient, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ok {
+		pc.failures = 0
+		return
+	}
+	pc.failures++
+	if pc.failures >= proxyMaxFailures {
+		pc.failures = 0
+		pc.benchedUntil = time.Now().Add(proxyCooldown)
+		logf("Proxy %s failed repeatedly, dropping it for %s\n", pc.proxy.Host, proxyCooldown)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// queueSaveInterval is the least time between rewrites of the queue file
+// while downloads complete; a crash repeats at most this much finished work
+const queueSaveInterval = time.Second
+
+// queuedDownload is the on-disk form of a pending download
+type queuedDownload struct {
+	Token    string `json:"token,omitempty"`
+	Photo    Photo  `json:"photo"`
+	Key      string `json:"key"`
+	URL      string `json:"url"`
+	Filename string `json:"filename"`
+	Optional bool   `json:"optional,omitempty"`
+}
+
+// downloadQueue tracks the downloads still to do and persists them to path
+// so an interrupted run can pick up without listing the catalog again
+type downloadQueue struct {
+	mu       sync.Mutex
+	path     string
+	pending  []download
+	done     map[string]bool // filenames finished since the queue was built
+	lastSave time.Time
+}
+
+// loadQueue reads the queue at path. A missing file yields an empty queue.
+func loadQueue(path string) (*downloadQueue, error) {
+	q := &downloadQueue{path: path, done: make(map[string]bool)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading queue: %v", err)
+	}
+
+	var items []queuedDownload
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, fmt.Errorf("error parsing queue %s: %v", path, err)
+	}
+	for _, it := range items {
+		photo := it.Photo
+		photo.SourceToken = it.Token
+		q.pending = append(q.pending, download{photo: photo, key: it.Key, url: it.URL, filename: it.Filename, optional: it.Optional})
+	}
+	return q, nil
+}
+
+// reset replaces the queue's contents with downloads and saves it
+func (q *downloadQueue) reset(downloads []download) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending = downloads
+	q.done = make(map[string]bool)
+	return q.saveLocked()
+}
+
+// photos returns each queued photo once, in queue order, with its downloads
+// by photoKey
+func (q *downloadQueue) photos() ([]Photo, map[string][]download) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var photos []Photo
+	byPhoto := make(map[string][]download)
+	for _, d := range q.pending {
+		key := photoKey(d.photo)
+		if _, ok := byPhoto[key]; !ok {
+			photos = append(photos, d.photo)
+		}
+		byPhoto[key] = append(byPhoto[key], d)
+	}
+	return photos, byPhoto
+}
+
+// complete removes d from the queue, saving it if the last save is old enough
+func (q *downloadQueue) complete(d download) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.done[d.filename] = true
+	if time.Since(q.lastSave) >= queueSaveInterval {
+		if err := q.saveLocked(); err != nil {
+			logf("Warning: %v\n", err)
+		}
+	}
+}
+
+// finish writes the final state of the queue, removing the file once
+// nothing is left to download
+func (q *downloadQueue) finish() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.done) == len(q.pending) {
+		if err := os.Remove(q.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing queue: %v", err)
+		}
+		return nil
+	}
+	return q.saveLocked()
+}
+
+// saveLocked atomically writes the unfinished downloads to q.path
+func (q *downloadQueue) saveLocked() error {
+	items := make([]queuedDownload, 0, len(q.pending)-len(q.done))
+	for _, d := range q.pending {
+		if q.done[d.filename] {
+			continue
+		}
+		items = append(items, queuedDownload{
+			Token: d.photo.SourceToken, Photo: d.photo, Key: d.key,
+			URL: d.url, Filename: d.filename, Optional: d.optional,
+		})
+	}
+
+	data, err := json.Marshal(items)
+	if err != nil {
+		return fmt.Errorf("error encoding queue: %v", err)
+	}
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("error writing queue: %v", err)
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		return fmt.Errorf("error writing queue: %v", err)
+	}
+	q.lastSave = time.Now()
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter spaces requests evenly at a fixed rate
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// requestLimit paces every API and download request of the run, set by
+// -rps; nil for unlimited
+var requestLimit *rateLimiter
+
+// newRateLimiter allows rps requests per second
+func newRateLimiter(rps float64) *rateLimiter {
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / rps)}
+}
+
+// wait blocks until the next request may start, or the run is canceled. A
+// nil rateLimiter never waits.
+func (l *rateLimiter) wait() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+	sleep(delay)
+}
+
+// retryAfter returns the pause a Retry-After header on resp asks for, given
+// either as seconds or as an HTTP date
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(v); err == nil {
+		return max(time.Until(at), 0), true
+	}
+	return 0, false
+}
+
+// hostLimits keeps a separate rate limiter for each host, so a slow limit on
+// one server does not throttle downloads from another
+type hostLimits struct {
+	mu       sync.Mutex
+	rps      map[string]float64 // requests per second by host; "*" covers the rest
+	limiters map[string]*rateLimiter
+}
+
+// parseHostLimits parses host=rps entries as given to -host-rps
+func parseHostLimits(entries []string) (*hostLimits, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	h := &hostLimits{rps: make(map[string]float64), limiters: make(map[string]*rateLimiter)}
+	for _, e := range entries {
+		host, value, ok := strings.Cut(e, "=")
+		rps, err := strconv.ParseFloat(value, 64)
+		if !ok || host == "" || err != nil || rps <= 0 {
+			return nil, fmt.Errorf("invalid -host-rps %q, expected host=requests-per-second", e)
+		}
+		h.rps[strings.ToLower(host)] = rps
+	}
+	return h, nil
+}
+
+// wait blocks until a request to host is allowed. Hosts without a limit, and
+// a nil hostLimits, never wait.
+func (h *hostLimits) wait(host string) {
+	if h == nil {
+		return
+	}
+	host = strings.ToLower(host)
+	h.mu.Lock()
+	l, ok := h.limiters[host]
+	if !ok {
+		rps, limited := h.rps[host]
+		if !limited {
+			rps, limited = h.rps["*"]
+		}
+		if limited {
+			l = newRateLimiter(rps)
+		}
+		h.limiters[host] = l
+	}
+	h.mu.Unlock()
+	l.wait()
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/jpeg"
+	"os"
+)
+
+// recompress re-encodes the JPEG at path at quality, keeping its metadata,
+// and returns its size before and after. The file is left alone when the
+// re-encode would not be smaller.
+func recompress(path string, quality int) (before, after int64, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	before = int64(len(data))
+	segments, _, err := splitJPEG(data)
+	if err != nil {
+		return before, before, err
+	}
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return before, before, fmt.Errorf("error decoding image: %v", err)
+	}
+
+	out, err := encodeKeepingSegments(img, segments, quality)
+	if err != nil {
+		return before, before, err
+	}
+	if int64(len(out)) >= before {
+		return before, before, nil
+	}
+	if err := replaceFile(path, out); err != nil {
+		return before, before, err
+	}
+	return before, int64(len(out)), nil
+}
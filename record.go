@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// recordImageSample is how many image responses -record keeps; API responses
+// are always kept
+const recordImageSample = 20
+
+// fixtureMeta describes a recorded response, stored next to its body
+type fixtureMeta struct {
+	URL         string `json:"url"` // with tokenId removed
+	Status      int    `json:"status"`
+	ContentType string `json:"contentType"`
+}
+
+// fixtureKey identifies a request independently of the token it was made with
+func fixtureKey(req *http.Request) (string, string) {
+	u := *req.URL
+	q := u.Query()
+	q.Del("tokenId")
+	u.RawQuery = q.Encode()
+	redacted := u.String()
+
+	sum := sha256.Sum256([]byte(req.Method + " " + redacted))
+	return hex.EncodeToString(sum[:8]), redacted
+}
+
+// recordingTransport saves API responses and a sample of images to dir
+type recordingTransport struct {
+	base http.RoundTripper
+	dir  string
+
+	mu     sync.Mutex
+	images int
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || req.Method != http.MethodGet {
+		return resp, err
+	}
+
+	isAPI := strings.HasPrefix(req.URL.String(), apiBaseURL)
+	if !isAPI {
+		t.mu.Lock()
+		keep := t.images < recordImageSample
+		if keep {
+			t.images++
+		}
+		t.mu.Unlock()
+		if !keep {
+			return resp, nil
+		}
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	key, redacted := fixtureKey(req)
+	meta, _ := json.MarshalIndent(fixtureMeta{URL: redacted, Status: resp.StatusCode, ContentType: resp.Header.Get("Content-Type")}, "", "  ")
+	if err := os.WriteFile(filepath.Join(t.dir, key+".body"), body, 0644); err != nil {
+		logf("Error recording %s: %v\n", redacted, err)
+	} else {
+		os.WriteFile(filepath.Join(t.dir, key+".meta.json"), meta, 0644)
+	}
+	return resp, nil
+}
+
+// replayTransport answers requests from responses saved by -record
+type replayTransport struct {
+	dir string
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, redacted := fixtureKey(req)
+	resp := &http.Response{
+		Request:    req,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+	}
+
+	body, err := os.ReadFile(filepath.Join(t.dir, key+".body"))
+	if err != nil {
+		resp.StatusCode = http.StatusNotFound
+		resp.Status = "404 Not Found"
+		resp.Body = io.NopCloser(strings.NewReader("not recorded: " + redacted))
+		return resp, nil
+	}
+
+	var meta fixtureMeta
+	if data, err := os.ReadFile(filepath.Join(t.dir, key+".meta.json")); err == nil {
+		json.Unmarshal(data, &meta)
+	}
+	if meta.Status == 0 {
+		meta.Status = http.StatusOK
+	}
+	resp.StatusCode = meta.Status
+	resp.Status = fmt.Sprintf("%d %s", meta.Status, http.StatusText(meta.Status))
+	if meta.ContentType != "" {
+		resp.Header.Set("Content-Type", meta.ContentType)
+	}
+	resp.ContentLength = int64(len(body))
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// fixtureTransport returns the transport for -record or -replay, wrapping base
+func fixtureTransport(base http.RoundTripper, recordDir, replayDir string) (http.RoundTripper, error) {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	switch {
+	case replayDir != "":
+		if _, err := os.Stat(replayDir); err != nil {
+			return nil, fmt.Errorf("error opening replay directory: %v", err)
+		}
+		return &replayTransport{dir: replayDir}, nil
+	case recordDir != "":
+		if err := os.MkdirAll(recordDir, 0755); err != nil {
+			return nil, fmt.Errorf("error creating record directory: %v", err)
+		}
+		return &recordingTransport{base: base, dir: recordDir}, nil
+	}
+	return base, nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// defaultMaxRedirects matches what net/http follows on its own
+const defaultMaxRedirects = 10
+
+// limitRedirects returns a CheckRedirect policy that follows at most max
+// redirects and stops at the first one leading back to a URL already visited
+func limitRedirects(max int) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		for _, prev := range via {
+			if prev.URL.String() == req.URL.String() {
+				return fmt.Errorf("redirect loop: led back to %s", req.URL.Redacted())
+			}
+		}
+		if len(via) > max {
+			if max == 0 {
+				return fmt.Errorf("redirected to %s, following redirects is disabled by -max-redirects 0", req.URL.Redacted())
+			}
+			return fmt.Errorf("stopped after %d redirects, at %s", max, req.URL.Redacted())
+		}
+		return nil
+	}
+}
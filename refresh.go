@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// refreshInterval is the least time between catalog re-listings for one token
+const refreshInterval = 30 * time.Second
+
+// expiryMarkers are fragments of 403 bodies returned by storage services when
+// a signed URL has expired
+var expiryMarkers = []string{"expired", "signature", "not valid in the specified time"}
+
+// signedURLParams are query parameters that mark a URL as presigned
+var signedURLParams = []string{"X-Amz-Expires", "X-Amz-Signature", "Expires=", "Signature=", "se=", "sig="}
+
+// statusError reports an unexpected HTTP status from a download
+type statusError struct {
+	code    int
+	expired bool           // a 403 that looks like an expired URL signature
+	resp    *http.Response // the response carrying the status, body already closed
+}
+
+func (e *statusError) Error() string {
+	if e.expired {
+		return fmt.Sprintf("received non-200 status code: %d (signed URL expired)", e.code)
+	}
+	return fmt.Sprintf("received non-200 status code: %d", e.code)
+}
+
+// looksExpired reports whether a 403 for url with the given body is due to an
+// expired signature rather than a genuine permission problem
+func looksExpired(url string, body []byte) bool {
+	text := strings.ToLower(string(body))
+	for _, m := range expiryMarkers {
+		if strings.Contains(text, m) {
+			return true
+		}
+	}
+	for _, p := range signedURLParams {
+		if strings.Contains(url, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// urlRefresher re-lists a token's catalog to obtain fresh signed URLs for
+// photos whose queued URLs expired
+type urlRefresher struct {
+	list listFunc
+
+	mu       sync.Mutex
+	listedAt map[string]time.Time // token -> last listing
+	photos   map[string]Photo     // photoKey -> newest metadata
+}
+
+func newURLRefresher(list listFunc) *urlRefresher {
+	return &urlRefresher{
+		list:     list,
+		listedAt: make(map[string]time.Time),
+		photos:   make(map[string]Photo),
+	}
+}
+
+// refresh returns up-to-date metadata for photo, re-listing its token's
+// whole catalog unless that was done recently, so photos past the first page
+// and others expiring soon after are covered by the same listing
+func (r *urlRefresher) refresh(photo Photo) (Photo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.listedAt[photo.SourceToken]) > refreshInterval {
+		_, err := fetchPages(photo.SourceToken, r.list, nil, func(page []Photo) {
+			for _, p := range page {
+				p.SourceToken = photo.SourceToken
+				r.photos[photoKey(p)] = p
+			}
+		})
+		if err != nil {
+			return photo, fmt.Errorf("error refreshing photo metadata: %v", err)
+		}
+		r.listedAt[photo.SourceToken] = time.Now()
+	}
+
+	fresh, ok := r.photos[photoKey(photo)]
+	if !ok {
+		return photo, fmt.Errorf("photo %s is no longer listed", photo.PhotoCode)
+	}
+	return fresh, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// pagedList serves n photos, id0 to id<n-1>, pageLimit to a page, with
+// fresh URLs, and counts the pages asked for. Pages from failFrom on fail
+// with err; with failFrom 0 every page does.
+type pagedList struct {
+	n        int
+	err      error
+	failFrom int
+	pages    int
+	first    int // first page asked for
+}
+
+func (l *pagedList) list(ctx context.Context, token string, page, limit int) (*APIResponse, error) {
+	l.pages++
+	if l.first == 0 {
+		l.first = page
+	}
+	if l.err != nil && page >= l.failFrom {
+		return nil, l.err
+	}
+	resp := &APIResponse{Status: 200}
+	for i := (page - 1) * limit; i < min(page*limit, l.n); i++ {
+		p := Photo{ID: fmt.Sprintf("id%d", i), PhotoCode: fmt.Sprintf("CODE%d", i)}
+		p.Thumbnail.X1024 = ThumbnailSize{URL: fmt.Sprintf("https://cdn.example.com/%d.jpg?sig=fresh", i)}
+		resp.Result.Photos = append(resp.Result.Photos, p)
+	}
+	return resp, nil
+}
+
+// withPageLimit lists n photos to a page for the rest of the test
+func withPageLimit(t *testing.T, n int) {
+	prev := pageLimit
+	pageLimit = n
+	t.Cleanup(func() { pageLimit = prev })
+}
+
+func TestURLRefresher(t *testing.T) {
+	withPageLimit(t, 2)
+	tests := []struct {
+		name    string
+		listed  int // photos in the catalog
+		id      string
+		listErr error
+		wantErr bool
+	}{
+		{name: "first page", listed: 5, id: "id1"},
+		{name: "past the first page", listed: 5, id: "id4"},
+		{name: "no longer listed", listed: 5, id: "id9", wantErr: true},
+		{name: "listing fails", listed: 5, id: "id1", listErr: errors.New("connection reset"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &pagedList{n: tt.listed, err: tt.listErr}
+			r := newURLRefresher(l.list)
+			photo := Photo{ID: tt.id, SourceToken: "tok"}
+
+			fresh, err := r.refresh(photo)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("refresh = %+v, want an error", fresh)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if fresh.Thumbnail.X1024.URL == "" || fresh.SourceToken != "tok" {
+				t.Errorf("refresh = %+v, want the fresh listing tagged with its token", fresh)
+			}
+
+			// A second photo soon after is served from the same listing
+			pages := l.pages
+			if _, err := r.refresh(Photo{ID: "id0", SourceToken: "tok"}); err != nil {
+				t.Errorf("second refresh: %v", err)
+			}
+			if l.pages != pages {
+				t.Errorf("second refresh listed %d more pages, want none", l.pages-pages)
+			}
+		})
+	}
+}
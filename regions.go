@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// region is one PhotoPass deployment: the API listing its photos and the
+// CDN serving their images
+type region struct {
+	api  string
+	cdn  string
+	zone string // IANA time zone of the parks, used for shoot dates; empty if unknown
+}
+
+// defaultRegion serves tokens given without a region: prefix
+const defaultRegion = "hk"
+
+// regions maps a name used in -token region:tokenId to its endpoints.
+// -region adds more.
+var regions = map[string]region{
+	defaultRegion: {api: apiBaseURL, cdn: baseURL, zone: "Asia/Hong_Kong"},
+}
+
+// addRegions registers the name=apiURL,cdnURL[,zone] entries given to -region
+func addRegions(entries url.Values) error {
+	for name, values := range entries {
+		for _, v := range values {
+			parts := strings.Split(v, ",")
+			if len(parts) < 2 || len(parts) > 3 || !isHTTPURL(parts[0]) || !isHTTPURL(parts[1]) {
+				return fmt.Errorf("invalid -region %s=%s, expected name=apiURL,cdnURL[,zone]", name, v)
+			}
+			r := region{api: strings.TrimRight(parts[0], "/") + "/", cdn: strings.TrimRight(parts[1], "/") + "/"}
+			if len(parts) == 3 {
+				if _, err := time.LoadLocation(parts[2]); err != nil {
+					return fmt.Errorf("invalid time zone in -region %s: %v", name, err)
+				}
+				r.zone = parts[2]
+			}
+			regions[name] = r
+		}
+	}
+	return nil
+}
+
+// tokensZone returns the time zone shared by the regions of tokens, or ""
+// when they differ or it is not known
+func tokensZone(tokens []string) string {
+	zone := ""
+	for i, token := range tokens {
+		z := tokenRegion(token).zone
+		if i > 0 && z != zone {
+			return ""
+		}
+		zone = z
+	}
+	return zone
+}
+
+// isHTTPURL reports whether s is an absolute http or https URL
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// splitToken separates the region: prefix of token from the tokenId sent to
+// the API. Tokens without a prefix belong to defaultRegion.
+func splitToken(token string) (name, id string) {
+	if name, id, ok := strings.Cut(token, ":"); ok {
+		return name, id
+	}
+	return defaultRegion, token
+}
+
+// tokenRegion returns the endpoints for token
+func tokenRegion(token string) region {
+	name, _ := splitToken(token)
+	if r, ok := regions[name]; ok {
+		return r
+	}
+	return regions[defaultRegion]
+}
+
+// checkTokenRegions fails when a token names a region that is not known
+func checkTokenRegions(tokens []string) error {
+	for _, token := range tokens {
+		if name, _ := splitToken(token); regions[name] == (region{}) {
+			return fmt.Errorf("token %s names unknown region %q (known: %s); add it with -region", tokenLabel(token), name, strings.Join(regionNames(), ", "))
+		}
+	}
+	return nil
+}
+
+// regionNames lists the known regions in order
+func regionNames() []string {
+	var names []string
+	for name := range regions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// photoRegion names the region photo was listed from
+func photoRegion(photo Photo) string {
+	name, _ := splitToken(photo.SourceToken)
+	return name
+}
+
+// regionKey identifies photo id of the named region. IDs may repeat across
+// regions, so anything remembered per photo is keyed by this.
+func regionKey(region, id string) string {
+	return region + "/" + id
+}
+
+// photoKey is the regionKey of photo
+func photoKey(photo Photo) string {
+	return regionKey(photoRegion(photo), photo.ID)
+}
+
+// isAPIURL reports whether u is under the API of any known region
+func isAPIURL(u string) bool {
+	for _, r := range regions {
+		if strings.HasPrefix(u, r.api) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// s3Sink uploads downloads to a bucket under a key prefix. Large files are
+// sent as multipart uploads by the upload manager.
+type s3Sink struct {
+	uploader *manager.Uploader
+	bucket   string
+	prefix   string
+}
+
+// newS3Sink connects to the bucket named by target, "bucket" or
+// "bucket/prefix", with credentials from the standard AWS chain
+// (environment, shared config and profile, or instance role)
+func newS3Sink(target string) (*s3Sink, error) {
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(target, "s3://"), "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("invalid -s3 %q, expected bucket or bucket/prefix", target)
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("error loading AWS configuration: %v", err)
+	}
+	return &s3Sink{
+		uploader: manager.NewUploader(s3.NewFromConfig(cfg)),
+		bucket:   bucket,
+		prefix:   strings.Trim(prefix, "/"),
+	}, nil
+}
+
+// add uploads one file as it is read from body, keyed by its name under the
+// prefix. The upload manager buffers one part at a time.
+func (s *s3Sink) add(name string, modTime time.Time, body io.Reader) error {
+	key := path.Join(s.prefix, filepath.ToSlash(name))
+	br := bufio.NewReaderSize(body, sniffLen)
+	head, _ := br.Peek(sniffLen)
+	_, err := s.uploader.Upload(runCtx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        br,
+		ContentType: aws.String(http.DetectContentType(head)),
+		Metadata:    map[string]string{"shoot-time": modTime.UTC().Format(time.RFC3339)},
+	})
+	if err != nil {
+		return fmt.Errorf("error uploading s3://%s/%s: %v", s.bucket, key, err)
+	}
+	return nil
+}
+
+// Close is a no-op; every upload completes within add
+func (s *s3Sink) Close() error {
+	return nil
+}
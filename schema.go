@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// schemaCheck compares API responses with the fields APIResponse expects and
+// warns once per run about each field that is new, missing or of another
+// type, so a change to the API shows up before it leaves fields empty
+type schemaCheck struct {
+	mu     sync.Mutex
+	warned map[string]bool
+}
+
+// responseSchema is set by -validate-schema; nil skips the check
+var responseSchema *schemaCheck
+
+// unmarshalerType is implemented by fields such as FlexTime that accept
+// several JSON types, so their type is not checked
+var unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// check reports the differences between body and APIResponse
+func (c *schemaCheck) check(body []byte) {
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return
+	}
+	present := make(map[string]bool)
+	var problems []string
+	walkSchema(doc, reflect.TypeOf(APIResponse{}), "", present, &problems)
+	missingFields(reflect.TypeOf(APIResponse{}), "", present, &problems)
+
+	sort.Strings(problems)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, p := range problems {
+		if !c.warned[p] {
+			c.warned[p] = true
+			logf("Warning: API response %s\n", p)
+		}
+	}
+}
+
+// walkSchema checks value against t, recording the paths of the fields seen
+func walkSchema(value interface{}, t reflect.Type, path string, present map[string]bool, problems *[]string) {
+	if value == nil || t.Kind() == reflect.Interface || reflect.PointerTo(t).Implements(unmarshalerType) {
+		return
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if t.Kind() != reflect.Struct {
+			*problems = append(*problems, "field "+path+" is an object, expected "+jsonKind(t))
+			return
+		}
+		fields := jsonFields(t)
+		for key, child := range v {
+			field, ok := fields[key]
+			if !ok {
+				*problems = append(*problems, "has new field "+joinPath(path, key))
+				continue
+			}
+			present[joinPath(path, key)] = true
+			walkSchema(child, field.Type, joinPath(path, key), present, problems)
+		}
+	case []interface{}:
+		if t.Kind() != reflect.Slice {
+			*problems = append(*problems, "field "+path+" is an array, expected "+jsonKind(t))
+			return
+		}
+		for _, elem := range v {
+			present[path+"[]"] = true
+			walkSchema(elem, t.Elem(), path+"[]", present, problems)
+		}
+	default:
+		if kind := jsonKindOf(value); kind != jsonKind(t) {
+			*problems = append(*problems, "field "+path+" is a "+kind+", expected "+jsonKind(t))
+		}
+	}
+}
+
+// missingFields reports the fields of t that no response object carried,
+// looking only inside objects, and arrays with elements, that were present
+func missingFields(t reflect.Type, path string, present map[string]bool, problems *[]string) {
+	for t.Kind() == reflect.Slice {
+		t = t.Elem()
+		path += "[]"
+	}
+	if t.Kind() != reflect.Struct || reflect.PointerTo(t).Implements(unmarshalerType) {
+		return
+	}
+	if path != "" && !present[path] {
+		return
+	}
+	for name, field := range jsonFields(t) {
+		child := joinPath(path, name)
+		if !present[child] {
+			*problems = append(*problems, "is missing field "+child)
+			continue
+		}
+		missingFields(field.Type, child, present, problems)
+	}
+}
+
+// jsonFields maps the JSON names of t's fields to the fields
+func jsonFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" || !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f
+	}
+	return fields
+}
+
+// joinPath appends key to a dotted field path
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// jsonKind names the JSON type a field of type t decodes from
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	}
+	return "object"
+}
+
+// jsonKindOf names the JSON type of a decoded scalar
+func jsonKindOf(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	}
+	return "object"
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// sharedURLs tracks URLs planned for more than one download in a run, such
+// as assets shared between photos, so each is only fetched once
+type sharedURLs struct {
+	flights singleflight.Group
+
+	mu        sync.Mutex
+	owners    map[string]map[string]bool // url -> photo ID and key of each download of it
+	snapshots []string                   // copies of shared downloads, removed at the end of the run
+	seq       int
+}
+
+// newSharedURLs returns an empty tracker
+func newSharedURLs() *sharedURLs {
+	return &sharedURLs{owners: make(map[string]map[string]bool)}
+}
+
+// plan notes that d downloads its URL
+func (s *sharedURLs) plan(d download) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.owners[d.url] == nil {
+		s.owners[d.url] = make(map[string]bool)
+	}
+	s.owners[d.url][photoKey(d.photo)+"/"+d.key] = true
+}
+
+// shared reports whether more than one download of the run uses url
+func (s *sharedURLs) shared(url string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.owners[url]) > 1
+}
+
+// snapshot hard links, or failing that copies, the freshly downloaded path to
+// a hidden file the other downloads of its URL copy from. Post-processing
+// replaces files rather than rewriting them, so the link keeps the bytes as served.
+func (s *sharedURLs) snapshot(url, path string) (string, error) {
+	s.mu.Lock()
+	s.seq++
+	sum := sha256.Sum256([]byte(url))
+	name := filepath.Join(outputDir, fmt.Sprintf(".shared-%s-%d", hex.EncodeToString(sum[:8]), s.seq))
+	s.snapshots = append(s.snapshots, name)
+	s.mu.Unlock()
+
+	if err := os.Link(path, name); err == nil {
+		return name, nil
+	}
+	return name, copyFile(path, name)
+}
+
+// cleanup removes the snapshots once every download has finished
+func (s *sharedURLs) cleanup() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range s.snapshots {
+		os.Remove(name)
+	}
+	s.snapshots = nil
+}
+
+// copyFile copies src to dst through a .part file, keeping src's modification time
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	part := dst + partSuffix
+	out, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(part, dst)
+	}
+	if err != nil {
+		os.Remove(part)
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// flight is the outcome of one fetch of a shared URL
+type flight struct {
+	target   string // where the fetching download saved it
+	snapshot string // copy for the other downloads, empty if none was made
+	got      fetched
+}
+
+// fetchShared is fetchWithRetry for a URL other downloads of the run may
+// also want. While it is in flight, they wait for it and copy the result
+// instead of fetching it again.
+func (pd *PhotoDownloader) fetchShared(url, target string, cond validators, fallback time.Time, want dimensions) (fetched, error) {
+	if !pd.sharedURLs.shared(url) {
+		return pd.fetchWithRetry(url, target, cond, fallback, want)
+	}
+	v, err, _ := pd.sharedURLs.flights.Do(url, func() (interface{}, error) {
+		got, err := pd.fetchWithRetry(url, target, cond, fallback, want)
+		f := flight{target: target, got: got}
+		if err == nil {
+			if f.snapshot, err = pd.sharedURLs.snapshot(url, target); err != nil {
+				logf("Could not keep %s for other downloads of the same URL: %v\n", target, err)
+				f.snapshot, err = "", nil
+			}
+		}
+		return f, err
+	})
+	f := v.(flight)
+	if f.target == target {
+		return f.got, err
+	}
+	// Whether the other download's copy was current says nothing about this one
+	if err == errNotModified || (err == nil && f.snapshot == "") {
+		return pd.fetchWithRetry(url, target, cond, fallback, want)
+	}
+	if err != nil {
+		return fetched{attempts: f.got.attempts}, err
+	}
+	if err := copyFile(f.snapshot, target); err != nil {
+		return fetched{}, fmt.Errorf("error copying shared download: %v", err)
+	}
+	logf("Reused the download of %s for %s\n", filepath.Base(f.target), filepath.Base(target))
+	got := f.got
+	got.attempts = 0 // nothing was requested for this file
+	return got, nil
+}
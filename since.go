@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// sinceIDName is the file in outputDir holding the newest photo ID of each
+// token as of the last fully successful -since-id or -auto-since run
+const sinceIDName = ".since-id.json"
+
+// sinceMarker stops each token's listing at the photo it was told to stop
+// at, relying on the API listing newest first, and remembers the newest
+// photo it saw for the next run
+type sinceMarker struct {
+	mu     sync.Mutex
+	path   string
+	all    string            // -since-id, applied to every token
+	since  map[string]string // per token, loaded from path
+	newest map[string]string // first photo of each token's listing this run
+	found  map[string]bool   // tokens whose listing reached their marker
+}
+
+// loadSinceMarker stops at id for every token, or with id empty at the IDs
+// saved in path; a missing file means every token is listed in full
+func loadSinceMarker(path, id string) (*sinceMarker, error) {
+	m := &sinceMarker{path: path, all: id, since: make(map[string]string), newest: make(map[string]string), found: make(map[string]bool)}
+	if id != "" {
+		return m, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading since ID: %v", err)
+	}
+	if err := json.Unmarshal(data, &m.since); err != nil {
+		return nil, fmt.Errorf("error parsing since ID in %s: %v", path, err)
+	}
+	return m, nil
+}
+
+// marker returns the ID token's listing stops at, if any
+func (m *sinceMarker) marker(token string) string {
+	if m.all != "" {
+		return m.all
+	}
+	return m.since[token]
+}
+
+// list wraps list so a page is cut off at token's marker. The short page
+// that leaves ends the listing as if it were the last one.
+func (m *sinceMarker) list(list listFunc) listFunc {
+	return func(ctx context.Context, token string, page, limit int) (*APIResponse, error) {
+		resp, err := list(ctx, token, page, limit)
+		if err != nil {
+			return resp, err
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		photos := resp.Result.Photos
+		if page == 1 && len(photos) > 0 {
+			m.newest[token] = photos[0].ID
+		}
+		stop := m.marker(token)
+		if stop == "" || m.found[token] {
+			return resp, nil
+		}
+		for i, p := range photos {
+			if p.ID == stop {
+				logf("Reached photo %s for token %s, the rest was listed before\n", stop, tokenLabel(token))
+				m.found[token] = true
+				resp.Result.Photos = photos[:i]
+				break
+			}
+		}
+		return resp, nil
+	}
+}
+
+// save records the newest photo of every token for the next -auto-since
+// run. Tokens whose listing came back empty keep their previous marker.
+func (m *sinceMarker) save(tokens []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	saved := make(map[string]string)
+	if data, err := os.ReadFile(m.path); err == nil {
+		json.Unmarshal(data, &saved)
+	}
+	for _, token := range tokens {
+		if stop := m.marker(token); stop != "" && !m.found[token] {
+			logf("Warning: photo %s was not in the listing of token %s, so everything was listed\n", stop, tokenLabel(token))
+		}
+		if id, ok := m.newest[token]; ok {
+			saved[token] = id
+		}
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding since ID: %v", err)
+	}
+	if err := os.WriteFile(m.path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error saving since ID: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// thumbnailVariant maps a size name to its field on Thumbnail and the suffix
+// used in filenames for it
+type thumbnailVariant struct {
+	name   string // size name as used by the API and on the command line
+	suffix string // filename suffix, distinct for every variant
+	get    func(Thumbnail) ThumbnailSize
+}
+
+// thumbnailVariants lists every variant declared on Thumbnail, smallest first
+var thumbnailVariants = []thumbnailVariant{
+	{"x128", "128x", func(t Thumbnail) ThumbnailSize { return t.X128 }},
+	{"w512", "512w", func(t Thumbnail) ThumbnailSize { return t.W512 }},
+	{"x512", "512x", func(t Thumbnail) ThumbnailSize { return t.X512 }},
+	{"x1024", "1024x", func(t Thumbnail) ThumbnailSize { return t.X1024 }},
+}
+
+// lookupVariant returns the variant called name
+func lookupVariant(name string) (thumbnailVariant, bool) {
+	for _, v := range thumbnailVariants {
+		if v.name == name {
+			return v, true
+		}
+	}
+	return thumbnailVariant{}, false
+}
+
+// pickByWidth returns the name of the narrowest populated variant at least
+// width pixels wide, or the widest populated variant if none is wide enough.
+// When keep is set, variants it rejects are not considered.
+func pickByWidth(t Thumbnail, width int, keep func(ThumbnailSize) bool) (string, bool) {
+	var best, widest *ThumbnailSize
+	var bestName, widestName string
+	for _, v := range thumbnailVariants {
+		ts := v.get(t)
+		if ts.URL == "" || (keep != nil && !keep(ts)) {
+			continue
+		}
+		if widest == nil || ts.Width > widest.Width {
+			widest, widestName = &ts, v.name
+		}
+		if ts.Width >= width && (best == nil || ts.Width < best.Width) {
+			best, bestName = &ts, v.name
+		}
+	}
+	if best != nil {
+		return bestName, true
+	}
+	return widestName, widest != nil
+}
+
+// originalSize is the pseudo-size for the full-resolution OriginalInfo.URL
+const originalSize = "original"
+
+// parseSizes splits a comma-separated -sizes value, rejecting names that are
+// neither a thumbnail variant nor original
+func parseSizes(value string) ([]string, error) {
+	var sizes []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		if _, ok := lookupVariant(name); !ok && name != originalSize {
+			var names []string
+			for _, v := range thumbnailVariants {
+				names = append(names, v.name)
+			}
+			return nil, fmt.Errorf("unknown size %q in -sizes, expected %s or %s", name, strings.Join(names, ", "), originalSize)
+		}
+		seen[name] = true
+		sizes = append(sizes, name)
+	}
+	if len(sizes) == 0 {
+		return nil, fmt.Errorf("-sizes lists no sizes")
+	}
+	return sizes, nil
+}
+
+// originalAvailable reports whether photo lists an original the account may
+// download, i.e. one that is paid for or otherwise allowed
+func originalAvailable(photo Photo) bool {
+	return photo.OriginalInfo.URL != "" && (photo.IsPaid || photo.AllowDownload)
+}
+
+// largestThumbnail returns the name of the widest thumbnail photo has
+func largestThumbnail(photo Photo) (string, bool) {
+	return pickByWidth(photo.Thumbnail, math.MaxInt, nil)
+}
+
+// aspectTolerance is how far a variant's aspect ratio may be from the
+// original's, relative to it, before the variant counts as cropped
+const aspectTolerance = 0.02
+
+// fullFrame returns a filter accepting the thumbnails of photo that have the
+// aspect ratio of its original. It accepts everything when the original's
+// dimensions are unknown, and any variant whose own dimensions are.
+func fullFrame(photo Photo) func(ThumbnailSize) bool {
+	w, h := photo.OriginalInfo.Width, photo.OriginalInfo.Height
+	if w <= 0 || h <= 0 {
+		return nil
+	}
+	want := float64(w) / float64(h)
+	return func(ts ThumbnailSize) bool {
+		if ts.Width <= 0 || ts.Height <= 0 {
+			return true
+		}
+		return math.Abs(float64(ts.Width)/float64(ts.Height)-want) <= want*aspectTolerance
+	}
+}
+
+// sizeURL returns the URL for size on photo and the filename suffix for it.
+// ok is false for unknown sizes; url is empty when the photo lacks the size.
+func sizeURL(photo Photo, size string) (url, suffix string, ok bool) {
+	if size == originalSize {
+		if photo.OriginalInfo.URL == "" {
+			return "", originalSize, true
+		}
+		return assetURL(photo, photo.OriginalInfo.URL), originalSize, true
+	}
+
+	variant, ok := lookupVariant(size)
+	if !ok {
+		return "", "", false
+	}
+	if u := variant.get(photo.Thumbnail).URL; u != "" {
+		return assetURL(photo, u), variant.suffix, true
+	}
+	return "", variant.suffix, true
+}
+
+// availableSizes lists every thumbnail variant photo has a URL for, smallest
+// first, followed by original when withOriginal is set and it has one
+func availableSizes(photo Photo, withOriginal bool) []string {
+	var sizes []string
+	for _, v := range thumbnailVariants {
+		if v.get(photo.Thumbnail).URL != "" {
+			sizes = append(sizes, v.name)
+		}
+	}
+	if withOriginal && photo.OriginalInfo.URL != "" {
+		sizes = append(sizes, originalSize)
+	}
+	return sizes
+}
+
+// assetURL resolves an asset path of photo from the API against the CDN of
+// its region. The path may already be absolute.
+func assetURL(photo Photo, u string) string {
+	if strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") {
+		return u
+	}
+	return joinURL(tokenRegion(photo.SourceToken).cdn, u)
+}
+
+// joinURL appends path to base with exactly one slash between them, whether
+// or not base ends or path starts with one. Unlike url.JoinPath it leaves any
+// query string on path untouched.
+func joinURL(base, path string) string {
+	return strings.TrimRight(base, "/") + "/" + strings.TrimLeft(path, "/")
+}
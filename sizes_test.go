@@ -0,0 +1,110 @@
+package main
+
+import "testing"
+
+func TestLookupVariant(t *testing.T) {
+	photo := Photo{}
+	photo.Thumbnail.X512 = ThumbnailSize{URL: "x512.jpg", Width: 512}
+	photo.Thumbnail.W512 = ThumbnailSize{URL: "w512.jpg", Width: 512}
+
+	tests := []struct {
+		name string
+		ok   bool
+		url  string
+	}{
+		{"x128", true, ""},
+		{"x512", true, "x512.jpg"},
+		{"w512", true, "w512.jpg"},
+		{"x1024", true, ""},
+		{"original", false, ""},
+		{"x2048", false, ""},
+	}
+	for _, tt := range tests {
+		v, ok := lookupVariant(tt.name)
+		if ok != tt.ok {
+			t.Errorf("lookupVariant(%q) ok = %v, want %v", tt.name, ok, tt.ok)
+			continue
+		}
+		if ok && v.get(photo.Thumbnail).URL != tt.url {
+			t.Errorf("lookupVariant(%q) reads URL %q, want %q", tt.name, v.get(photo.Thumbnail).URL, tt.url)
+		}
+	}
+}
+
+func TestPickByWidth(t *testing.T) {
+	full := Thumbnail{
+		X128:  ThumbnailSize{URL: "a", Width: 128, Height: 96},
+		W512:  ThumbnailSize{URL: "b", Width: 512, Height: 512},
+		X512:  ThumbnailSize{URL: "c", Width: 512, Height: 384},
+		X1024: ThumbnailSize{URL: "d", Width: 1024, Height: 768},
+	}
+	noLarge := full
+	noLarge.X1024 = ThumbnailSize{}
+	wide := func(ts ThumbnailSize) bool { return ts.Width != ts.Height }
+
+	tests := []struct {
+		name  string
+		t     Thumbnail
+		width int
+		keep  func(ThumbnailSize) bool
+		want  string
+		ok    bool
+	}{
+		{"narrowest wide enough", full, 300, nil, "w512", true},
+		{"exact width", full, 128, nil, "x128", true},
+		{"larger than any", full, 4000, nil, "x1024", true},
+		{"missing variant skipped", noLarge, 600, nil, "w512", true},
+		{"keep rejects square", full, 300, wide, "x512", true},
+		{"none populated", Thumbnail{}, 100, nil, "", false},
+	}
+	for _, tt := range tests {
+		got, ok := pickByWidth(tt.t, tt.width, tt.keep)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: pickByWidth(%d) = %q, %v, want %q, %v", tt.name, tt.width, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestJoinURL(t *testing.T) {
+	tests := []struct {
+		base, path, want string
+	}{
+		{"https://cdn.example.com", "media/a.jpg", "https://cdn.example.com/media/a.jpg"},
+		{"https://cdn.example.com/", "media/a.jpg", "https://cdn.example.com/media/a.jpg"},
+		{"https://cdn.example.com", "/media/a.jpg", "https://cdn.example.com/media/a.jpg"},
+		{"https://cdn.example.com/", "/media/a.jpg", "https://cdn.example.com/media/a.jpg"},
+	}
+	for _, tt := range tests {
+		if got := joinURL(tt.base, tt.path); got != tt.want {
+			t.Errorf("joinURL(%q, %q) = %q, want %q", tt.base, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestPlanX512AndW512(t *testing.T) {
+	pd := NewPhotoDownloader(nil)
+	pd.skips = &skipLog{}
+	photo := Photo{ID: "id0", PhotoCode: "CODE0"}
+	photo.Thumbnail.X128 = ThumbnailSize{URL: "https://cdn.example.com/x128.jpg", Width: 128}
+	photo.Thumbnail.W512 = ThumbnailSize{URL: "https://cdn.example.com/w512.jpg", Width: 512}
+	photo.Thumbnail.X512 = ThumbnailSize{URL: "https://cdn.example.com/x512.jpg", Width: 512}
+	photo.Thumbnail.X1024 = ThumbnailSize{URL: "https://cdn.example.com/x1024.jpg", Width: 1024}
+
+	downloads, problems := pd.plan(photo, []string{"x512", "w512"})
+	if len(problems) > 0 {
+		t.Fatalf("problems planning x512 and w512: %v", problems)
+	}
+	want := map[string]struct{ url, filename string }{
+		"x512": {"https://cdn.example.com/x512.jpg", "CODE0_512x.jpg"},
+		"w512": {"https://cdn.example.com/w512.jpg", "CODE0_512w.jpg"},
+	}
+	if len(downloads) != len(want) {
+		t.Fatalf("planned %d downloads, want %d: %+v", len(downloads), len(want), downloads)
+	}
+	for _, d := range downloads {
+		w, ok := want[d.key]
+		if !ok || d.url != w.url || d.filename != w.filename {
+			t.Errorf("planned %s as %s from %s, want %s from %s", d.key, d.filename, d.url, w.filename, w.url)
+		}
+	}
+}
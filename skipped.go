@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// skippedName is the file in outputDir listing why photos were not downloaded
+const skippedName = "skipped.json"
+
+// Reasons a photo or one of its sizes was not downloaded
+const (
+	skipFiltered     = "filtered"       // excluded by a filter flag
+	skipDisabled     = "disabled"       // disabled in the catalog
+	skipExpired      = "expired"        // its expireDate has passed
+	skipExists       = "already-exists" // the local copy is current
+	skipUnavailable  = "unavailable"    // the photo has no URL for the size
+	skipNotPurchased = "not-purchased"  // an original that is neither paid for nor downloadable
+	skipDuplicate    = "duplicate"      // its name is taken by another photo
+	skipNotFound     = "not-found"      // the server no longer has it
+	skipTimeLimit    = "time-limit"     // -max-runtime passed first
+	skipByteLimit    = "byte-limit"     // it would pass -max-total-bytes
+	skipAuth         = "auth-failed"    // the token was refused earlier in the run
+	skipCanceled     = "canceled"       // the run was interrupted first
+	skipNameError    = "name-error"     // -name-template could not name it
+)
+
+// skippedEntry is one photo, or one size of it, that was not downloaded
+type skippedEntry struct {
+	PhotoCode string `json:"photoCode"`
+	Size      string `json:"size,omitempty"`
+	Reason    string `json:"reason"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+// skipLog collects skipped photos from the filters and concurrent downloads
+type skipLog struct {
+	mu      sync.Mutex
+	entries []skippedEntry
+	seen    map[string]bool // region/ID/size/reason of every entry
+}
+
+// add records that size of photo, or the whole photo when size is empty,
+// was skipped. Planning a photo more than once, e.g. to count the downloads
+// up front, records each skip only once. It is a no-op on nil.
+func (l *skipLog) add(photo Photo, size, reason, detail string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := photoKey(photo) + "/" + size + "/" + reason
+	if l.seen[key] {
+		return
+	}
+	if l.seen == nil {
+		l.seen = make(map[string]bool)
+	}
+	l.seen[key] = true
+	l.entries = append(l.entries, skippedEntry{PhotoCode: photo.PhotoCode, Size: size, Reason: reason, Detail: detail})
+}
+
+// dropped records every photo of before that a filter left out of after
+func (l *skipLog) dropped(before, after []Photo, reason, detail string) {
+	if l == nil || len(before) == len(after) {
+		return
+	}
+	kept := make(map[string]bool, len(after))
+	for _, p := range after {
+		kept[photoKey(p)] = true
+	}
+	for _, p := range before {
+		if !kept[photoKey(p)] {
+			l.add(p, "", reason, detail)
+		}
+	}
+}
+
+// write saves the entries, sorted by photo code, with a count per reason
+func (l *skipLog) write(dir string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := make([]skippedEntry, len(l.entries))
+	copy(entries, l.entries)
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].PhotoCode < entries[j].PhotoCode })
+	counts := make(map[string]int)
+	for _, e := range entries {
+		counts[e.Reason]++
+	}
+	data, err := json.MarshalIndent(struct {
+		Counts  map[string]int `json:"counts"`
+		Skipped []skippedEntry `json:"skipped"`
+	}{counts, entries}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding skipped list: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, skippedName), append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing skipped list: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSkipLogRecordsEachSkipOnce(t *testing.T) {
+	pd := NewPhotoDownloader(nil)
+	pd.names = newNameRegistry(collideSuffix)
+	pd.skips = &skipLog{}
+	photo := Photo{ID: "id0", PhotoCode: "CODE0"}
+	photo.Thumbnail.X128 = ThumbnailSize{URL: "https://cdn.example.com/a.jpg"}
+
+	// Counting the downloads plans each photo before processing plans it again
+	for i := 0; i < 2; i++ {
+		pd.plan(photo, []string{"x128", "x1024"})
+	}
+	pd.skips.add(photo, "x128", skipExists, "")
+
+	dir := t.TempDir()
+	if err := pd.skips.write(dir); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, skippedName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Counts  map[string]int `json:"counts"`
+		Skipped []skippedEntry `json:"skipped"`
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Counts[skipUnavailable] != 1 || got.Counts[skipExists] != 1 || len(got.Skipped) != 2 {
+		t.Errorf("skipped.json = %s, want one unavailable x1024 and one already-exists x128", data)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// idleWatch cancels a request once no bytes have arrived for limit, catching
+// half-open connections long before the client timeout would
+type idleWatch struct {
+	limit   time.Duration
+	timer   *time.Timer
+	stalled atomic.Bool
+}
+
+// watchIdle starts the idle timer; cancel is called when it fires
+func watchIdle(limit time.Duration, cancel context.CancelFunc) *idleWatch {
+	w := &idleWatch{limit: limit}
+	w.timer = time.AfterFunc(limit, func() {
+		w.stalled.Store(true)
+		cancel()
+	})
+	return w
+}
+
+// reader wraps r, restarting the idle timer whenever bytes arrive
+func (w *idleWatch) reader(r io.Reader) io.Reader {
+	return readerFunc(func(p []byte) (int, error) {
+		n, err := r.Read(p)
+		if n > 0 {
+			w.timer.Reset(w.limit)
+		}
+		return n, err
+	})
+}
+
+// stop disarms the timer once the download is over
+func (w *idleWatch) stop() {
+	w.timer.Stop()
+}
+
+// explain replaces the cancellation error of a stalled request with one
+// naming the stall
+func (w *idleWatch) explain(err error) error {
+	if err != nil && w.stalled.Load() && errors.Is(err, context.Canceled) {
+		return fmt.Errorf("no data received for %v: %w", w.limit, errStalled)
+	}
+	return err
+}
+
+// errStalled marks a download aborted by -max-idle
+var errStalled = errors.New("download stalled")
+
+// readerFunc adapts a function to io.Reader
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
+
+// sizedDeadline cancels a request after base, then once the response says
+// how large it is, after base plus perMB for each megabyte, so originals get
+// longer than thumbnails
+type sizedDeadline struct {
+	base, perMB time.Duration
+	limit       time.Duration
+	timer       *time.Timer
+	expired     atomic.Bool
+}
+
+// startDeadline arms the base deadline; cancel is called when it passes
+func startDeadline(base, perMB time.Duration, cancel context.CancelFunc) *sizedDeadline {
+	d := &sizedDeadline{base: base, perMB: perMB, limit: base}
+	d.timer = time.AfterFunc(base, func() {
+		d.expired.Store(true)
+		cancel()
+	})
+	return d
+}
+
+// bounded gives req the -timeout-per-mb deadline, which the caller stops once
+// done with the response. Both are returned unchanged when it is not in use,
+// as the client's own timeout applies then.
+func (pd *PhotoDownloader) bounded(req *http.Request) (*http.Request, *sizedDeadline, func()) {
+	if pd.timeoutPerMB <= 0 {
+		return req, nil, func() {}
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	d := startDeadline(pd.timeout, pd.timeoutPerMB, cancel)
+	return req.WithContext(ctx), d, func() {
+		d.stop()
+		cancel()
+	}
+}
+
+// scale extends the deadline for a body of length bytes, counted from now
+func (d *sizedDeadline) scale(length int64) {
+	if d == nil || length <= 0 {
+		return
+	}
+	d.limit = d.base + time.Duration(float64(d.perMB)*float64(length)/(1<<20))
+	d.timer.Reset(d.limit)
+}
+
+// stop disarms the deadline once the download is over
+func (d *sizedDeadline) stop() {
+	d.timer.Stop()
+}
+
+// explain replaces the cancellation error of a request that ran out of time
+// with one giving its limit
+func (d *sizedDeadline) explain(err error) error {
+	if d != nil && err != nil && d.expired.Load() && errors.Is(err, context.Canceled) {
+		return fmt.Errorf("download did not finish within %v: %w", d.limit, context.DeadlineExceeded)
+	}
+	return err
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// streamPhoto writes the first planned size of the photo whose PhotoCode is
+// code to w, failing unless exactly one photo has that code
+func (pd *PhotoDownloader) streamPhoto(photos []Photo, code string, sizes []string, w io.Writer) error {
+	matches, _ := filterPhotos(photos, func(p Photo) bool { return p.PhotoCode == code })
+	switch len(matches) {
+	case 0:
+		return fmt.Errorf("no photo has code %s", code)
+	case 1:
+	default:
+		return fmt.Errorf("%d photos have code %s, expected one", len(matches), code)
+	}
+
+	downloads, problems := pd.plan(matches[0], sizes)
+	if len(downloads) == 0 {
+		if len(problems) > 0 {
+			return fmt.Errorf("%s", problems[0])
+		}
+		return fmt.Errorf("photo %s has no URL for the chosen size", code)
+	}
+
+	d := downloads[0]
+	logf("Writing %s %s to stdout\n", code, d.key)
+	data, err := pd.fetchBytesWithRetry(d.url)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("error writing to stdout: %v", err)
+	}
+	pd.stats.downloaded.Add(1)
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"os"
+)
+
+// iccHeader starts the APP2 segments carrying an ICC colour profile
+var iccHeader = []byte("ICC_PROFILE\x00")
+
+// keepWhenStripping reports whether s is needed to display the image rather
+// than describing it: the JFIF header, an ICC profile and the Adobe colour
+// transform. Everything else, EXIF, XMP and comments included, is dropped.
+func keepWhenStripping(s jpegSegment) bool {
+	switch {
+	case s.marker == markerAPP0, s.marker == 0xEE:
+		return true
+	case s.marker == 0xE2:
+		return bytes.HasPrefix(s.payload, iccHeader)
+	case s.marker > markerAPP0 && s.marker <= 0xEF, s.marker == 0xFE:
+		return false
+	}
+	return true // tables and frame headers
+}
+
+// stripMetadata removes the metadata segments from the JPEG at path without
+// re-encoding it and returns its size before and after. The file is left
+// alone when it has nothing to strip.
+func stripMetadata(path string) (before, after int64, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	before = int64(len(data))
+	segments, scan, err := splitJPEG(data)
+	if err != nil {
+		return before, before, err
+	}
+
+	var kept []jpegSegment
+	for _, s := range segments {
+		if keepWhenStripping(s) {
+			kept = append(kept, s)
+		}
+	}
+	if len(kept) == len(segments) {
+		return before, before, nil
+	}
+	out := joinJPEG(kept, scan)
+	if err := replaceFile(path, out); err != nil {
+		return before, before, err
+	}
+	return before, int64(len(out)), nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// runSummary is the machine-readable result of a run written by -summary-json
+type runSummary struct {
+	Total           int64            `json:"total"`
+	Succeeded       int64            `json:"succeeded"`
+	Failed          int64            `json:"failed"`
+	Skipped         int64            `json:"skipped"`
+	NotStarted      int64            `json:"notStarted"`
+	NotFound        int64            `json:"notFound"`
+	Filtered        int64            `json:"filtered"`
+	Substituted     int64            `json:"substituted"`
+	Retried         int64            `json:"retried"`
+	RetryAttempts   int64            `json:"retryAttempts"`
+	Stalls          int64            `json:"stalls"`
+	Bytes           int64            `json:"bytes"`
+	DurationSeconds float64          `json:"durationSeconds"`
+	ExitCode        int              `json:"exitCode"`
+	Failures        []failureSummary `json:"failures"`
+}
+
+// failureSummary describes one failed download
+type failureSummary struct {
+	File  string `json:"file"`
+	Error string `json:"error"`
+}
+
+// summary collects the run's results so far
+func (pd *PhotoDownloader) summary(started time.Time, exitCode int) runSummary {
+	s := &pd.stats
+	summary := runSummary{
+		Succeeded:       s.downloaded.Load(),
+		Failed:          s.failed.Load(),
+		Skipped:         s.skipped.Load(),
+		NotStarted:      s.timeLimited.Load() + s.authAborted.Load() + s.byteCapped.Load() + s.canceled.Load(),
+		NotFound:        s.notFound.Load(),
+		Filtered:        s.filtered.Load(),
+		Substituted:     s.substituted.Load(),
+		Retried:         s.retriedSuccess.Load(),
+		RetryAttempts:   s.retryAttempts.Load(),
+		Stalls:          s.stalls.Load(),
+		Bytes:           s.bytes.Load(),
+		DurationSeconds: time.Since(started).Seconds(),
+		ExitCode:        exitCode,
+		Failures:        []failureSummary{},
+	}
+	summary.Total = summary.Succeeded + summary.Failed + summary.Skipped + summary.NotStarted + summary.NotFound
+
+	pd.mu.Lock()
+	for _, f := range pd.failures {
+		summary.Failures = append(summary.Failures, failureSummary{File: f.filename, Error: f.err.Error()})
+	}
+	pd.mu.Unlock()
+	return summary
+}
+
+// writeSummary writes the run's results as JSON to path, or to stdout when
+// path is "-"
+func (pd *PhotoDownloader) writeSummary(path string, started time.Time, exitCode int) error {
+	data, err := json.MarshalIndent(pd.summary(started, exitCode), "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding summary: %v", err)
+	}
+	if path == "-" {
+		fmt.Println(string(data))
+		return nil
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing summary: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// phaseTimes accumulates the time and bytes of each phase of a run for
+// -verbose-timing. Time spent by concurrent workers is summed, so a phase can
+// add up to more than the run's wall time.
+type phaseTimes struct {
+	catalog, download, post        atomic.Int64 // nanoseconds
+	catalogRequests                atomic.Int64
+	catalogBytes, postBytes, posts atomic.Int64
+}
+
+// phases is global because catalog requests are made before any
+// PhotoDownloader exists
+var phases phaseTimes
+
+// add records the time elapsed since start against a phase counter
+func (p *phaseTimes) add(phase *atomic.Int64, start time.Time) {
+	phase.Add(int64(time.Since(start)))
+}
+
+// print writes the breakdown, given the bytes downloaded and the run's wall time
+func (p *phaseTimes) print(downloaded int64, wall time.Duration) {
+	mb := func(n int64) float64 { return float64(n) / (1 << 20) }
+	dur := func(n int64) time.Duration { return time.Duration(n).Round(time.Millisecond) }
+	fmt.Println("Time by phase (summed across concurrent workers):")
+	fmt.Printf("  catalog          %10v  %8.1f MB in %d requests\n", dur(p.catalog.Load()), mb(p.catalogBytes.Load()), p.catalogRequests.Load())
+	fmt.Printf("  download         %10v  %8.1f MB\n", dur(p.download.Load()), mb(downloaded))
+	fmt.Printf("  post-processing  %10v  %8.1f MB in %d files\n", dur(p.post.Load()), mb(p.postBytes.Load()), p.posts.Load())
+	fmt.Printf("  wall time        %10v\n", wall.Round(time.Millisecond))
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// tokenExpiryMargin is how little validity a token may have left before
+// -verify-token-expiry warns that it may run out mid-run
+const tokenExpiryMargin = time.Hour
+
+// errTokenExpired is returned by verifyTokens for a token past its expiry
+var errTokenExpired = errors.New("expired")
+
+// tokenExpiry returns the exp claim of id when it is a JWT that has one.
+// The signature is not checked; only the server can do that.
+func tokenExpiry(id string) (time.Time, bool) {
+	parts := strings.Split(id, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp *float64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(*claims.Exp), 0), true
+}
+
+// verifyTokens checks every token before a run. Tokens that carry an expiry
+// fail if it has passed and warn if it is near; opaque ones are probed with a
+// one-photo listing instead.
+func verifyTokens(tokens []string, list listFunc, now time.Time) error {
+	for _, token := range tokens {
+		_, id := splitToken(token)
+		if exp, ok := tokenExpiry(id); ok {
+			left := exp.Sub(now).Round(time.Second)
+			switch {
+			case left <= 0:
+				return fmt.Errorf("token %s: %w %v ago, at %s", tokenLabel(token), errTokenExpired, -left, exp.Format(time.RFC3339))
+			case left < tokenExpiryMargin:
+				logf("Warning: token %s expires in %v, at %s; refresh it before a long run\n", tokenLabel(token), left, exp.Format(time.RFC3339))
+			default:
+				logf("Token %s is valid for about %v more, until %s\n", tokenLabel(token), left, exp.Format(time.RFC3339))
+			}
+			continue
+		}
+
+		if _, err := list(context.Background(), token, 1, 1); err != nil {
+			return fmt.Errorf("token %s failed a test listing: %w", tokenLabel(token), err)
+		}
+		logf("Token %s has no readable expiry but the API accepts it\n", tokenLabel(token))
+	}
+	return nil
+}
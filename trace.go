@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// traceOut receives -trace output; kept off stdout so it never mixes with
+// piped images or JSON summaries
+var traceOut io.Writer = os.Stderr
+
+// traceMu keeps the lines of one traced request together
+var traceMu sync.Mutex
+
+// tracingTransport logs the headers and connection timings of each request
+type tracingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	var dnsStart, connStart, tlsStart time.Time
+	var dns, conn, handshake, firstByte time.Duration
+	reused := false
+	trace := &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone:              func(httptrace.DNSDoneInfo) { dns = time.Since(dnsStart) },
+		ConnectStart:         func(string, string) { connStart = time.Now() },
+		ConnectDone:          func(string, string, error) { conn = time.Since(connStart) },
+		TLSHandshakeStart:    func() { tlsStart = time.Now() },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { handshake = time.Since(tlsStart) },
+		GotConn:              func(info httptrace.GotConnInfo) { reused = info.Reused },
+		GotFirstResponseByte: func() { firstByte = time.Since(start) },
+	}
+	resp, err := t.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "trace: %s %s\n", req.Method, redactToken(req.URL.String()))
+	writeHeaders(&b, "  > ", req.Header)
+	if reused {
+		fmt.Fprintf(&b, "  reused connection, first byte %v\n", firstByte.Round(time.Millisecond))
+	} else {
+		fmt.Fprintf(&b, "  dns %v, connect %v, tls %v, first byte %v\n", dns.Round(time.Millisecond),
+			conn.Round(time.Millisecond), handshake.Round(time.Millisecond), firstByte.Round(time.Millisecond))
+	}
+	if err != nil {
+		fmt.Fprintf(&b, "  error: %v\n", err)
+	} else {
+		fmt.Fprintf(&b, "  < %s %s\n", resp.Proto, resp.Status)
+		writeHeaders(&b, "  < ", resp.Header)
+	}
+
+	traceMu.Lock()
+	io.WriteString(traceOut, b.String())
+	traceMu.Unlock()
+	return resp, err
+}
+
+// writeHeaders writes h sorted by name, hiding credentials and the
+// -headers-file headers, which often carry anti-bot tokens
+func writeHeaders(b *strings.Builder, prefix string, h http.Header) {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range h[name] {
+			switch http.CanonicalHeaderKey(name) {
+			case "Authorization", "Cookie", "Set-Cookie", http.CanonicalHeaderKey(authHeaderName):
+				v = "REDACTED"
+			}
+			if extraHeaders[http.CanonicalHeaderKey(name)] != nil {
+				v = "REDACTED"
+			}
+			fmt.Fprintf(b, "%s%s: %s\n", prefix, name, v)
+		}
+	}
+}
+
+// traced wraps rt so its requests are logged by -trace
+func traced(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &tracingTransport{next: rt}
+}
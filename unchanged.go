@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// catalogHashName is the file in outputDir holding a hash of the listing of
+// the last fully successful -skip-if-unchanged run, per token set
+const catalogHashName = ".catalog-hash.json"
+
+// catalogHashes holds the listing hashes saved by earlier runs
+type catalogHashes struct {
+	path  string
+	saved map[string]string // cacheKey to hex sha256
+}
+
+// loadCatalogHashes reads the hashes saved in path; a missing file means no
+// listing has been recorded yet
+func loadCatalogHashes(path string) (*catalogHashes, error) {
+	h := &catalogHashes{path: path, saved: make(map[string]string)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading catalog hash: %v", err)
+	}
+	if err := json.Unmarshal(data, &h.saved); err != nil {
+		return nil, fmt.Errorf("error parsing catalog hash in %s: %v", path, err)
+	}
+	return h, nil
+}
+
+// catalogHash sums what identifies each photo and decides what a run does
+// with it, in ID order. URLs are left out because their signatures change
+// on every listing.
+func catalogHash(photos []Photo) string {
+	lines := make([]string, len(photos))
+	for i, p := range photos {
+		lines[i] = fmt.Sprintf("%s/%s %s %s %t %t %t %d %s\n", photoRegion(p), p.ID, p.PhotoCode, p.ModifiedOn.Time().UTC(),
+			p.IsPaid, p.AllowDownload, p.Disabled, p.EditCount, p.ExpireDate)
+	}
+	sort.Strings(lines)
+	sum := sha256.New()
+	for _, line := range lines {
+		sum.Write([]byte(line))
+	}
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// unchanged reports whether hash matches the one saved for key
+func (h *catalogHashes) unchanged(key, hash string) bool {
+	return h.saved[key] == hash
+}
+
+// save records hash for key for the next run
+func (h *catalogHashes) save(key, hash string) error {
+	h.saved[key] = hash
+	data, err := json.MarshalIndent(h.saved, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding catalog hash: %v", err)
+	}
+	if err := os.WriteFile(h.path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error saving catalog hash: %v", err)
+	}
+	return nil
+}
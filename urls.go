@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// exportURLs writes the resolved URL of every file photos would download to
+// path in aria2's input format, each followed by an out= line with the name
+// it would be saved as under outputDir. The URLs are not fetched.
+func (pd *PhotoDownloader) exportURLs(photos []Photo, sizes []string, path string) (int, error) {
+	var b strings.Builder
+	n := 0
+	for _, photo := range photos {
+		downloads, problems := pd.plan(photo, sizes)
+		for _, p := range problems {
+			logf("%s\n", p)
+		}
+		for _, d := range downloads {
+			fmt.Fprintf(&b, "%s\n  out=%s\n", d.url, filepath.ToSlash(d.filename))
+			n++
+		}
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		return 0, fmt.Errorf("error writing URL list: %v", err)
+	}
+	return n, nil
+}
+
+// readURLList reads a -urls-file: one URL per line, optionally followed by
+// whitespace and the name to save it as. Blank lines and # comments are
+// ignored. Each URL becomes a Photo that plan downloads as-is.
+func readURLList(file string) ([]Photo, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("error opening URL list: %v", err)
+	}
+	defer f.Close()
+
+	var photos []Photo
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		u, err := url.Parse(fields[0])
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%s:%d: invalid URL %q", file, line, fields[0])
+		}
+
+		name := ""
+		if len(fields) > 1 {
+			name = strings.Join(fields[1:], " ")
+		} else {
+			name = defaultURLName(u)
+		}
+		if name == "" || strings.Contains(name, "..") || path.IsAbs(name) {
+			return nil, fmt.Errorf("%s:%d: invalid output name %q", file, line, name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("%s:%d: output name %q is used more than once", file, line, name)
+		}
+		seen[name] = true
+
+		photos = append(photos, Photo{ID: u.String(), PhotoCode: name, DirectURL: u.String()})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading URL list: %v", err)
+	}
+	if len(photos) == 0 {
+		return nil, fmt.Errorf("no URLs found in %s", file)
+	}
+	return photos, nil
+}
+
+// defaultURLName names a download after the last element of its URL path,
+// falling back to a hash of the URL when the path has no usable name
+func defaultURLName(u *url.URL) string {
+	base := path.Base(u.Path)
+	if base == "/" || base == "." || base == "" {
+		sum := sha256.Sum256([]byte(u.String()))
+		return hex.EncodeToString(sum[:8]) + ".jpg"
+	}
+	ext := path.Ext(base)
+	name := sanitizeField(strings.TrimSuffix(base, ext))
+	if ext == "" {
+		ext = ".jpg"
+	}
+	return name + sanitizeField(ext)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"strings"
+)
+
+// validateImage decodes the header of the file at path and checks that it is
+// an image of the type mimeType (JPEG when empty). Formats the standard
+// library cannot decode are accepted on their sniffed signature alone.
+func validateImage(path, mimeType string) error {
+	switch mimeType {
+	case "image/webp", "image/heic", "image/heif":
+		return nil
+	}
+	if mimeType != "" && !strings.HasPrefix(mimeType, "image/") {
+		return fmt.Errorf("downloaded file is %s, not an image", mimeType)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening file for validation: %v", err)
+	}
+	defer f.Close()
+
+	_, format, err := image.DecodeConfig(f)
+	if err != nil {
+		return fmt.Errorf("downloaded file is not a valid image: %v", err)
+	}
+
+	expected := "jpeg"
+	if strings.HasPrefix(mimeType, "image/") {
+		expected = strings.TrimPrefix(mimeType, "image/")
+	}
+	if format != expected {
+		return fmt.Errorf("downloaded file is %s, expected %s", format, expected)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// verifyReport is the result of checking local files against the checksums
+// and ETags recorded in the manifest
+type verifyReport struct {
+	ok         int
+	unverified []string        // recorded files with no checksum or content ETag to compare
+	corrupt    []string        // files whose contents no longer match
+	missing    []string        // recorded files that are gone
+	extra      []string        // local files the manifest does not list
+	damaged    map[string]bool // photoKeys of photos with a corrupt or missing file
+}
+
+// contentMD5 returns the digest in etag when it is a strong ETag holding the
+// hex MD5 of the body, as many CDNs and object stores send, or "" otherwise
+func contentMD5(etag string) string {
+	digest := strings.Trim(etag, `"`)
+	if strings.HasPrefix(etag, "W/") || len(digest) != 2*md5.Size {
+		return ""
+	}
+	if _, err := hex.DecodeString(digest); err != nil {
+		return ""
+	}
+	return strings.ToLower(digest)
+}
+
+// md5File returns the hex MD5 of the file at path
+func md5File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verify rehashes every file recorded in the manifest without contacting the
+// API. Files without a SHA-256 are compared against their ETag when it is a
+// content MD5.
+func (m *Manifest) verify() (*verifyReport, error) {
+	type recorded struct{ key, name, sum, etag string }
+	var files []recorded
+	m.mu.Lock()
+	for _, e := range m.entries {
+		for size, name := range e.Files {
+			files = append(files, recorded{e.key(), name, e.Checksums[size], contentMD5(e.ETags[size])})
+		}
+	}
+	m.mu.Unlock()
+
+	r := &verifyReport{damaged: make(map[string]bool)}
+	claimed := make(map[string]bool)
+	for _, f := range files {
+		claimed[f.name] = true
+		claimed[sidecarName(f.name)] = true
+		sum, err := hashFile(filepath.Join(m.dir, f.name))
+		switch {
+		case os.IsNotExist(err):
+			r.missing = append(r.missing, f.name)
+			r.damaged[f.key] = true
+		case err != nil:
+			return nil, fmt.Errorf("error reading %s: %v", f.name, err)
+		case f.sum == "" && f.etag != "":
+			if digest, err := md5File(filepath.Join(m.dir, f.name)); err != nil {
+				return nil, fmt.Errorf("error reading %s: %v", f.name, err)
+			} else if digest != f.etag {
+				r.corrupt = append(r.corrupt, f.name)
+				r.damaged[f.key] = true
+			} else {
+				r.ok++
+			}
+		case f.sum == "":
+			r.unverified = append(r.unverified, f.name)
+		case sum != f.sum:
+			r.corrupt = append(r.corrupt, f.name)
+			r.damaged[f.key] = true
+		default:
+			r.ok++
+		}
+	}
+
+	err := filepath.WalkDir(m.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(m.dir, path)
+		if err != nil {
+			return err
+		}
+		if !bookkeepingFile(name) && !claimed[name] {
+			r.extra = append(r.extra, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error scanning %s: %v", m.dir, err)
+	}
+
+	sort.Strings(r.unverified)
+	sort.Strings(r.corrupt)
+	sort.Strings(r.missing)
+	sort.Strings(r.extra)
+	return r, nil
+}
+
+// print writes the problems found and a one-line tally
+func (r *verifyReport) print() {
+	section := func(title string, names []string) {
+		if len(names) == 0 {
+			return
+		}
+		fmt.Printf("%s (%d):\n", title, len(names))
+		for _, name := range names {
+			fmt.Printf("  %s\n", name)
+		}
+	}
+	section("Corrupt", r.corrupt)
+	section("Missing", r.missing)
+	section("Not in manifest", r.extra)
+	section("No checksum or ETag recorded", r.unverified)
+	fmt.Printf("%d files verified, %d corrupt, %d missing, %d extra, %d unverified\n",
+		r.ok, len(r.corrupt), len(r.missing), len(r.extra), len(r.unverified))
+}
+
+// removeCorrupt deletes the corrupt files so the next download replaces them
+func (r *verifyReport) removeCorrupt(dir string) error {
+	for _, name := range r.corrupt {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("error removing corrupt %s: %v", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import "time"
+
+// warmUp starts downloads at one at a time by holding back every other slot
+// of sem, then hands the slots back evenly over d so a cold start does not hit
+// the CDN at full concurrency. The returned func stops the ramp early.
+func warmUp(sem chan struct{}, d time.Duration) func() {
+	held := cap(sem) - 1
+	if held <= 0 || d <= 0 {
+		return func() {}
+	}
+	for i := 0; i < held; i++ {
+		sem <- struct{}{}
+	}
+	logf("Warming up from 1 to %d concurrent downloads over %v\n", cap(sem), d)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(d / time.Duration(held))
+		defer ticker.Stop()
+		for ; held > 0; held-- {
+			select {
+			case <-ticker.C:
+				<-sem
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
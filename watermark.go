@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"slices"
+)
+
+// watermarkPositions lists the corners and centre -watermark-pos accepts
+var watermarkPositions = []string{"top-left", "top-right", "bottom-left", "bottom-right", "center"}
+
+// watermark is an overlay composited onto each downloaded JPEG
+type watermark struct {
+	img     image.Image
+	pos     string
+	opacity float64 // 0 (invisible) to 1 (as drawn)
+}
+
+// loadWatermark reads the PNG overlay at path
+func loadWatermark(path, pos string, opacity float64) (*watermark, error) {
+	if !slices.Contains(watermarkPositions, pos) {
+		return nil, fmt.Errorf("unknown -watermark-pos %q, expected top-left, top-right, bottom-left, bottom-right or center", pos)
+	}
+	if opacity <= 0 || opacity > 1 {
+		return nil, fmt.Errorf("-watermark-opacity must be above 0 and at most 1, got %g", opacity)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening watermark: %v", err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding watermark %s: %v", path, err)
+	}
+	return &watermark{img: img, pos: pos, opacity: opacity}, nil
+}
+
+// placement returns where the overlay goes on an image with bounds b, inset
+// from the edges by a margin proportional to the image size
+func (w *watermark) placement(b image.Rectangle) image.Rectangle {
+	size := w.img.Bounds().Size()
+	margin := min(b.Dx(), b.Dy()) / 50
+	x := b.Min.X + margin
+	y := b.Min.Y + margin
+	switch w.pos {
+	case "top-right":
+		x = b.Max.X - margin - size.X
+	case "bottom-left":
+		y = b.Max.Y - margin - size.Y
+	case "bottom-right":
+		x = b.Max.X - margin - size.X
+		y = b.Max.Y - margin - size.Y
+	case "center":
+		x = b.Min.X + (b.Dx()-size.X)/2
+		y = b.Min.Y + (b.Dy()-size.Y)/2
+	}
+	return image.Rectangle{Min: image.Pt(x, y), Max: image.Pt(x+size.X, y+size.Y)}
+}
+
+// apply composites the overlay onto the JPEG at path, keeping its metadata
+func (w *watermark) apply(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	segments, _, err := splitJPEG(data)
+	if err != nil {
+		return err
+	}
+	src, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("error decoding image: %v", err)
+	}
+
+	dst := image.NewRGBA(src.Bounds())
+	draw.Draw(dst, dst.Bounds(), src, src.Bounds().Min, draw.Src)
+	mask := image.NewUniform(color.Alpha{A: uint8(w.opacity * 255)})
+	draw.DrawMask(dst, w.placement(dst.Bounds()), w.img, w.img.Bounds().Min, mask, image.Point{}, draw.Over)
+
+	out, err := encodeKeepingSegments(dst, segments, orientQuality)
+	if err != nil {
+		return err
+	}
+	return replaceFile(path, out)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Webhook delivery is best-effort: events wait in a small buffer, each is
+// tried a few times, and anything that cannot keep up is dropped rather than
+// slowing downloads
+const (
+	webhookBuffer   = 256
+	webhookAttempts = 3
+	webhookTimeout  = 10 * time.Second
+)
+
+// webhookEvent is the JSON body POSTed to -webhook
+type webhookEvent struct {
+	Event     string      `json:"event"` // "download" or "summary"
+	PhotoCode string      `json:"photoCode,omitempty"`
+	Size      string      `json:"size,omitempty"`
+	File      string      `json:"file,omitempty"`
+	Status    string      `json:"status,omitempty"` // "ok" or "failed"
+	Bytes     int64       `json:"bytes,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Summary   *runSummary `json:"summary,omitempty"`
+}
+
+// webhook POSTs events to a URL from a background goroutine
+type webhook struct {
+	url     string
+	client  *http.Client
+	events  chan webhookEvent
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+// startWebhook begins delivering events to url
+func startWebhook(url string) *webhook {
+	w := &webhook{
+		url:    url,
+		client: &http.Client{Timeout: webhookTimeout},
+		events: make(chan webhookEvent, webhookBuffer),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(w.done)
+		for ev := range w.events {
+			if err := w.deliver(ev); err != nil {
+				logf("Webhook: %v\n", err)
+			}
+		}
+	}()
+	return w
+}
+
+// send queues ev without waiting, dropping it when the buffer is full
+func (w *webhook) send(ev webhookEvent) {
+	select {
+	case w.events <- ev:
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+// deliver POSTs ev, retrying failures
+func (w *webhook) deliver(ev webhookEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("error encoding event: %v", err)
+	}
+	for attempt := 1; ; attempt++ {
+		err = w.post(body)
+		if err == nil || attempt == webhookAttempts {
+			return err
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+// post sends one request
+func (w *webhook) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error posting event: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("event rejected with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Close delivers the events still queued and stops, giving up after one
+// more webhookTimeout so an unreachable hook cannot hold the run open
+func (w *webhook) Close() {
+	close(w.events)
+	select {
+	case <-w.done:
+	case <-time.After(webhookTimeout):
+		logf("Webhook: gave up delivering the remaining events\n")
+	}
+	if n := w.dropped.Load(); n > 0 {
+		logf("Webhook: dropped %d events that arrived faster than they could be sent\n", n)
+	}
+}
+
+// notifyDownload sends the outcome of d to the webhook, if any
+func (pd *PhotoDownloader) notifyDownload(d download, err error) {
+	if pd.webhook == nil {
+		return
+	}
+	ev := webhookEvent{Event: "download", PhotoCode: d.photo.PhotoCode, Size: d.key, File: d.filename, Status: "ok"}
+	if err != nil {
+		ev.Status, ev.Error = "failed", err.Error()
+	} else {
+		if name := pd.manifest.fileFor(d.photo, d.key); name != "" {
+			ev.File = name
+		}
+		ev.Bytes = pd.manifest.bytesFor(d.photo, d.key)
+	}
+	pd.webhook.send(ev)
+}
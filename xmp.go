@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// xmpTemplate renders a sidecar readable by Lightroom, digiKam and exiftool.
+// Values are XML-escaped by the esc function.
+var xmpTemplate = template.Must(template.New("xmp").Funcs(template.FuncMap{"esc": xmlEscape}).Parse(`<?xpacket begin="` + "\ufeff" + `" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:dc="http://purl.org/dc/elements/1.1/"
+    xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+    xmlns:photoshop="http://ns.adobe.com/photoshop/1.0/"
+    xmlns:exif="http://ns.adobe.com/exif/1.0/"
+    xmlns:Iptc4xmpCore="http://iptc.org/std/Iptc4xmpCore/1.0/xmlns/"
+    xmlns:dpa="https://github.com/geoffreyma92/disney-photo-api/ns/1.0/">
+   <dc:identifier>{{esc .PhotoCode}}</dc:identifier>
+   <dc:source>Disney PhotoPass</dc:source>
+{{- if .CreatedBy}}
+   <dc:creator>
+    <rdf:Seq>
+     <rdf:li>{{esc .CreatedBy}}</rdf:li>
+    </rdf:Seq>
+   </dc:creator>
+{{- end}}
+{{- if .Date}}
+   <xmp:CreateDate>{{.Date}}</xmp:CreateDate>
+   <photoshop:DateCreated>{{.Date}}</photoshop:DateCreated>
+   <exif:DateTimeOriginal>{{.Date}}</exif:DateTimeOriginal>
+{{- end}}
+{{- if .LocationID}}
+   <Iptc4xmpCore:Location>{{esc .LocationID}}</Iptc4xmpCore:Location>
+{{- end}}
+{{- if .Latitude}}
+   <exif:GPSLatitude>{{.Latitude}}</exif:GPSLatitude>
+   <exif:GPSLongitude>{{.Longitude}}</exif:GPSLongitude>
+{{- end}}
+   <dpa:PhotoID>{{esc .ID}}</dpa:PhotoID>
+   <dpa:LikeCount>{{.LikeCount}}</dpa:LikeCount>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>
+`))
+
+// xmpFields are the values available to xmpTemplate
+type xmpFields struct {
+	ID, PhotoCode, CreatedBy, LocationID string
+	Date                                 string // ISO 8601, empty when unknown
+	Latitude, Longitude                  string // XMP GPS coordinates, empty when unknown
+	LikeCount                            int
+}
+
+// sidecarName is the XMP sidecar path for an image, named the way Lightroom
+// expects: the image name with its extension replaced by .xmp
+func sidecarName(filename string) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + ".xmp"
+}
+
+// writeSidecar writes the XMP sidecar for a downloaded image of photo
+func (pd *PhotoDownloader) writeSidecar(photo Photo, filename string) error {
+	fields := xmpFields{
+		ID:         photo.ID,
+		PhotoCode:  photo.PhotoCode,
+		CreatedBy:  photo.CreatedBy,
+		LocationID: photo.LocationID,
+		LikeCount:  photo.LikeCount,
+	}
+	if shootOn := shootTime(photo); !shootOn.IsZero() {
+		fields.Date = shootOn.Format(time.RFC3339)
+	}
+	if c, ok := pd.locationCoords[photo.LocationID]; ok {
+		fields.Latitude = xmpCoordinate(c.lat, "N", "S")
+		fields.Longitude = xmpCoordinate(c.lon, "E", "W")
+	}
+
+	var b bytes.Buffer
+	if err := xmpTemplate.Execute(&b, fields); err != nil {
+		return fmt.Errorf("error rendering XMP: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(outputDir, sidecarName(filename)), b.Bytes(), 0644); err != nil {
+		return fmt.Errorf("error writing XMP sidecar: %v", err)
+	}
+	return nil
+}
+
+// sidecar writes the sidecar for filename, logging rather than failing the
+// download when it cannot
+func (pd *PhotoDownloader) sidecar(photo Photo, filename string) {
+	if err := pd.writeSidecar(photo, filename); err != nil {
+		logf("Could not write sidecar for %s: %v\n", filename, err)
+	}
+}
+
+// xmpCoordinate formats decimal degrees as an XMP GPSCoordinate, e.g. 22,18.774N
+func xmpCoordinate(deg float64, pos, neg string) string {
+	ref := pos
+	if deg < 0 {
+		ref = neg
+	}
+	deg = math.Abs(deg)
+	d := math.Floor(deg)
+	return fmt.Sprintf("%d,%.4f%s", int(d), (deg-d)*60, ref)
+}
+
+// xmlEscape escapes s for use as XML character data
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}